@@ -0,0 +1,311 @@
+package gcedns
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/pubsub/v1"
+)
+
+/* Audit trail
+Every applied recordSet change is recorded with who created or deleted the VM, from where,
+the before and after rrdatas and the decision that led to it, for compliance reviews.
+Records are flat JSON objects, loadable into BigQuery as newline delimited JSON.
+DNS_AUDIT_TRAIL selects the sink:
+- "" (default): the function log
+- file:///path/audit.ndjson
+- pubsub://projects/PROJECT/topics/TOPIC: a message per record
+- bigquery://PROJECT/DATASET/TABLE: streaming inserts into an existing table
+*/
+
+var auditTrail = newAuditSink(os.Getenv("DNS_AUDIT_TRAIL"))
+
+type auditRecord struct {
+	Time           time.Time `json:"time"`
+	EventID        string    `json:"event_id,omitempty"`
+	EventTime      time.Time `json:"event_time,omitempty"`
+	PrincipalEmail string    `json:"principal_email,omitempty"`
+	CallerIP       string    `json:"caller_ip,omitempty"`
+	VMProject      string    `json:"vm_project"`
+	Instance       string    `json:"instance"`
+	InstanceID     string    `json:"instance_id,omitempty"`
+	Action         string    `json:"action"`
+	DnsProject     string    `json:"dns_project"`
+	Zone           string    `json:"zone"`
+	FQDN           string    `json:"fqdn"`
+	RecordType     string    `json:"record_type"`
+	Change         string    `json:"change"`
+	Before         []string  `json:"before"`
+	After          []string  `json:"after"`
+	Decision       string    `json:"decision"`
+	ConflictPolicy string    `json:"conflict_policy,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+	Replayed       bool      `json:"replayed,omitempty"`
+}
+
+// The event behind the changes, collects the recordSets changed on its behalf
+type auditEvent struct {
+	EventID        string
+	EventTime      time.Time
+	PrincipalEmail string
+	CallerIP       string
+	VMProject      string
+	Instance       string
+	InstanceID     string
+	Action         string
+
+	sync.Mutex
+	changes []auditChange
+}
+
+type auditChange struct {
+	Project string
+	Zone    string
+	Name    string
+	Type    string
+	Before  []string
+	After   []string
+	Exists  bool
+}
+
+type auditKey struct{}
+
+func withAuditEvent(ctx context.Context, logMessage logMetadata) context.Context {
+	return context.WithValue(ctx, auditKey{}, &auditEvent{
+		EventID:        logMessage.InsertID,
+		EventTime:      logMessage.Timestamp,
+		PrincipalEmail: logMessage.ProtoPayload.AuthenticationInfo.PrincipalEmail,
+		CallerIP:       logMessage.ProtoPayload.RequestMetadata.CallerIP,
+		VMProject:      logMessage.Resource.Labels.ProjectID,
+		Instance:       logMessage.ProtoPayload.ResourceName,
+		InstanceID:     logMessage.Resource.Labels.InstanceID,
+		Action:         eventType(logMessage),
+	})
+}
+
+func eventAudit(ctx context.Context) *auditEvent {
+	event, _ := ctx.Value(auditKey{}).(*auditEvent)
+	return event
+}
+
+// Recordsets of applied zone changes, a deletion and addition of the same name and type is one change
+func (e *auditEvent) addChanges(changes []*zoneChange) {
+	if e == nil {
+		return
+	}
+	for _, zc := range changes {
+		var recordsets []*auditChange
+		find := func(record rrset) *auditChange {
+			for _, c := range recordsets {
+				if c.Name == record.Name && c.Type == record.Type {
+					return c
+				}
+			}
+			recordsets = append(recordsets, &auditChange{Project: zc.Project, Zone: zc.Zone, Name: record.Name, Type: record.Type})
+			return recordsets[len(recordsets)-1]
+		}
+		for _, record := range zc.Change.Deletions {
+			c := find(record)
+			c.Before, c.Exists = record.Rrdatas, true
+		}
+		for _, record := range zc.Change.Additions {
+			find(record).After = record.Rrdatas
+		}
+		for _, c := range recordsets {
+			e.addChange(*c)
+		}
+	}
+}
+
+func (e *auditEvent) addChange(change auditChange) {
+	if e == nil {
+		return
+	}
+	e.Lock()
+	defer e.Unlock()
+	e.changes = append(e.changes, change)
+}
+
+// Records the changes made for the result, the decision is the result's status
+func auditResult(ctx context.Context, result dnsResult) {
+	e := eventAudit(ctx)
+	// Dry runs change nothing
+	if e == nil || dryRun {
+		return
+	}
+	e.Lock()
+	changes := e.changes
+	e.changes = nil
+	e.Unlock()
+
+	for _, change := range changes {
+		record := auditRecord{
+			Time:           time.Now().UTC(),
+			EventID:        e.EventID,
+			EventTime:      e.EventTime,
+			PrincipalEmail: e.PrincipalEmail,
+			CallerIP:       e.CallerIP,
+			VMProject:      e.VMProject,
+			Instance:       e.Instance,
+			InstanceID:     e.InstanceID,
+			Action:         e.Action,
+			DnsProject:     change.Project,
+			Zone:           change.Zone,
+			FQDN:           change.Name,
+			RecordType:     change.Type,
+			Before:         change.Before,
+			After:          change.After,
+			Decision:       result.Status,
+			ConflictPolicy: result.Conflict,
+			Reason:         result.Reason,
+			Replayed:       replaying,
+		}
+		switch {
+		case !change.Exists:
+			record.Change = "created"
+		case len(change.After) == 0:
+			record.Change = "deleted"
+		default:
+			record.Change = "patched"
+		}
+		if record.Before == nil {
+			record.Before = []string{}
+		}
+		if record.After == nil {
+			record.After = []string{}
+		}
+		if err := auditTrail.write(ctx, record); err != nil {
+			fmt.Printf("Error writing audit record of %v %v: %v\n", record.FQDN, record.RecordType, err)
+		}
+	}
+}
+
+type auditSink interface {
+	write(ctx context.Context, record auditRecord) error
+}
+
+func newAuditSink(config string) auditSink {
+	switch {
+	case strings.HasPrefix(config, "file://"):
+		return &fileAuditSink{Path: strings.TrimPrefix(config, "file://")}
+	case strings.HasPrefix(config, "pubsub://"):
+		return &pubsubAuditSink{Topic: strings.TrimPrefix(config, "pubsub://")}
+	case strings.HasPrefix(config, "bigquery://"):
+		table := strings.SplitN(strings.TrimPrefix(config, "bigquery://"), "/", 3)
+		if len(table) == 3 {
+			return &bigqueryAuditSink{Project: table[0], Dataset: table[1], Table: table[2]}
+		}
+		fmt.Printf("Invalid DNS_AUDIT_TRAIL %q, audit records are logged\n", config)
+	case config != "":
+		fmt.Printf("Unknown DNS_AUDIT_TRAIL %q, audit records are logged\n", config)
+	}
+	return logAuditSink{}
+}
+
+type logAuditSink struct{}
+
+func (logAuditSink) write(ctx context.Context, record auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("DNS audit: %s\n", line)
+	return nil
+}
+
+type fileAuditSink struct {
+	Path string
+	sync.Mutex
+}
+
+func (f *fileAuditSink) write(ctx context.Context, record auditRecord) error {
+	f.Lock()
+	defer f.Unlock()
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+type pubsubAuditSink struct {
+	Topic string
+}
+
+func (p *pubsubAuditSink) write(ctx context.Context, record auditRecord) error {
+	ps, err := pubsub.NewService(ctx)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	request := &pubsub.PublishRequest{Messages: []*pubsub.PubsubMessage{{
+		Data:       base64.StdEncoding.EncodeToString(line),
+		Attributes: map[string]string{"fqdn": record.FQDN, "change": record.Change, "vm_project": record.VMProject},
+	}}}
+	return withRetry(ctx, "pubsub.topics.publish", func() error {
+		_, err := ps.Projects.Topics.Publish(p.Topic, request).Context(ctx).Do()
+		return err
+	})
+}
+
+type bigqueryAuditSink struct {
+	Project string
+	Dataset string
+	Table   string
+
+	once    sync.Once
+	service *bigquery.Service
+	err     error
+}
+
+func (b *bigqueryAuditSink) write(ctx context.Context, record auditRecord) error {
+	b.once.Do(func() {
+		b.service, b.err = bigquery.NewService(context.Background())
+	})
+	if b.err != nil {
+		return b.err
+	}
+
+	// Same columns as the NDJSON records
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	row := map[string]bigquery.JsonValue{}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&row); err != nil {
+		return err
+	}
+
+	// The insert ID makes retried inserts idempotent
+	request := &bigquery.TableDataInsertAllRequest{Rows: []*bigquery.TableDataInsertAllRequestRows{{
+		InsertId: fmt.Sprintf("%v/%v/%v/%v", record.EventID, record.Zone, record.FQDN, record.RecordType),
+		Json:     row,
+	}}}
+	return withRetry(ctx, "bigquery.tabledata.insertAll", func() error {
+		response, err := b.service.Tabledata.InsertAll(b.Project, b.Dataset, b.Table, request).Context(ctx).Do()
+		if err == nil && len(response.InsertErrors) > 0 && len(response.InsertErrors[0].Errors) > 0 {
+			return fmt.Errorf("insert error: %v", response.InsertErrors[0].Errors[0].Message)
+		}
+		return err
+	})
+}
@@ -0,0 +1,100 @@
+package gcedns
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func setupTestAuditTrail(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "audit.ndjson")
+	auditTrail = newAuditSink("file://" + path)
+	t.Cleanup(func() { auditTrail = newAuditSink("") })
+	return path
+}
+
+func readAuditTrail(t *testing.T, path string) (records []auditRecord) {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := auditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("FAILED: invalid audit record %s: %v\n", scanner.Bytes(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func testAuditEvent() context.Context {
+	logMessage := logMetadata{}
+	json.Unmarshal(insertAuditLog(`[]`), &logMessage)
+	logMessage.ProtoPayload.AuthenticationInfo.PrincipalEmail = "jane@company.com"
+	logMessage.ProtoPayload.RequestMetadata.CallerIP = "10.128.0.9"
+	return withAuditEvent(context.Background(), logMessage)
+}
+
+func TestAuditTrail(t *testing.T) {
+	setupTestDns(t)
+	path := setupTestAuditTrail(t)
+
+	dnsInfo := DnsInfo{DnsHostName: "devserver01", Action: "create", IPs: []string{"10.0.0.5"}, VMName: "dev-vm-01", VMProject: "prj-dev-4328"}
+	dnsManagement(testAuditEvent(), dnsInfo)
+	dnsInfo.IPs, dnsInfo.VMName = []string{"10.0.0.6"}, "dev-vm-02"
+	dnsManagement(testAuditEvent(), dnsInfo)
+	// Denied, nothing changed
+	dnsManagement(testAuditEvent(), DnsInfo{DnsHostName: "prod01", Action: "create", IPs: []string{"10.0.0.7"}, VMName: "vm-03", VMProject: "prj-dev-4328"})
+
+	records := readAuditTrail(t, path)
+	if len(records) != 4 {
+		t.Fatalf("FAILED: got %v audit records expected 4: %+v\n", len(records), records)
+	}
+	first, merged := records[0], records[2]
+	if first.PrincipalEmail != "jane@company.com" || first.CallerIP != "10.128.0.9" || first.Instance != "projects/prj-dev-4328/zones/us-central1-a/instances/dev-vm-01" ||
+		first.Zone != "default-zone" || first.FQDN != "devserver01.gcp.company.com." || first.Change != "created" || first.Decision != dnsCreated {
+		t.Errorf("FAILED: got first record %+v\n", first)
+	}
+	if records[1].RecordType != "PTR" || records[1].Zone != "ptr-zone" {
+		t.Errorf("FAILED: got second record %+v expected the PTR\n", records[1])
+	}
+	if merged.Change != "patched" || !reflect.DeepEqual(merged.Before, []string{"10.0.0.5"}) || !reflect.DeepEqual(merged.After, []string{"10.0.0.5", "10.0.0.6"}) ||
+		merged.ConflictPolicy != conflictMerge {
+		t.Errorf("FAILED: got merged record %+v\n", merged)
+	}
+}
+
+func TestBatchAuditTrail(t *testing.T) {
+	setupTestDns(t)
+	startTestBatcher(t)
+	path := setupTestAuditTrail(t)
+
+	var wg sync.WaitGroup
+	for _, ip := range []string{"10.0.0.5", "10.0.0.6"} {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			groupManagement(testAuditEvent(), DnsInfo{DnsHostName: "devserver-pool", Action: "create", IPs: []string{ip}, VMName: "vm-" + ip, VMProject: "prj-dev-4328"})
+		}(ip)
+	}
+	wg.Wait()
+
+	// One record per event, with the recordSet before and after the batch
+	records := readAuditTrail(t, path)
+	if len(records) != 2 {
+		t.Fatalf("FAILED: got %v audit records expected 2: %+v\n", len(records), records)
+	}
+	for _, record := range records {
+		if record.Change != "created" || len(record.After) != 2 || record.PrincipalEmail != "jane@company.com" {
+			t.Errorf("FAILED: got %+v\n", record)
+		}
+	}
+}
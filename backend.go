@@ -0,0 +1,176 @@
+package gcedns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"google.golang.org/api/googleapi"
+)
+
+/* DNS backends
+Record management reads and writes zones through a dnsBackend. Cloud DNS is called with raw
+requests as the dns library drops routing policies, the in-memory backend stands in for tests.
+*/
+
+type dnsBackend interface {
+	// Recordsets of a zone by name and type, an empty name and type list the whole zone
+	listRecordSets(ctx context.Context, project, zone, dns_name, rs_type string) ([]rrset, error)
+	// Applies a change atomically, the returned change carries its ID and status
+	createChange(ctx context.Context, project, zone string, change rrChange) (rrChange, error)
+	getChange(ctx context.Context, project, zone, id string) (rrChange, error)
+}
+
+// https://cloud.google.com/dns/docs/reference/v1/changes#resource
+type rrChange struct {
+	ID        string  `json:"id,omitempty"`
+	Status    string  `json:"status,omitempty"`
+	Additions []rrset `json:"additions,omitempty"`
+	Deletions []rrset `json:"deletions,omitempty"`
+}
+
+// Backend used by the record management
+var dnsAPI dnsBackend = cloudDNS{}
+
+type cloudDNS struct{}
+
+func (cloudDNS) listRecordSets(ctx context.Context, project, zone, dns_name, rs_type string) (records []rrset, err error) {
+	query := url.Values{"alt": {"json"}}
+	if dns_name != "" {
+		query.Set("name", dns_name)
+	}
+	if rs_type != "" {
+		query.Set("type", rs_type)
+	}
+
+	for {
+		list_url := fmt.Sprintf("https://dns.googleapis.com/dns/v1/projects/%v/managedZones/%v/rrsets?%v", project, zone, query.Encode())
+		statusCode, rs_resp, err := dnsRequest(ctx, "dns.resourceRecordSets.list", "GET", list_url, nil)
+		if err != nil {
+			return nil, err
+		} else if statusCode != http.StatusOK {
+			return nil, &googleapi.Error{Code: statusCode, Body: string(rs_resp)}
+		}
+
+		rsdata := rdSet{}
+		if err := json.Unmarshal(rs_resp, &rsdata); err != nil {
+			return nil, err
+		}
+		records = append(records, rsdata.Rrsets...)
+		if rsdata.NextPageToken == "" {
+			return records, nil
+		}
+		query.Set("pageToken", rsdata.NextPageToken)
+	}
+}
+
+func (cloudDNS) createChange(ctx context.Context, project, zone string, change rrChange) (created rrChange, err error) {
+	change_url := fmt.Sprintf("https://dns.googleapis.com/dns/v1/projects/%v/managedZones/%v/changes?alt=json", project, zone)
+	statusCode, respBody, err := dnsRequest(ctx, "dns.changes.create", "POST", change_url, change)
+	if err != nil {
+		return created, err
+	} else if statusCode != http.StatusOK {
+		return created, &googleapi.Error{Code: statusCode, Body: string(respBody)}
+	}
+	err = json.Unmarshal(respBody, &created)
+	return created, err
+}
+
+func (cloudDNS) getChange(ctx context.Context, project, zone, id string) (change rrChange, err error) {
+	change_url := fmt.Sprintf("https://dns.googleapis.com/dns/v1/projects/%v/managedZones/%v/changes/%v?alt=json", project, zone, id)
+	statusCode, respBody, err := dnsRequest(ctx, "dns.changes.get", "GET", change_url, nil)
+	if err != nil {
+		return change, err
+	} else if statusCode != http.StatusOK {
+		return change, &googleapi.Error{Code: statusCode, Body: string(respBody)}
+	}
+	err = json.Unmarshal(respBody, &change)
+	return change, err
+}
+
+// In-memory zones, changes are validated like Cloud DNS does and are done immediately
+type memoryDNS struct {
+	sync.Mutex
+	// Recordsets by project/zone
+	zones   map[string][]rrset
+	changes int
+}
+
+func newMemoryDNS() *memoryDNS {
+	return &memoryDNS{zones: make(map[string][]rrset)}
+}
+
+// Deep copy, routing policies are pointers
+func (r rrset) clone() (c rrset) {
+	data, _ := json.Marshal(r)
+	json.Unmarshal(data, &c)
+	return c
+}
+
+// Same name, type, TTL and data, the kind is ignored
+func sameRecordSet(a, b rrset) bool {
+	a.Kind, b.Kind = "", ""
+	return reflect.DeepEqual(a.clone(), b.clone())
+}
+
+func (m *memoryDNS) listRecordSets(ctx context.Context, project, zone, dns_name, rs_type string) (records []rrset, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, record := range m.zones[project+"/"+zone] {
+		if (dns_name == "" || record.Name == dns_name) && (rs_type == "" || record.Type == rs_type) {
+			records = append(records, record.clone())
+		}
+	}
+	return records, nil
+}
+
+func (m *memoryDNS) createChange(ctx context.Context, project, zone string, change rrChange) (rrChange, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := project + "/" + zone
+	records := append([]rrset{}, m.zones[key]...)
+
+	for _, deletion := range change.Deletions {
+		found := false
+		for i, record := range records {
+			if record.Name == deletion.Name && record.Type == deletion.Type {
+				if !sameRecordSet(record, deletion) {
+					return rrChange{}, &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "conditionNotMet: " + deletion.Name}
+				}
+				records = append(records[:i], records[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return rrChange{}, &googleapi.Error{Code: http.StatusNotFound, Message: "notFound: " + deletion.Name}
+		}
+	}
+	for _, addition := range change.Additions {
+		if policy := addition.RoutingPolicy; policy != nil && (policy.Geo != nil && policy.Wrr != nil || len(addition.Rrdatas) > 0) {
+			return rrChange{}, &googleapi.Error{Code: http.StatusBadRequest, Message: "invalid: routingPolicy of " + addition.Name}
+		}
+		for _, record := range records {
+			if record.Name == addition.Name && record.Type == addition.Type {
+				return rrChange{}, &googleapi.Error{Code: http.StatusConflict, Message: "alreadyExists: " + addition.Name}
+			}
+		}
+		records = append(records, addition.clone())
+	}
+
+	m.zones[key] = records
+	m.changes++
+	change.ID, change.Status = strconv.Itoa(m.changes), "done"
+	return change, nil
+}
+
+func (m *memoryDNS) getChange(ctx context.Context, project, zone, id string) (rrChange, error) {
+	return rrChange{ID: id, Status: "done"}, nil
+}
@@ -0,0 +1,50 @@
+package gcedns
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Exponential backoff between polls, bounded by a deadline
+type backoff struct {
+	Initial  time.Duration
+	Max      time.Duration
+	Deadline time.Time
+	// Fraction of each interval randomized away, spreads out concurrent retries
+	Jitter float64
+
+	next time.Duration
+}
+
+func newBackoff(initial, max, timeout time.Duration) *backoff {
+	return &backoff{Initial: initial, Max: max, Deadline: time.Now().Add(timeout)}
+}
+
+// Sleeps for the next interval, false when the deadline would be passed or ctx is done
+func (b *backoff) Wait(ctx context.Context) bool {
+	if b.next == 0 {
+		b.next = b.Initial
+	}
+	wait := b.next
+	if b.Jitter > 0 {
+		wait -= time.Duration(b.Jitter * rand.Float64() * float64(wait))
+	}
+	if remaining := time.Until(b.Deadline); remaining <= 0 {
+		return false
+	} else if wait > remaining {
+		wait = remaining
+	}
+
+	b.next *= 2
+	if b.next > b.Max {
+		b.next = b.Max
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
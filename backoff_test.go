@@ -0,0 +1,31 @@
+package gcedns
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+
+	b := newBackoff(10*time.Millisecond, 40*time.Millisecond, 150*time.Millisecond)
+	start := time.Now()
+	waits := 0
+	for b.Wait(context.Background()) {
+		waits++
+	}
+
+	// 10, 20, 40, 40, 40 capped by the deadline
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 300*time.Millisecond {
+		t.Errorf("FAILED: backoff stopped after %v\n", elapsed)
+	}
+	if waits < 4 || waits > 6 {
+		t.Errorf("FAILED: got %d waits\n", waits)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if newBackoff(time.Second, time.Second, time.Minute).Wait(ctx) {
+		t.Errorf("FAILED: backoff waited on a cancelled context\n")
+	}
+}
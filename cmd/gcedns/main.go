@@ -0,0 +1,134 @@
+// Service mode and tools of the VM event based DNS management.
+// Runs from the directory holding serverless_function_source_code.
+//
+//	gcedns [serve] -subscription=projects/PROJECT/subscriptions/NAME
+//	gcedns dead-letters -source=FILE|projects/PROJECT/subscriptions/NAME [-message-ids=ID,ID] [-error-class=CLASS] [-since=RFC3339] [-dry-run]
+//	gcedns replay [-backend=cloud|memory|memory:FILE] [-apply] [-vms=FILE] PATH...
+//	gcedns snapshot [-dir=DIR|gs://BUCKET/PREFIX] [PROJECT/ZONE...]
+//	gcedns rollback [-dir=DIR|gs://BUCKET/PREFIX] [-snapshot=ID|latest] [-apply] PROJECT/ZONE
+//	gcedns export [-format=zone|terraform|json] [-out=DIR] [PROJECT/ZONE...]
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"gcedns.com/gcedns"
+)
+
+func main() {
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch command {
+	case "serve":
+		err = serve(ctx, args)
+	case "dead-letters":
+		err = deadLetters(ctx, args)
+	case "replay":
+		err = replay(ctx, args)
+	case "snapshot":
+		err = snapshot(ctx, args)
+	case "rollback":
+		err = rollback(ctx, args)
+	case "export":
+		err = export(ctx, args)
+	default:
+		log.Fatalf("Unknown command %q, expected serve, dead-letters, replay, snapshot, rollback or export", command)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func serve(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	subscription := flags.String("subscription", os.Getenv("DNS_SUBSCRIPTION"), "Pub/Sub subscription of the VM audit log sink, projects/PROJECT/subscriptions/NAME")
+	flags.Parse(args)
+	if *subscription == "" {
+		log.Fatal("-subscription or DNS_SUBSCRIPTION is required")
+	}
+	return gcedns.Serve(ctx, *subscription)
+}
+
+// Replays dead letters once the cause of the failures is fixed
+func deadLetters(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("dead-letters", flag.ExitOnError)
+	source := flags.String("source", "", "Dead letters JSON lines file, or subscription to the dead-letter topic projects/PROJECT/subscriptions/NAME")
+	message_ids := flags.String("message-ids", "", "Comma separated message IDs to replay, all by default")
+	error_class := flags.String("error-class", "", "Only replay this error class: transient, permanent or expired")
+	since := flags.String("since", "", "Only replay dead letters from this time on, RFC3339")
+	dry_run := flags.Bool("dry-run", false, "List the selected dead letters without replaying them")
+	flags.Parse(args)
+	if *source == "" {
+		log.Fatal("-source is required")
+	}
+
+	filter := gcedns.DeadLetterFilter{ErrorClass: *error_class}
+	if *message_ids != "" {
+		filter.MessageIDs = strings.Split(*message_ids, ",")
+	}
+	if *since != "" {
+		t, err := time.Parse(time.RFC3339, *since)
+		if err != nil {
+			return err
+		}
+		filter.Since = t
+	}
+	return gcedns.ReplayDeadLetters(ctx, *source, filter, *dry_run)
+}
+
+// Replays exported audit logs, a dry run unless -apply is set
+func replay(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	backend := flags.String("backend", "cloud", "DNS backend: cloud, memory, or memory:FILE seeded with {\"PROJECT/ZONE\": [recordSets]}")
+	apply := flags.Bool("apply", false, "Apply the changes, they're only logged otherwise")
+	vms := flags.String("vms", "", "Seed file of VM IPs and labels, {\"projects/PROJECT/zones/ZONE/instances/NAME\": {\"ips\": [...], \"labels\": {...}}}")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		log.Fatal("Audit log files or directories are required")
+	}
+	return gcedns.ReplayAuditLogs(ctx, flags.Args(), gcedns.ReplayOptions{Backend: *backend, Apply: *apply, VMs: *vms})
+}
+
+// Snapshots the managed records of the zones, of the default and policy zones when none are given
+func snapshot(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	dir := flags.String("dir", os.Getenv("DNS_SNAPSHOT_DIR"), "Snapshot directory, local or gs://BUCKET/PREFIX")
+	flags.Parse(args)
+	return gcedns.SnapshotZones(ctx, *dir, flags.Args())
+}
+
+// Restores a zone's managed records to a snapshot, a dry run unless -apply is set
+func rollback(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("rollback", flag.ExitOnError)
+	dir := flags.String("dir", os.Getenv("DNS_SNAPSHOT_DIR"), "Snapshot directory, local or gs://BUCKET/PREFIX")
+	id := flags.String("snapshot", "", "Snapshot ID or latest, the zone's snapshots are listed when unset")
+	apply := flags.Bool("apply", false, "Apply the change, only the diff is printed otherwise")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatal("A zone PROJECT/ZONE is required")
+	}
+	return gcedns.RollbackZone(ctx, *dir, flags.Arg(0), *id, *apply)
+}
+
+// Exports the managed records of the zones, of the default and policy zones when none are given
+func export(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "zone", "Output format: zone (RFC 1035 zone file), terraform or json")
+	out := flags.String("out", "", "Directory to write a file per zone to, stdout when unset")
+	flags.Parse(args)
+	return gcedns.ExportRecords(ctx, *format, *out, flags.Args())
+}
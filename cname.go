@@ -0,0 +1,165 @@
+package gcedns
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+/* CNAME record mode
+Instead of an A record with copied IPs, the friendly name is a CNAME to the VM's
+zonal internal DNS name VM.ZONE.c.PROJECT.internal., so IP changes never need a DNS update.
+Set per project through record_modes in dns_policy.yaml, or per VM with the dns_record_mode label.
+*/
+
+const (
+	recordModeA     = "a"
+	recordModeCNAME = "cname"
+)
+
+// dns_record_mode label takes precedence over the project's record mode
+func (p dnsPolicy) recordMode(vm_info VMInfo) string {
+	for _, mode := range []string{vm_info.Labels["dns_record_mode"], p.RecordModes[vm_info.VMProject]} {
+		switch mode {
+		case recordModeA, recordModeCNAME:
+			return mode
+		case "":
+		default:
+			fmt.Printf("Unknown record mode %q for %q, ignored\n", mode, vm_info.Name)
+		}
+	}
+	return recordModeA
+}
+
+func vmRecordMode(vm_info VMInfo) string {
+	policy, err := loadDnsPolicy()
+	if err != nil {
+		log.Println(err)
+		return vm_info.Labels["dns_record_mode"]
+	}
+	return policy.recordMode(vm_info)
+}
+
+// Zonal internal DNS name of a VM, domain scoped projects (example.com:project) become project.example.com
+func zonalInternalName(vm_name, zone, project string) string {
+	if i := strings.Index(project, ":"); i > 0 {
+		project = project[i+1:] + "." + project[:i]
+	}
+	return fmt.Sprintf("%v.%v.c.%v.internal.", vm_name, zone, project)
+}
+
+// Creates or deletes the CNAME for a VM, conflicts follow the conflict policy with merge treated as reject
+func cnameManagement(ctx context.Context, dnsInfo DnsInfo, target dnsTarget, conflictPolicy string) (result dnsResult) {
+	dns_name := target.fqdn()
+	result = dnsResult{FQDN: dns_name}
+
+	if dnsInfo.VMZone == "" {
+		result.Status, result.Reason = dnsSkipped, "no VM zone"
+		return
+	}
+	cname := []string{zonalInternalName(dnsInfo.VMName, dnsInfo.VMZone, dnsInfo.VMProject)}
+
+	record, exists, err := getRecordSet(ctx, target.HostProject, target.Zone, dns_name, "CNAME")
+	if err != nil {
+		return lookupFailed(result, err)
+	}
+	// A CNAME can't coexist with other records of the same name
+	a_record, a_exists, err := getRecordSet(ctx, target.HostProject, target.Zone, dns_name, "A")
+	if err != nil {
+		return lookupFailed(result, err)
+	}
+
+	if dnsInfo.Action == "create" {
+		if exists && ipsOverlap(record.Rrdatas, cname) {
+			result.Status = dnsUnchanged
+			return
+		}
+		if !exists && !a_exists {
+			if conflictPolicy == conflictSuffix {
+				// A retried event may already hold a suffixed name, the base name's VM may be gone since
+				suffixed, found, err := findSuffixedName(ctx, target.HostProject, target.Zone, target.HostName, target.Domain, "CNAME", cname)
+				if err != nil {
+					return lookupFailed(result, err)
+				} else if found {
+					result.FQDN, result.Status = suffixed.Name, dnsUnchanged
+					return
+				}
+			}
+			txn := &dnsTransaction{}
+			txn.add(target.HostProject, target.Zone, rrset{Name: dns_name, Rrdatas: cname, TTL: 60, Type: "CNAME"})
+			if result.Status, err = txn.commit(ctx, dnsCreated); err != nil {
+				result.Reason, result.Err = err.Error(), err
+			}
+			return
+		}
+
+		// Name is taken by another VM
+		existing := record
+		if !exists {
+			existing = a_record
+		}
+		result.Conflict = conflictPolicy
+
+		switch conflictPolicy {
+		case conflictReplace:
+			txn := &dnsTransaction{}
+			txn.remove(target.HostProject, target.Zone, existing)
+			txn.add(target.HostProject, target.Zone, rrset{Name: dns_name, Rrdatas: cname, TTL: 60, Type: "CNAME"})
+			if result.Status, err = txn.commit(ctx, dnsUpdated); err != nil {
+				result.Reason, result.Err = err.Error(), err
+			} else {
+				result.Reason = fmt.Sprintf("replaced %v %v", existing.Type, existing.Rrdatas)
+			}
+		case conflictSuffix:
+			suffix_name, suffix_exists, err := nextFreeName(ctx, target.HostProject, target.Zone, target.HostName, target.Domain, "CNAME", cname)
+			if err != nil {
+				return lookupFailed(result, err)
+			} else if suffix_name == "" {
+				result.Status, result.Reason = dnsFailed, "no free suffixed name"
+				return
+			}
+			result.FQDN = suffix_name
+			if !checkAllowList(ctx, suffix_name, dnsInfo.VMProject) {
+				fmt.Printf("%q is not in the allow list for %q\n", suffix_name, dnsInfo.VMProject)
+				result.Status, result.Code, result.Reason = dnsDenied, denyAllowList, "not in the allow list for "+dnsInfo.VMProject
+				return
+			}
+			if suffix_exists {
+				result.Status = dnsUnchanged
+				return
+			}
+			txn := &dnsTransaction{}
+			txn.add(target.HostProject, target.Zone, rrset{Name: suffix_name, Rrdatas: cname, TTL: 60, Type: "CNAME"})
+			if result.Status, err = txn.commit(ctx, dnsCreated); err != nil {
+				result.Reason, result.Err = err.Error(), err
+			}
+		default:
+			// reject, a CNAME can't be merged
+			fmt.Printf("%q already exists with %v %v, rejected for %q\n", dns_name, existing.Type, existing.Rrdatas, dnsInfo.VMName)
+			result.Status, result.Code, result.Reason = dnsDenied, denyConflict, fmt.Sprintf("record exists with %v %v", existing.Type, existing.Rrdatas)
+		}
+	} else if dnsInfo.Action == "delete" {
+		if !exists || !ipsOverlap(record.Rrdatas, cname) {
+			if conflictPolicy != conflictSuffix {
+				result.Status, result.Reason = dnsUnchanged, "no record found"
+				return
+			}
+			suffixed, found, err := findSuffixedName(ctx, target.HostProject, target.Zone, target.HostName, target.Domain, "CNAME", cname)
+			if err != nil {
+				return lookupFailed(result, err)
+			} else if !found {
+				result.Status, result.Reason = dnsUnchanged, "no record found"
+				return
+			}
+			result.FQDN, record = suffixed.Name, suffixed
+		}
+
+		txn := &dnsTransaction{}
+		txn.remove(target.HostProject, target.Zone, record)
+		if result.Status, err = txn.commit(ctx, dnsDeleted); err != nil {
+			result.Reason, result.Err = err.Error(), err
+		}
+	}
+	return result
+}
@@ -0,0 +1,344 @@
+package gcedns
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/* Batch coalescing in service mode
+A MIG resize produces an event per instance, each listing and changing the same zone.
+The coalescer buffers the record operations of concurrent events for DNS_BATCH_WINDOW
+seconds and applies them as one change per zone, with one update per recordSet.
+IPs are merged and removed in event order with the ipCreateChecker/ipDeleteChecker semantics.
+A failed batch change is retried event by event on the unbatched path.
+An event whose context is done stops waiting for its batch and fails, events pending when
+the coalescer stops are retried on the unbatched path.
+*/
+
+var (
+	batchWindow = envSeconds("DNS_BATCH_WINDOW", 2)
+	batchSize   = envInt("DNS_BATCH_SIZE", 500)
+)
+
+// Set in service mode, events are applied one by one otherwise
+var batcher *coalescer
+
+// Operation on one recordSet
+type recordOp struct {
+	Project string
+	Zone    string
+	Name    string
+	Type    string
+	Action  string
+	Rrdatas []string
+	// The recordSet must be absent or already hold Rrdatas, otherwise the event
+	// falls back to the unbatched path and its conflict policy
+	Exclusive bool
+	// Rrdatas replace the recordSet's data instead of being merged, ex: PTRs
+	Replace bool
+}
+
+func (op recordOp) key() string {
+	return recordKey(op.Project, op.Zone, op.Name) + "/" + op.Type
+}
+
+// The event's operations need the unbatched path
+const batchFallback = "fallback"
+
+type batchRequest struct {
+	ops   []recordOp
+	done  chan []dnsResult
+	audit *auditEvent
+}
+
+type coalescer struct {
+	window   time.Duration
+	maxOps   int
+	requests chan batchRequest
+	// Closed when run returns
+	stopped chan struct{}
+}
+
+func newCoalescer(window time.Duration, maxOps int) *coalescer {
+	return &coalescer{window: window, maxOps: maxOps, requests: make(chan batchRequest), stopped: make(chan struct{})}
+}
+
+// Collects requests until the window closes or the batch is full, then flushes
+func (c *coalescer) run(ctx context.Context) {
+	defer close(c.stopped)
+	for {
+		var batch []batchRequest
+		select {
+		case <-ctx.Done():
+			return
+		case request := <-c.requests:
+			batch = append(batch, request)
+		}
+
+		ops := len(batch[0].ops)
+		timer := time.NewTimer(c.window)
+	collect:
+		for ops < c.maxOps {
+			select {
+			case request := <-c.requests:
+				batch = append(batch, request)
+				ops += len(request.ops)
+			case <-timer.C:
+				break collect
+			case <-ctx.Done():
+				timer.Stop()
+				for _, request := range batch {
+					request.done <- batchResults(request, dnsResult{Status: batchFallback})
+				}
+				return
+			}
+		}
+		timer.Stop()
+		flushBatch(ctx, batch)
+	}
+}
+
+// Queues an event's operations and waits for the batch, one result per operation
+func (c *coalescer) submit(ctx context.Context, ops ...recordOp) []dnsResult {
+	request := batchRequest{ops: ops, done: make(chan []dnsResult, 1), audit: eventAudit(ctx)}
+	select {
+	case c.requests <- request:
+	case <-c.stopped:
+		return batchResults(request, dnsResult{Status: batchFallback})
+	case <-ctx.Done():
+		return batchResults(request, dnsResult{Status: dnsFailed, Reason: "cancelled waiting for the batch", Err: ctx.Err()})
+	}
+	select {
+	case results := <-request.done:
+		return results
+	case <-ctx.Done():
+		// The batch may still apply the operations, the event's redelivery finds them done
+		return batchResults(request, dnsResult{Status: dnsFailed, Reason: "cancelled waiting for the batch", Err: ctx.Err()})
+	}
+}
+
+// Working state of a recordSet during a flush
+type batchRecord struct {
+	// First operation on the recordSet, names its project, zone and type
+	Op      recordOp
+	Current rrset
+	Exists  bool
+	Rrdatas []string
+}
+
+func flushBatch(ctx context.Context, batch []batchRequest) {
+	var keys, lock_keys []string
+	records := make(map[string]*batchRecord)
+	for _, request := range batch {
+		for _, op := range request.ops {
+			if _, seen := records[op.key()]; !seen {
+				records[op.key()] = nil
+				keys = append(keys, op.key())
+				lock_keys = append(lock_keys, recordKey(op.Project, op.Zone, op.Name))
+			}
+		}
+	}
+	if debug != "" {
+		fmt.Printf("Flushing %v events on %v recordSets\n", len(batch), len(keys))
+	}
+
+	// A batch is traced on its own, it spans many events
+	ctx, span := startSpan(ctx, "gcedns.batch", "events", strconv.Itoa(len(batch)), "recordsets", strconv.Itoa(len(keys)))
+	defer span.end(nil)
+
+	results := make([][]dnsResult, len(batch))
+	unlock, err := lockRecords(ctx, lock_keys...)
+	if err != nil {
+		fmt.Println(err)
+		for i, request := range batch {
+			results[i] = batchResults(request, dnsResult{Status: dnsFailed, Reason: "record locked", Err: err})
+			request.done <- results[i]
+		}
+		return
+	}
+	defer unlock()
+
+	// One read per recordSet
+	for _, request := range batch {
+		for _, op := range request.ops {
+			if records[op.key()] == nil {
+				current, exists, err := getRecordSet(ctx, op.Project, op.Zone, op.Name, op.Type)
+				if err != nil {
+					// Retried one by one, only the events reading the failing zone fail
+					fmt.Printf("%v, retrying the %v events one by one\n", err, len(batch))
+					for _, request := range batch {
+						request.done <- batchResults(request, dnsResult{Status: batchFallback})
+					}
+					return
+				}
+				records[op.key()] = &batchRecord{Op: op, Current: current, Exists: exists, Rrdatas: current.Rrdatas}
+			}
+		}
+	}
+
+	// Operations in event order, an event's operations are kept or dropped together
+	for i, request := range batch {
+		saved := make(map[string][]string)
+		for _, op := range request.ops {
+			saved[op.key()] = records[op.key()].Rrdatas
+		}
+
+		for _, op := range request.ops {
+			result := applyRecordOp(records[op.key()], op)
+			results[i] = append(results[i], result)
+			if result.Status == batchFallback {
+				for key, rrdatas := range saved {
+					records[key].Rrdatas = rrdatas
+				}
+				results[i] = batchResults(request, result)
+				break
+			}
+		}
+	}
+
+	// One change per zone
+	txn := &dnsTransaction{}
+	for _, key := range keys {
+		record := records[key]
+		op := record.Op
+
+		switch {
+		case !record.Exists && len(record.Rrdatas) > 0:
+			txn.add(op.Project, op.Zone, rrset{Name: op.Name, Rrdatas: record.Rrdatas, TTL: 60, Type: op.Type})
+		case record.Exists && len(record.Rrdatas) == 0:
+			txn.remove(op.Project, op.Zone, record.Current)
+		case record.Exists && !sameRrdatas(record.Current.Rrdatas, record.Rrdatas):
+			updated := record.Current.clone()
+			updated.Rrdatas = record.Rrdatas
+			txn.replace(op.Project, op.Zone, record.Current, updated)
+		}
+	}
+
+	if !txn.empty() {
+		if err := txn.apply(ctx); err != nil {
+			// The batch is rolled back and its events retried one by one,
+			// only the events writing to the failing zone fail
+			fmt.Printf("%v, retrying the %v events one by one\n", err, len(batch))
+			for i, request := range batch {
+				results[i] = batchResults(request, dnsResult{Status: batchFallback})
+			}
+		} else {
+			auditBatch(batch, results, records)
+		}
+	}
+	for i, request := range batch {
+		request.done <- results[i]
+	}
+}
+
+// Recordsets changed by each event, before and after the whole batch
+func auditBatch(batch []batchRequest, results [][]dnsResult, records map[string]*batchRecord) {
+	for i, request := range batch {
+		if request.audit == nil || results[i][0].Status == batchFallback {
+			continue
+		}
+		for j, op := range request.ops {
+			record := records[op.key()]
+			switch results[i][j].Status {
+			case dnsCreated, dnsUpdated, dnsDeleted:
+				if !record.Exists || !sameRrdatas(record.Current.Rrdatas, record.Rrdatas) {
+					before := []string(nil)
+					if record.Exists {
+						before = record.Current.Rrdatas
+					}
+					request.audit.addChange(auditChange{Project: op.Project, Zone: op.Zone, Name: op.Name, Type: op.Type,
+						Before: before, After: record.Rrdatas, Exists: record.Exists})
+				}
+			}
+		}
+	}
+}
+
+// Same result for all of a request's operations
+func batchResults(request batchRequest, result dnsResult) []dnsResult {
+	results := make([]dnsResult, len(request.ops))
+	for i := range results {
+		results[i] = result
+	}
+	return results
+}
+
+func sameRrdatas(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Applies op to the working rrdatas
+func applyRecordOp(record *batchRecord, op recordOp) (result dnsResult) {
+	result = dnsResult{FQDN: op.Name}
+	if record.Current.RoutingPolicy != nil {
+		result.Status = batchFallback
+		return
+	}
+	before := record.Rrdatas
+
+	if op.Action == "create" {
+		switch {
+		case len(before) == 0:
+			record.Rrdatas = op.Rrdatas
+			result.Status = dnsCreated
+		case op.Replace:
+			record.Rrdatas = op.Rrdatas
+			result.Status = dnsUpdated
+			if sameRrdatas(before, op.Rrdatas) {
+				result.Status = dnsUnchanged
+			}
+		case op.Exclusive && !ipsOverlap(before, op.Rrdatas):
+			result.Status = batchFallback
+		default:
+			record.Rrdatas = ipCreateChecker(append([]string{}, before...), op.Rrdatas)
+			result.Status = dnsUpdated
+			if len(record.Rrdatas) == len(before) {
+				result.Status = dnsUnchanged
+			}
+		}
+	} else if op.Action == "delete" {
+		if op.Exclusive && !ipsOverlap(before, op.Rrdatas) {
+			result.Status = batchFallback
+			return
+		}
+		record.Rrdatas = ipDeleteChecker(before, op.Rrdatas)
+		switch {
+		case len(record.Rrdatas) == len(before):
+			result.Status = dnsUnchanged
+		case len(record.Rrdatas) == 0:
+			result.Status = dnsDeleted
+		default:
+			result.Status = dnsUpdated
+		}
+	}
+	return result
+}
+
+// A and PTR of a VM through the coalescer, false when the event needs the unbatched path
+func batchDnsManagement(ctx context.Context, dnsInfo DnsInfo, target dnsTarget, dns_name, conflictPolicy string) (result dnsResult, batched bool) {
+	results := batcher.submit(ctx,
+		recordOp{Project: target.HostProject, Zone: target.Zone, Name: dns_name, Type: "A",
+			Action: dnsInfo.Action, Rrdatas: dnsInfo.IPs, Exclusive: conflictPolicy != conflictMerge},
+		recordOp{Project: target.PTRHostProject, Zone: target.PTRZone, Name: ptrRecordConverter(dnsInfo.IPs[0]), Type: "PTR",
+			Action: dnsInfo.Action, Rrdatas: []string{dns_name}, Replace: true},
+	)
+	result = results[0]
+	if result.Status == batchFallback {
+		return result, false
+	}
+	// Only the PTR changed
+	if result.Status == dnsUnchanged && results[1].Status != dnsUnchanged {
+		result.Status = dnsUpdated
+	}
+	return result, true
+}
@@ -0,0 +1,182 @@
+package gcedns
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startTestBatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	batcher = newCoalescer(200*time.Millisecond, 500)
+	go batcher.run(ctx)
+	t.Cleanup(func() {
+		cancel()
+		batcher = nil
+	})
+}
+
+func TestCoalescedGroupResize(t *testing.T) {
+	backend := setupTestDns(t)
+	startTestBatcher(t)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dnsInfo := DnsInfo{DnsHostName: "devserver-pool", Action: "create", IPs: []string{fmt.Sprintf("10.0.0.%v", i)}, VMName: fmt.Sprintf("vm-%v", i), VMProject: "prj-dev-4328"}
+			if result := groupManagement(context.Background(), dnsInfo); !result.ok() {
+				t.Errorf("FAILED: member %v got %v\n", i, result)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	record, _, _ := getRecordSet(context.Background(), "prj-c-dnshub", "default-zone", "devserver-pool.gcp.company.com.", "A")
+	if len(record.Rrdatas) != 50 {
+		t.Errorf("FAILED: got %v member IPs expected 50\n", len(record.Rrdatas))
+	}
+	if backend.changes != 1 {
+		t.Errorf("FAILED: got %v changes expected 1\n", backend.changes)
+	}
+
+	// Joins and leaves in the same batch
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		groupManagement(context.Background(), DnsInfo{DnsHostName: "devserver-pool", Action: "delete", IPs: []string{"10.0.0.1"}, VMName: "vm-1", VMProject: "prj-dev-4328"})
+	}()
+	go func() {
+		defer wg.Done()
+		groupManagement(context.Background(), DnsInfo{DnsHostName: "devserver-pool", Action: "create", IPs: []string{"10.0.0.51"}, VMName: "vm-51", VMProject: "prj-dev-4328"})
+	}()
+	wg.Wait()
+
+	record, _, _ = getRecordSet(context.Background(), "prj-c-dnshub", "default-zone", "devserver-pool.gcp.company.com.", "A")
+	if len(record.Rrdatas) != 50 || ipsOverlap(record.Rrdatas, []string{"10.0.0.1"}) || !ipsOverlap(record.Rrdatas, []string{"10.0.0.51"}) {
+		t.Errorf("FAILED: got %v\n", record.Rrdatas)
+	}
+}
+
+func TestCoalescedVMRecords(t *testing.T) {
+	backend := setupTestDns(t)
+	startTestBatcher(t)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dnsInfo := DnsInfo{DnsHostName: fmt.Sprintf("devserver%v", i), Action: "create", IPs: []string{fmt.Sprintf("10.0.0.%v", i)}, VMName: fmt.Sprintf("vm-%v", i), VMProject: "prj-dev-4328"}
+			if result := dnsManagement(context.Background(), dnsInfo); result.Status != dnsCreated {
+				t.Errorf("FAILED: vm %v got %v expected %v\n", i, result, dnsCreated)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// A records and PTRs, one change per zone
+	if backend.changes != 2 {
+		t.Errorf("FAILED: got %v changes expected 2\n", backend.changes)
+	}
+	if ptr, _, _ := getRecordSet(context.Background(), "prj-c-dnshub", "ptr-zone", "7.0.0.10.in-addr.arpa.", "PTR"); len(ptr.Rrdatas) != 1 || ptr.Rrdatas[0] != "devserver7.gcp.company.com." {
+		t.Errorf("FAILED: PTR got %v\n", ptr)
+	}
+}
+
+func TestCoalescedConflictFallback(t *testing.T) {
+	setupTestDns(t)
+	if err := ioutil.WriteFile(dnsPolicyFile, []byte("conflicts:\n  default: reject\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	startTestBatcher(t)
+
+	// Two VMs asking for the same name in one batch
+	statuses := make(chan string, 2)
+	var wg sync.WaitGroup
+	for i := 1; i <= 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dnsInfo := DnsInfo{DnsHostName: "devserver", Action: "create", IPs: []string{fmt.Sprintf("10.0.0.%v", i)}, VMName: fmt.Sprintf("vm-%v", i), VMProject: "prj-dev-4328"}
+			statuses <- dnsManagement(context.Background(), dnsInfo).Status
+		}(i)
+	}
+	wg.Wait()
+	close(statuses)
+
+	got := map[string]int{}
+	for status := range statuses {
+		got[status]++
+	}
+	if got[dnsCreated] != 1 || got[dnsDenied] != 1 {
+		t.Errorf("FAILED: got %v expected one created and one denied\n", got)
+	}
+}
+
+func TestCoalescedZoneFailure(t *testing.T) {
+	backend := setupTestDns(t)
+	dnsAPI = failingDNS{memoryDNS: backend, failZone: "other-zone"}
+	ioutil.WriteFile(dnsPolicyFile, []byte(`zones:
+  prj-dev-4328:
+    - zone: "other-zone"
+      host_project: "prj-c-dnshub"
+`), 0644)
+	startTestBatcher(t)
+
+	// Batched together, only the group in the failing zone fails
+	results := make([]dnsResult, 2)
+	var wg sync.WaitGroup
+	for i, dnsInfo := range []DnsInfo{
+		{DnsHostName: "devserver-pool", Action: "create", IPs: []string{"10.0.0.5"}, VMName: "vm-1", VMProject: "prj-dev-4328"},
+		{DnsHostName: "qa-pool", DnsZoneName: "other-zone", DnsZoneHostProject: "prj-c-dnshub", DnsDomain: "other.company.com.",
+			Action: "create", IPs: []string{"10.0.0.6"}, VMName: "vm-2", VMProject: "prj-dev-4328"},
+	} {
+		wg.Add(1)
+		go func(i int, dnsInfo DnsInfo) {
+			defer wg.Done()
+			results[i] = groupManagement(context.Background(), dnsInfo)
+		}(i, dnsInfo)
+	}
+	wg.Wait()
+
+	if results[0].Status != dnsCreated || results[1].Status != dnsFailed {
+		t.Errorf("FAILED: got %v expected the default zone group created and the other failed\n", results)
+	}
+	if _, exists, _ := getRecordSet(context.Background(), "prj-c-dnshub", "default-zone", "devserver-pool.gcp.company.com.", "A"); !exists {
+		t.Errorf("FAILED: group record of the default zone not created\n")
+	}
+}
+
+func TestCoalescerCancel(t *testing.T) {
+	setupTestDns(t)
+	run_ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	batcher = newCoalescer(time.Minute, 500)
+	defer func() { batcher = nil }()
+	go batcher.run(run_ctx)
+	op := recordOp{Project: "prj-c-dnshub", Zone: "default-zone", Name: "devserver01.gcp.company.com.", Type: "A", Action: "create", Rrdatas: []string{"10.0.0.5"}}
+
+	// The event's context is done while its batch is pending
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	results := batcher.submit(ctx, op)
+	if results[0].Status != dnsFailed || results[0].Err != context.DeadlineExceeded {
+		t.Errorf("FAILED: got %v expected a failed result\n", results[0])
+	}
+
+	// The coalescer stops while a batch is pending, then after it stopped
+	pending := make(chan []dnsResult, 1)
+	go func() { pending <- batcher.submit(context.Background(), op) }()
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	for _, results := range [][]dnsResult{<-pending, batcher.submit(context.Background(), op)} {
+		if results[0].Status != batchFallback {
+			t.Errorf("FAILED: got %v expected %v\n", results[0], batchFallback)
+		}
+	}
+}
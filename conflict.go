@@ -0,0 +1,120 @@
+package gcedns
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Conflict policies applied when an A record already exists with other VMs' IPs
+const (
+	conflictReject  = "reject"
+	conflictMerge   = "merge"
+	conflictReplace = "replace"
+	conflictSuffix  = "auto-suffix"
+)
+
+// Upper bound on dev01-2, dev01-3.. names tried by the auto-suffix policy
+var maxConflictSuffix = 20
+
+type conflictPolicies struct {
+	// Policy used when neither the zone nor the VM project has one, merge if unset
+	Default  string            `yaml:"default"`
+	Projects map[string]string `yaml:"projects"`
+	Zones    map[string]string `yaml:"zones"`
+}
+
+// Zone policy takes precedence over the VM project's policy
+func (p dnsPolicy) conflictPolicy(vmProjectID, zone string) string {
+	for _, policy := range []string{p.Conflicts.Zones[zone], p.Conflicts.Projects[vmProjectID], p.Conflicts.Default} {
+		switch policy {
+		case conflictReject, conflictMerge, conflictReplace, conflictSuffix:
+			return policy
+		case "":
+		default:
+			log.Printf("Unknown conflict policy %q, ignored\n", policy)
+		}
+	}
+	return conflictMerge
+}
+
+func conflictPolicyFor(vmProjectID, zone string) string {
+	policy, err := loadDnsPolicy()
+	if err != nil {
+		log.Println(err)
+		// fail closed
+		return conflictReject
+	}
+	return policy.conflictPolicy(vmProjectID, zone)
+}
+
+// Helper func to check if a record already holds any of the VM's IPs
+func ipsOverlap(record_ips, vm_ips []string) bool {
+	for _, vm_ip := range vm_ips {
+		for _, record_ip := range record_ips {
+			if vm_ip == record_ip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func suffixedName(dns_host_name, dnsDomain string, n int) string {
+	return fmt.Sprintf("%v-%d.%v", dns_host_name, n, dnsDomain)
+}
+
+// Suffixed recordSets of dns_host_name by name, from one list of the zone's rs_type recordSets.
+// Cloud DNS only filters on the exact name, a lookup per suffix would take up to maxConflictSuffix calls.
+func suffixedRecords(ctx context.Context, project, zone, dns_host_name, dnsDomain, rs_type string) (map[string]rrset, error) {
+	ctx, span := startSpan(ctx, "dns.resourceRecordSets.list", "project", project, "zone", zone, "type", rs_type)
+	records, err := dnsAPI.listRecordSets(ctx, project, zone, "", rs_type)
+	span.end(err)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing %v RecordSets in %v/%v: %w", rs_type, project, zone, err)
+	}
+
+	suffixed := make(map[string]rrset)
+	for _, record := range records {
+		if record.Type == rs_type && strings.HasPrefix(record.Name, dns_host_name+"-") && strings.HasSuffix(record.Name, "."+dnsDomain) {
+			suffixed[record.Name] = record
+		}
+	}
+	return suffixed, nil
+}
+
+// Finds the suffixed name already holding the VM's rrdatas, or else the first free one.
+// Names past a gap left by a delete are checked too, a retried event must not take a second name.
+func nextFreeName(ctx context.Context, project, zone, dns_host_name, dnsDomain, rs_type string, rrdatas []string) (dns_name string, holdsIPs bool, err error) {
+	records, err := suffixedRecords(ctx, project, zone, dns_host_name, dnsDomain, rs_type)
+	if err != nil {
+		return "", false, err
+	}
+	free := ""
+	for n := 2; n <= maxConflictSuffix; n++ {
+		name := suffixedName(dns_host_name, dnsDomain, n)
+		if record, exists := records[name]; !exists {
+			if free == "" {
+				free = name
+			}
+		} else if ipsOverlap(record.Rrdatas, rrdatas) {
+			return name, true, nil
+		}
+	}
+	return free, false, nil
+}
+
+// Finds the suffixed recordSet holding the VM's rrdatas, names freed by earlier deletes are skipped
+func findSuffixedName(ctx context.Context, project, zone, dns_host_name, dnsDomain, rs_type string, rrdatas []string) (record rrset, found bool, err error) {
+	records, err := suffixedRecords(ctx, project, zone, dns_host_name, dnsDomain, rs_type)
+	if err != nil {
+		return rrset{}, false, err
+	}
+	for n := 2; n <= maxConflictSuffix; n++ {
+		if record, exists := records[suffixedName(dns_host_name, dnsDomain, n)]; exists && ipsOverlap(record.Rrdatas, rrdatas) {
+			return record, true, nil
+		}
+	}
+	return rrset{}, false, nil
+}
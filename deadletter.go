@@ -0,0 +1,354 @@
+package gcedns
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/pubsub/v1"
+)
+
+/* Dead letters
+Events failing permanently, failing DNS_MAX_EVENT_ATTEMPTS times, or older than the max
+message age are published to the dead-letter sink and acknowledged, instead of being lost
+in the logs. DNS_DEAD_LETTER selects the sink:
+- "" (default): the function log
+- file:///path/dead_letters.jsonl
+- pubsub://projects/PROJECT/topics/TOPIC: the original message with the failure as attributes
+ReplayDeadLetters re-runs selected dead letters through the pipeline once the cause is fixed.
+*/
+
+const (
+	errorTransient = "transient"
+	errorPermanent = "permanent"
+	errorExpired   = "expired"
+)
+
+var (
+	errNoData = errors.New("error parsing pubsub message")
+
+	// Failed attempts of an event before it's dead-lettered
+	maxEventAttempts = envInt("DNS_MAX_EVENT_ATTEMPTS", 5)
+
+	deadLetters = newDeadLetterSink(os.Getenv("DNS_DEAD_LETTER"))
+)
+
+type deadLetter struct {
+	MessageID   string            `json:"message_id"`
+	PublishTime time.Time         `json:"publish_time"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	Data        []byte            `json:"data"`
+	Reason      string            `json:"reason"`
+	ErrorClass  string            `json:"error_class"`
+	Attempts    int               `json:"attempts"`
+	Time        time.Time         `json:"dead_lettered_at"`
+}
+
+type deadLetterSink interface {
+	publish(ctx context.Context, letter deadLetter) error
+}
+
+func newDeadLetterSink(config string) deadLetterSink {
+	switch {
+	case strings.HasPrefix(config, "file://"):
+		return &fileDeadLetters{Path: strings.TrimPrefix(config, "file://")}
+	case strings.HasPrefix(config, "pubsub://"):
+		return &pubsubDeadLetters{Topic: strings.TrimPrefix(config, "pubsub://")}
+	case config != "":
+		fmt.Printf("Unknown DNS_DEAD_LETTER %q, dead letters are logged\n", config)
+	}
+	return logDeadLetters{}
+}
+
+// 4xx API errors and unparsable messages won't succeed on a retry
+func errorClass(err error) string {
+	if errors.Is(err, errNoData) {
+		return errorPermanent
+	}
+	// Errors are wrapped on their way up, ex: by withRetry
+	var e *googleapi.Error
+	if errors.As(err, &e) && e.Code >= 400 && e.Code < 500 && !rebuildRetryable(e) {
+		return errorPermanent
+	}
+	return errorTransient
+}
+
+// Counts a failed attempt of the event, in the dedup store
+func eventAttempt(ctx context.Context, key string) int {
+	if key == "" || events == nil {
+		return 1
+	}
+	unlock := recordLocks.lock("attempts/" + key)
+	defer unlock()
+
+	value, _, err := events.get(ctx, "attempts/"+key)
+	if err != nil {
+		fmt.Printf("Error reading the attempts of %v: %v\n", key, err)
+	}
+	attempts, _ := strconv.Atoi(value)
+	attempts++
+	if err := events.put(ctx, "attempts/"+key, strconv.Itoa(attempts)); err != nil {
+		fmt.Printf("Error recording the attempts of %v: %v\n", key, err)
+	}
+	return attempts
+}
+
+// Publishes the message to the dead-letter sink, false if it couldn't be kept and should be retried
+func publishDeadLetter(ctx context.Context, m PubSubMessage, reason, class string, attempts int) bool {
+	letter := deadLetter{
+		MessageID:   m.MessageID,
+		PublishTime: m.PublishTime,
+		Attributes:  m.Attributes,
+		Data:        m.Data,
+		Reason:      reason,
+		ErrorClass:  class,
+		Attempts:    attempts,
+		Time:        time.Now().UTC(),
+	}
+	fmt.Printf("Dead letter, message %v published at %v: %v (%v, %v attempts)\n", m.MessageID, m.PublishTime.Format(time.RFC3339), reason, class, attempts)
+	deadLettersTotal.inc(class)
+
+	if err := deadLetters.publish(ctx, letter); err != nil {
+		fmt.Printf("Error publishing dead letter %v: %v\n", m.MessageID, err)
+		return false
+	}
+	return true
+}
+
+type logDeadLetters struct{}
+
+func (logDeadLetters) publish(ctx context.Context, letter deadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", line)
+	return nil
+}
+
+type fileDeadLetters struct {
+	Path string
+	sync.Mutex
+}
+
+func (f *fileDeadLetters) publish(ctx context.Context, letter deadLetter) error {
+	f.Lock()
+	defer f.Unlock()
+
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+type pubsubDeadLetters struct {
+	Topic string
+}
+
+// Failure details ride along as attributes, the data is the original audit log entry
+func deadLetterAttributes(letter deadLetter) map[string]string {
+	attributes := map[string]string{}
+	for k, v := range letter.Attributes {
+		attributes[k] = v
+	}
+	attributes["dead_letter_reason"] = letter.Reason
+	attributes["dead_letter_error_class"] = letter.ErrorClass
+	attributes["dead_letter_attempts"] = strconv.Itoa(letter.Attempts)
+	attributes["dead_letter_message_id"] = letter.MessageID
+	attributes["dead_letter_publish_time"] = letter.PublishTime.Format(time.RFC3339Nano)
+	return attributes
+}
+
+// Inverse of deadLetterAttributes
+func deadLetterFromMessage(message *pubsub.PubsubMessage) (letter deadLetter, err error) {
+	if letter.Data, err = base64.StdEncoding.DecodeString(message.Data); err != nil {
+		return letter, err
+	}
+	letter.Attributes = map[string]string{}
+	for k, v := range message.Attributes {
+		if !strings.HasPrefix(k, "dead_letter_") {
+			letter.Attributes[k] = v
+		}
+	}
+	letter.Reason = message.Attributes["dead_letter_reason"]
+	letter.ErrorClass = message.Attributes["dead_letter_error_class"]
+	letter.Attempts, _ = strconv.Atoi(message.Attributes["dead_letter_attempts"])
+	letter.MessageID = message.Attributes["dead_letter_message_id"]
+	letter.PublishTime, _ = time.Parse(time.RFC3339Nano, message.Attributes["dead_letter_publish_time"])
+	letter.Time, _ = time.Parse(time.RFC3339Nano, message.PublishTime)
+	return letter, nil
+}
+
+func (p *pubsubDeadLetters) publish(ctx context.Context, letter deadLetter) error {
+	ps, err := pubsub.NewService(ctx)
+	if err != nil {
+		return err
+	}
+	request := &pubsub.PublishRequest{Messages: []*pubsub.PubsubMessage{{
+		Data:       base64.StdEncoding.EncodeToString(letter.Data),
+		Attributes: deadLetterAttributes(letter),
+	}}}
+	return withRetry(ctx, "pubsub.topics.publish", func() error {
+		_, err := ps.Projects.Topics.Publish(p.Topic, request).Context(ctx).Do()
+		return err
+	})
+}
+
+// DeadLetterFilter selects the dead letters to replay, empty fields match all
+type DeadLetterFilter struct {
+	MessageIDs []string
+	ErrorClass string
+	// Dead-lettered at or after
+	Since time.Time
+}
+
+func (f DeadLetterFilter) match(letter deadLetter) bool {
+	if len(f.MessageIDs) > 0 {
+		found := false
+		for _, id := range f.MessageIDs {
+			found = found || id == letter.MessageID
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.ErrorClass != "" && f.ErrorClass != letter.ErrorClass {
+		return false
+	}
+	return f.Since.IsZero() || !letter.Time.Before(f.Since)
+}
+
+// ReplayDeadLetters re-runs the selected dead letters of a JSON lines file, or of a subscription
+// to the dead-letter topic (projects/PROJECT/subscriptions/NAME). With dryRun they're only listed.
+func ReplayDeadLetters(ctx context.Context, source string, filter DeadLetterFilter, dryRun bool) error {
+	if strings.HasPrefix(source, "projects/") {
+		return replaySubscription(ctx, source, filter, dryRun)
+	}
+
+	file, err := os.Open(strings.TrimPrefix(source, "file://"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	failed := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		letter := deadLetter{}
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			fmt.Printf("Invalid dead letter, skipped: %v\n", err)
+			continue
+		}
+		if filter.match(letter) && replayDeadLetter(ctx, letter, dryRun) != nil {
+			failed++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return replayFailures(failed)
+}
+
+func replayFailures(failed int) error {
+	if failed > 0 {
+		return fmt.Errorf("%v dead letters failed to replay", failed)
+	}
+	return nil
+}
+
+// Acknowledges the replayed dead letters, the others are left on the subscription
+func replaySubscription(ctx context.Context, subscription string, filter DeadLetterFilter, dryRun bool) error {
+	ps, err := pubsub.NewService(ctx)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for {
+		var pulled *pubsub.PullResponse
+		err := withRetry(ctx, "pubsub.subscriptions.pull", func() (err error) {
+			pulled, err = ps.Projects.Subscriptions.Pull(subscription, &pubsub.PullRequest{MaxMessages: int64(pullSize), ReturnImmediately: true}).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return err
+		} else if len(pulled.ReceivedMessages) == 0 {
+			return replayFailures(failed)
+		}
+
+		var acks, nacks []string
+		for _, received := range pulled.ReceivedMessages {
+			letter, err := deadLetterFromMessage(received.Message)
+			if err != nil {
+				fmt.Printf("Invalid dead letter %v, skipped: %v\n", received.Message.MessageId, err)
+				nacks = append(nacks, received.AckId)
+			} else if !filter.match(letter) {
+				nacks = append(nacks, received.AckId)
+			} else if err := replayDeadLetter(ctx, letter, dryRun); err != nil {
+				failed++
+				nacks = append(nacks, received.AckId)
+			} else if dryRun {
+				nacks = append(nacks, received.AckId)
+			} else {
+				acks = append(acks, received.AckId)
+			}
+		}
+
+		if len(acks) > 0 {
+			if _, err := ps.Projects.Subscriptions.Acknowledge(subscription, &pubsub.AcknowledgeRequest{AckIds: acks}).Context(ctx).Do(); err != nil {
+				return err
+			}
+		}
+		if len(nacks) > 0 {
+			if _, err := ps.Projects.Subscriptions.ModifyAckDeadline(subscription, &pubsub.ModifyAckDeadlineRequest{AckIds: nacks}).Context(ctx).Do(); err != nil {
+				return err
+			}
+		}
+		// Left over messages are redelivered, one pass over the subscription
+		if len(acks) == 0 {
+			return replayFailures(failed)
+		}
+	}
+}
+
+// Runs a dead letter through the pipeline as a fresh message, an error when it failed or was dead-lettered again
+func replayDeadLetter(ctx context.Context, letter deadLetter, dryRun bool) error {
+	fmt.Printf("Dead letter %v (%v, %v attempts): %v\n", letter.MessageID, letter.ErrorClass, letter.Attempts, letter.Reason)
+	if dryRun {
+		return nil
+	}
+
+	logMessage := logMetadata{}
+	json.Unmarshal(letter.Data, &logMessage)
+	if key := eventKey(logMessage, letter.MessageID); key != "" && events != nil {
+		events.put(ctx, "attempts/"+key, "0")
+	}
+
+	// Published now, the original publish time would trip the max age
+	m := PubSubMessage{Data: letter.Data, Attributes: letter.Attributes, MessageID: letter.MessageID, PublishTime: time.Now()}
+	deadLettered, err := readMessage(ctx, m)
+	if err == nil && deadLettered {
+		err = errors.New("dead-lettered again")
+	}
+	if err != nil {
+		fmt.Printf("Replay of %v failed: %v\n", letter.MessageID, err)
+	}
+	return err
+}
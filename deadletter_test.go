@@ -0,0 +1,241 @@
+package gcedns
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/pubsub/v1"
+)
+
+func TestErrorClass(t *testing.T) {
+	test_data := []struct {
+		err      error
+		expected string
+	}{
+		{errNoData, errorPermanent},
+		{&googleapi.Error{Code: 403}, errorPermanent},
+		{&googleapi.Error{Code: 429}, errorTransient},
+		{&googleapi.Error{Code: 503}, errorTransient},
+		{errors.New("received no VM IPs"), errorTransient},
+		{fmt.Errorf("compute.instances.get: %w", &googleapi.Error{Code: 404}), errorPermanent},
+		{fmt.Errorf("dns.changes.create failed after 5 attempts: %w", &googleapi.Error{Code: 503}), errorTransient},
+	}
+	for _, data := range test_data {
+		if got := errorClass(data.err); got != data.expected {
+			t.Errorf("FAILED: %v got %v expected %v\n", data.err, got, data.expected)
+		}
+	}
+}
+
+func readDeadLetters(t *testing.T, path string) (letters []deadLetter) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		letter := deadLetter{}
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			t.Fatal(err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters
+}
+
+func TestDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns_dead_letters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead_letters.jsonl")
+
+	deadLetters = &fileDeadLetters{Path: path}
+	events = newMemoryDedup(10)
+	maxEventAttempts = 3
+	defer func() {
+		deadLetters = newDeadLetterSink(os.Getenv("DNS_DEAD_LETTER"))
+		events = newEventStore("DNS_DEDUP_STORE")
+		maxEventAttempts = envInt("DNS_MAX_EVENT_ATTEMPTS", 5)
+	}()
+	ctx := context.Background()
+
+	// Permanent failures are dead-lettered right away
+	if err := PubSubMsgReader(ctx, PubSubMessage{MessageID: "1"}); err != nil {
+		t.Errorf("FAILED: got %v expected the message to be acknowledged\n", err)
+	}
+
+	// Delete event the VM can't be looked up for, retried until out of attempts
+	m := PubSubMessage{MessageID: "2", PublishTime: time.Now(), Data: []byte(`{
+		"insertId": "-def456",
+		"protoPayload": {
+			"authorizationInfo": [{"granted": true, "permission": "compute.instances.delete"}],
+			"resourceName": "projects/prj-dev-4328/zones/us-central1-a/instances/dev-vm-02"
+		}
+	}`)}
+	for attempt := 1; attempt <= 3; attempt++ {
+		err := PubSubMsgReader(ctx, m)
+		if attempt < 3 && err == nil {
+			t.Errorf("FAILED: attempt %v acknowledged\n", attempt)
+		} else if attempt == 3 && err != nil {
+			t.Errorf("FAILED: last attempt got %v expected a dead letter\n", err)
+		}
+	}
+
+	letters := readDeadLetters(t, path)
+	if len(letters) != 2 {
+		t.Fatalf("FAILED: got %v dead letters expected 2\n", len(letters))
+	}
+	if letters[0].MessageID != "1" || letters[0].ErrorClass != errorPermanent {
+		t.Errorf("FAILED: got %+v\n", letters[0])
+	}
+	if letters[1].MessageID != "2" || letters[1].ErrorClass != errorTransient || letters[1].Attempts != 3 {
+		t.Errorf("FAILED: got %+v\n", letters[1])
+	}
+}
+
+// Failed DNS changes fail the event: transient errors are redelivered, permanent ones dead-lettered
+func TestFailedChangeDeadLettered(t *testing.T) {
+	backend := setupTestDns(t)
+	path := filepath.Join(t.TempDir(), "dead_letters.jsonl")
+	deadLetters, maxEventAttempts = &fileDeadLetters{Path: path}, 2
+	replaying, replayVMs.vms = true, map[string]VMInfo{}
+	t.Cleanup(func() {
+		deadLetters, maxEventAttempts = newDeadLetterSink(os.Getenv("DNS_DEAD_LETTER")), envInt("DNS_MAX_EVENT_ATTEMPTS", 5)
+		replaying, replayVMs.vms = false, nil
+		events = newEventStore("DNS_DEDUP_STORE")
+	})
+	ctx := context.Background()
+
+	insert := map[string]interface{}{}
+	json.Unmarshal(insertAuditLog(`[{"key": "dns_host_name", "value": "devserver01"}]`), &insert)
+	insert["protoPayload"].(map[string]interface{})["request"].(map[string]interface{})["networkInterfaces"] = []map[string]string{{"networkIP": "10.0.0.5"}}
+	data, _ := json.Marshal(insert)
+	m := PubSubMessage{MessageID: "1", PublishTime: time.Now(), Data: data}
+
+	// 400 on the PTR zone's change
+	events = newMemoryDedup(10)
+	dnsAPI = failingDNS{memoryDNS: backend, failZone: "ptr-zone"}
+	if err := PubSubMsgReader(ctx, m); err != nil {
+		t.Errorf("FAILED: got %v expected a dead letter\n", err)
+	}
+	if _, seen, _ := events.get(ctx, "-abc123/operation-1627-abc"); seen {
+		t.Errorf("FAILED: failed event recorded as processed\n")
+	}
+
+	// 503 listing the PTR zone, redelivered until out of attempts
+	events = newMemoryDedup(10)
+	dnsAPI = failingDNS{memoryDNS: backend, listZone: "ptr-zone"}
+	if err := PubSubMsgReader(ctx, m); err == nil {
+		t.Errorf("FAILED: transient failure acknowledged\n")
+	}
+	if err := PubSubMsgReader(ctx, m); err != nil {
+		t.Errorf("FAILED: last attempt got %v expected a dead letter\n", err)
+	}
+
+	letters := readDeadLetters(t, path)
+	if len(letters) != 2 || letters[0].ErrorClass != errorPermanent || letters[1].ErrorClass != errorTransient || letters[1].Attempts != 2 {
+		t.Errorf("FAILED: got dead letters %+v\n", letters)
+	}
+}
+
+// A 412 on a change planned from a stale read fails the event, its redelivery plans again
+func TestPreconditionFailedRedelivered(t *testing.T) {
+	backend := setupTestDns(t)
+	replaying, replayVMs.vms, events = true, map[string]VMInfo{}, newMemoryDedup(10)
+	t.Cleanup(func() {
+		replaying, replayVMs.vms, events = false, nil, newEventStore("DNS_DEDUP_STORE")
+	})
+	ctx := context.Background()
+
+	insert := map[string]interface{}{}
+	json.Unmarshal(insertAuditLog(`[{"key": "dns_host_name", "value": "devserver01"}]`), &insert)
+	insert["protoPayload"].(map[string]interface{})["request"].(map[string]interface{})["networkInterfaces"] = []map[string]string{{"networkIP": "10.0.0.5"}}
+	data, _ := json.Marshal(insert)
+	m := PubSubMessage{MessageID: "1", PublishTime: time.Now(), Data: data}
+
+	dnsAPI = failingDNS{memoryDNS: backend, failZone: "default-zone", failCode: 412}
+	err := PubSubMsgReader(ctx, m)
+	if err == nil || errorClass(err) != errorTransient {
+		t.Fatalf("FAILED: got %v expected a transient error\n", err)
+	}
+	dnsAPI = backend
+	if err := PubSubMsgReader(ctx, m); err != nil {
+		t.Errorf("FAILED: redelivery got %v\n", err)
+	}
+	if _, exists, _ := getRecordSet(ctx, "prj-c-dnshub", "default-zone", "devserver01.gcp.company.com.", "A"); !exists {
+		t.Errorf("FAILED: record not created on redelivery\n")
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns_dead_letters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead_letters.jsonl")
+
+	setupTestDns(t)
+	events = newMemoryDedup(10)
+	defer func() { events = newEventStore("DNS_DEDUP_STORE") }()
+	ctx := context.Background()
+
+	sink := &fileDeadLetters{Path: path}
+	sink.publish(ctx, deadLetter{MessageID: "1", ErrorClass: errorTransient, Data: insertAuditLog(`[{"key": "dns_skip_record", "value": "true"}]`)})
+	sink.publish(ctx, deadLetter{MessageID: "2", ErrorClass: errorPermanent})
+
+	// Dry run only lists
+	if err := ReplayDeadLetters(ctx, path, DeadLetterFilter{}, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, seen, _ := events.get(ctx, "-abc123/operation-1627-abc"); seen {
+		t.Errorf("FAILED: dry run replayed an event\n")
+	}
+
+	if err := ReplayDeadLetters(ctx, path, DeadLetterFilter{ErrorClass: errorTransient}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, seen, _ := events.get(ctx, "-abc123/operation-1627-abc"); !seen {
+		t.Errorf("FAILED: selected dead letter wasn't replayed\n")
+	}
+
+	// Still unparsable, dead-lettered again
+	if err := ReplayDeadLetters(ctx, path, DeadLetterFilter{ErrorClass: errorPermanent}, false); err == nil {
+		t.Errorf("FAILED: replay dead-lettered again reported as a success\n")
+	}
+}
+
+func TestDeadLetterAttributes(t *testing.T) {
+	letter := deadLetter{
+		MessageID:   "42",
+		PublishTime: time.Date(2021, 7, 10, 10, 0, 0, 0, time.UTC),
+		Attributes:  map[string]string{"traceparent": "00-abc-def-01"},
+		Data:        []byte(`{"insertId": "-abc123"}`),
+		Reason:      "no vm info received",
+		ErrorClass:  errorTransient,
+		Attempts:    5,
+	}
+	message := &pubsub.PubsubMessage{Data: base64.StdEncoding.EncodeToString(letter.Data), Attributes: deadLetterAttributes(letter)}
+
+	got, err := deadLetterFromMessage(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.MessageID != "42" || got.Attempts != 5 || got.Reason != letter.Reason || !got.PublishTime.Equal(letter.PublishTime) ||
+		got.Attributes["traceparent"] != "00-abc-def-01" || len(got.Attributes) != 1 || string(got.Data) != string(letter.Data) {
+		t.Errorf("FAILED: got %+v expected %+v\n", got, letter)
+	}
+}
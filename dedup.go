@@ -0,0 +1,249 @@
+package gcedns
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+)
+
+/* Event deduplication
+Pub/Sub delivers at least once and the function is deployed with --retry, the same audit
+log entry can come back after it was processed. Outcomes of processed entries are kept,
+keyed on insertId and operation.id, and redelivered entries are acknowledged with the
+stored outcome. Only successful outcomes are kept: an event whose record lookup or change
+failed returns an error, and is redelivered or dead-lettered (see deadletter.go).
+
+DNS_DEDUP_STORE selects the store:
+- memory (default): LRU of the last DNS_DEDUP_SIZE entries, per function instance
+- file:///path/dedup.jsonl: append only file, for service mode on a persistent disk
+- firestore://PROJECT/COLLECTION: shared by all instances
+- none: disabled
+*/
+
+// Values by key, keeps processed event outcomes and the event sequencing state
+type eventStore interface {
+	get(ctx context.Context, key string) (outcome string, seen bool, err error)
+	put(ctx context.Context, key, outcome string) error
+}
+
+var events = newEventStore("DNS_DEDUP_STORE")
+
+// Store configured by the env var
+func newEventStore(env string) eventStore {
+	config := os.Getenv(env)
+	switch {
+	case config == "none":
+		return nil
+	case strings.HasPrefix(config, "file://"):
+		return newFileDedup(strings.TrimPrefix(config, "file://"))
+	case strings.HasPrefix(config, "firestore://"):
+		project_collection := strings.SplitN(strings.TrimPrefix(config, "firestore://"), "/", 2)
+		if len(project_collection) == 2 {
+			return &firestoreDedup{Project: project_collection[0], Collection: project_collection[1]}
+		}
+		fmt.Printf("Invalid %v %q, using memory\n", env, config)
+	case config != "" && config != "memory":
+		fmt.Printf("Unknown %v %q, using memory\n", env, config)
+	}
+	return newMemoryDedup(envInt("DNS_DEDUP_SIZE", 10000))
+}
+
+// Dedup key of an audit log entry, the Pub/Sub message ID for entries without an insertId
+func eventKey(logMessage logMetadata, messageID string) string {
+	if logMessage.InsertID == "" {
+		if messageID == "" {
+			return ""
+		}
+		return "message/" + messageID
+	}
+	return logMessage.InsertID + "/" + logMessage.Operation.ID
+}
+
+// LRU of processed entries
+type memoryDedup struct {
+	sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type dedupEntry struct {
+	Key     string    `json:"key"`
+	Outcome string    `json:"outcome"`
+	Time    time.Time `json:"time"`
+}
+
+func newMemoryDedup(capacity int) *memoryDedup {
+	return &memoryDedup{capacity: capacity, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (m *memoryDedup) get(ctx context.Context, key string) (string, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	element, seen := m.entries[key]
+	if !seen {
+		return "", false, nil
+	}
+	m.order.MoveToFront(element)
+	return element.Value.(dedupEntry).Outcome, true, nil
+}
+
+func (m *memoryDedup) put(ctx context.Context, key, outcome string) error {
+	m.Lock()
+	defer m.Unlock()
+	if element, seen := m.entries[key]; seen {
+		element.Value = dedupEntry{Key: key, Outcome: outcome, Time: time.Now()}
+		m.order.MoveToFront(element)
+		return nil
+	}
+	m.entries[key] = m.order.PushFront(dedupEntry{Key: key, Outcome: outcome, Time: time.Now()})
+	for m.order.Len() > m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(dedupEntry).Key)
+	}
+	return nil
+}
+
+// JSON lines file loaded into memory on first use, new outcomes are appended
+type fileDedup struct {
+	Path string
+
+	sync.Mutex
+	loaded  bool
+	entries map[string]string
+}
+
+func newFileDedup(path string) *fileDedup {
+	return &fileDedup{Path: path, entries: make(map[string]string)}
+}
+
+func (f *fileDedup) load() error {
+	if f.loaded {
+		return nil
+	}
+	file, err := os.Open(f.Path)
+	if os.IsNotExist(err) {
+		f.loaded = true
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := dedupEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Partly written last line
+			continue
+		}
+		f.entries[entry.Key] = entry.Outcome
+	}
+	f.loaded = true
+	return scanner.Err()
+}
+
+func (f *fileDedup) get(ctx context.Context, key string) (string, bool, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.load(); err != nil {
+		return "", false, err
+	}
+	outcome, seen := f.entries[key]
+	return outcome, seen, nil
+}
+
+func (f *fileDedup) put(ctx context.Context, key, outcome string) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.load(); err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(dedupEntry{Key: key, Outcome: outcome, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	f.entries[key] = outcome
+	return nil
+}
+
+// A document per entry, a TTL policy on the processed field can expire old entries
+type firestoreDedup struct {
+	Project    string
+	Collection string
+
+	once    sync.Once
+	service *firestore.Service
+	err     error
+}
+
+func (f *firestoreDedup) documents(ctx context.Context) (*firestore.ProjectsDatabasesDocumentsService, error) {
+	f.once.Do(func() {
+		f.service, f.err = firestore.NewService(context.Background())
+	})
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.service.Projects.Databases.Documents, nil
+}
+
+func (f *firestoreDedup) document(key string) string {
+	return fmt.Sprintf("projects/%v/databases/(default)/documents/%v/%v", f.Project, f.Collection, strings.NewReplacer("/", "_").Replace(key))
+}
+
+func (f *firestoreDedup) get(ctx context.Context, key string) (string, bool, error) {
+	documents, err := f.documents(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	var document *firestore.Document
+	err = withRetry(ctx, "firestore.documents.get", func() (err error) {
+		document, err = documents.Get(f.document(key)).Context(ctx).Do()
+		return err
+	})
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return document.Fields["outcome"].StringValue, true, nil
+}
+
+func (f *firestoreDedup) put(ctx context.Context, key, outcome string) error {
+	documents, err := f.documents(ctx)
+	if err != nil {
+		return err
+	}
+
+	document := &firestore.Document{Fields: map[string]firestore.Value{
+		"key":       {StringValue: key},
+		"outcome":   {StringValue: outcome},
+		"processed": {TimestampValue: time.Now().UTC().Format(time.RFC3339Nano)},
+	}}
+	return withRetry(ctx, "firestore.documents.patch", func() error {
+		_, err := documents.Patch(f.document(key), document).Context(ctx).Do()
+		return err
+	})
+}
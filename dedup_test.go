@@ -0,0 +1,74 @@
+package gcedns
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMemoryDedupEviction(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryDedup(2)
+
+	store.put(ctx, "a/op-1", "created")
+	store.put(ctx, "b/op-2", "denied")
+	// a is now the most recently used
+	store.get(ctx, "a/op-1")
+	store.put(ctx, "c/op-3", "deleted")
+
+	for key, expected := range map[string]bool{"a/op-1": true, "b/op-2": false, "c/op-3": true} {
+		if _, seen, _ := store.get(ctx, key); seen != expected {
+			t.Errorf("FAILED: %v seen %v expected %v\n", key, seen, expected)
+		}
+	}
+}
+
+func TestFileDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns_dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dedup.jsonl")
+
+	ctx := context.Background()
+	if err := newFileDedup(path).put(ctx, "a/op-1", "devserver01.gcp.company.com. created"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Outcomes survive a restart
+	outcome, seen, err := newFileDedup(path).get(ctx, "a/op-1")
+	if err != nil || !seen || outcome != "devserver01.gcp.company.com. created" {
+		t.Errorf("FAILED: got %q, %v, %v\n", outcome, seen, err)
+	}
+	if _, seen, _ := newFileDedup(path).get(ctx, "b/op-2"); seen {
+		t.Errorf("FAILED: unknown key seen\n")
+	}
+}
+
+func TestRedeliveredEvent(t *testing.T) {
+	setupTestDns(t)
+	events = newMemoryDedup(10)
+	defer func() { events = newEventStore("DNS_DEDUP_STORE") }()
+
+	message := PubSubMessage{Data: insertAuditLog(`[{"key": "dns_skip_record", "value": "true"}]`)}
+	if err := PubSubMsgReader(context.Background(), message); err != nil {
+		t.Errorf("FAILED: %v\n", err)
+	}
+	outcome, seen, _ := events.get(context.Background(), "-abc123/operation-1627-abc")
+	if !seen || !strings.Contains(outcome, "dns_skip_record is set") {
+		t.Errorf("FAILED: outcome got %q, %v\n", outcome, seen)
+	}
+
+	// A redelivery is acknowledged with the stored outcome, even when it would fail now
+	events.put(context.Background(), "-abc123/operation-1627-abc", "devserver01.gcp.company.com. created")
+	if err := PubSubMsgReader(context.Background(), message); err != nil {
+		t.Errorf("FAILED: redelivery got %v\n", err)
+	}
+	if outcome, _, _ := events.get(context.Background(), "-abc123/operation-1627-abc"); outcome != "devserver01.gcp.company.com. created" {
+		t.Errorf("FAILED: redelivery was processed again: %q\n", outcome)
+	}
+}
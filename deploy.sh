@@ -29,7 +29,7 @@ SA_FQDN="${DNS_SA_NAME}@${PROJECT_ID}.iam.gserviceaccount.com"
     gcloud logging sinks create ${LOG_SINK_NAME} pubsub.googleapis.com/projects/${PROJECT_ID}/topics/${PUBSUB_TOPIC} \
     --include-children \
     --organization=${ORG_ID} \
-    --log-filter='protoPayload.serviceName="compute.googleapis.com" operation.first="true" protoPayload.methodName=~("compute.instances.insert" OR "compute.instances.delete") protoPayload.request.@type=~("type.googleapis.com/compute.instances.insert" OR "type.googleapis.com/compute.instances.delete")'
+    --log-filter='protoPayload.serviceName="compute.googleapis.com" operation.first="true" protoPayload.methodName=~("compute.instances.insert" OR "compute.instances.delete" OR "compute.instanceGroups.addInstances" OR "compute.instanceGroups.removeInstances") protoPayload.request.@type=~("type.googleapis.com/compute.instances.insert" OR "type.googleapis.com/compute.instances.delete" OR "type.googleapis.com/compute.instanceGroups.addInstances" OR "type.googleapis.com/compute.instanceGroups.removeInstances")'
 }
 
 # Step4: Pubsub IAM permission
@@ -57,6 +57,7 @@ SA_FQDN="${DNS_SA_NAME}@${PROJECT_ID}.iam.gserviceaccount.com"
     gcloud functions deploy ${FUNCTION_NAME} \
         --trigger-topic=${PUBSUB_TOPIC} \
         --retry \
+        --timeout=300s \
         --region=us-central1 \
         --runtime=go113 \
         --entry-point=PubSubMsgReader \
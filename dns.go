@@ -8,19 +8,16 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
-	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 
 	"gopkg.in/yaml.v3"
 
 	"golang.org/x/oauth2/google"
-	"google.golang.org/api/dns/v1"
+	"google.golang.org/api/googleapi"
 )
 
 /* DNS entry management
@@ -30,16 +27,23 @@ https://cloud.google.com/dns/docs/reference/v1/changes/create#request-body
 
 // RecordSet
 type rdSet struct {
-	Kind   string `json:"kind"`
-	Rrsets []struct {
-		Kind    string   `json:"kind"`
-		Name    string   `json:"name"`
-		Rrdatas []string `json:"rrdatas"`
-		TTL     int      `json:"ttl"`
-		Type    string   `json:"type"`
-	} `json:"rrsets"`
+	Kind          string  `json:"kind"`
+	Rrsets        []rrset `json:"rrsets"`
+	NextPageToken string  `json:"nextPageToken,omitempty"`
 }
 
+type rrset struct {
+	Kind          string              `json:"kind,omitempty"`
+	Name          string              `json:"name"`
+	Rrdatas       []string            `json:"rrdatas,omitempty"`
+	RoutingPolicy *rrsetRoutingPolicy `json:"routingPolicy,omitempty"`
+	TTL           int                 `json:"ttl"`
+	Type          string              `json:"type"`
+}
+
+// Hostnames allowed per project, maintained by the DNS/Network team
+var dnsAllowListFile = "./serverless_function_source_code/dns_allow_list.yaml"
+
 // DNS management default variables
 var (
 	defaultDnsHostProject = os.Getenv("defaultDnsHostProject")
@@ -50,62 +54,133 @@ var (
 	defaultPTRHostProject = os.Getenv("defaultPTRHostProject")
 )
 
-// func dnsManagement(action string, dns_host_name string, ips []string) (status bool) {
-func dnsManagement(dnsInfo DnsInfo) (status bool) {
+// dnsManagement outcomes
+const (
+	dnsCreated   = "created"
+	dnsUpdated   = "updated"
+	dnsDeleted   = "deleted"
+	dnsUnchanged = "unchanged"
+	dnsDenied    = "denied"
+	dnsSkipped   = "skipped"
+	dnsFailed    = "failed"
+)
 
-	var mutex sync.Mutex
-	mutex.Lock()
-	defer mutex.Unlock()
-	var (
-		dns_host_name  string
-		dnsZone        string
-		dnsDomain      string
-		dnsHostProject string
-		ptrHostProject string
-		ptrZone        string
-		ips            []string
-		action         string
-	)
+// Reason codes of denied results, the denial metric's label
+const (
+	denyAllowList       = "allow_list"
+	denyZonePolicy      = "zone_policy"
+	denyConflict        = "conflict"
+	denyRoutingPolicy   = "routing_policy"
+	denyPublicPTRPolicy = "public_ptr_policy"
+	denyForwardMismatch = "forward_mismatch"
+)
 
-	if debug != "" {
-		fmt.Printf("dnsInfo: %v\n", dnsInfo)
+// Result of a dnsManagement request
+type dnsResult struct {
+	Status string
+	FQDN   string
+	Reason string
+	// Reason code of a denial, Reason carries the details
+	Code string
+	// Cause of a failed result, kept for errorClass
+	Err error
+	// Conflict policy applied when the record already existed with other VMs' IPs
+	Conflict string
+	// Readiness wait state, when the VM is readiness gated
+	Readiness string
+}
+
+// Metrics, audit trail and notifications of a result
+func reportResult(ctx context.Context, result dnsResult) {
+	observeResult(result)
+	auditResult(ctx, result)
+	notifyResult(ctx, result)
+}
+
+func (r dnsResult) ok() bool {
+	return r.Status == dnsCreated || r.Status == dnsUpdated || r.Status == dnsDeleted || r.Status == dnsUnchanged
+}
+
+// Error of a failed result, the event fails and is retried or dead-lettered
+func (r dnsResult) failure() error {
+	if r.Status != dnsFailed {
+		return nil
+	} else if r.Err != nil {
+		return fmt.Errorf("%v failed: %w", r.FQDN, r.Err)
+	}
+	return fmt.Errorf("%v failed: %v", r.FQDN, r.Reason)
+}
+
+func (r dnsResult) String() string {
+	result := fmt.Sprintf("%v %v", r.FQDN, r.Status)
+	if r.Conflict != "" {
+		result += fmt.Sprintf(" (conflict policy: %v)", r.Conflict)
+	}
+	if r.Reason != "" {
+		result += ": " + r.Reason
+	}
+	if r.Readiness != "" {
+		result += fmt.Sprintf(" [%v]", r.Readiness)
 	}
+	return result
+}
 
+// Effective record location, labels with the env.yaml defaults as fallback
+type dnsTarget struct {
+	HostName       string
+	Zone           string
+	Domain         string
+	HostProject    string
+	PTRZone        string
+	PTRHostProject string
+}
+
+func (t dnsTarget) fqdn() string {
+	return t.HostName + "." + t.Domain
+}
+
+// Populate dns request metadata based on provided VM labels
+func resolveDnsTarget(dnsInfo DnsInfo) (target dnsTarget) {
 	// Default wildcard PTRDomain. DNS Zone covering *.in-addr.arpa. domain should pre-exist.
 	if defaultPTRDomain == "" {
 		defaultPTRDomain = "in-addr.arpa."
 	}
-	// Populate dns request metadata based on provided VM labels
 	if dnsInfo.DnsHostName != "" {
-		dns_host_name = dnsInfo.DnsHostName
+		target.HostName = dnsInfo.DnsHostName
 	} else {
-		dns_host_name = dnsInfo.VMName
+		target.HostName = dnsInfo.VMName
 	}
 	if dnsInfo.DnsZoneName != "" {
-		dnsZone = dnsInfo.DnsZoneName
+		target.Zone = dnsInfo.DnsZoneName
 	} else {
-		dnsZone = defaultDnsZone
+		target.Zone = defaultDnsZone
 	}
 	if dnsInfo.DnsDomain != "" {
-		dnsDomain = dnsInfo.DnsDomain
+		target.Domain = dnsInfo.DnsDomain
 	} else {
-		dnsDomain = defaultDnsDomain
+		target.Domain = defaultDnsDomain
 	}
 	if dnsInfo.DnsZoneHostProject != "" {
-		dnsHostProject = dnsInfo.DnsZoneHostProject
+		target.HostProject = dnsInfo.DnsZoneHostProject
 	} else {
-		dnsHostProject = defaultDnsHostProject
+		target.HostProject = defaultDnsHostProject
 	}
 	if dnsInfo.PTRZoneHostProject != "" {
-		ptrHostProject = dnsInfo.PTRZoneHostProject
+		target.PTRHostProject = dnsInfo.PTRZoneHostProject
 	} else {
-		ptrHostProject = defaultPTRHostProject
+		target.PTRHostProject = defaultPTRHostProject
 	}
 	if dnsInfo.PTRZoneName != "" {
-		ptrZone = dnsInfo.PTRZoneName
+		target.PTRZone = dnsInfo.PTRZoneName
 	} else {
-		ptrZone = defaultPTRZone
+		target.PTRZone = defaultPTRZone
 	}
+	return target
+}
+
+// func dnsManagement(action string, dns_host_name string, ips []string) (status bool) {
+func dnsManagement(ctx context.Context, dnsInfo DnsInfo) (result dnsResult) {
+	defer func() { reportResult(ctx, result) }()
 
 	if debug != "" {
 		fmt.Printf("dnsInfo: %v\n", dnsInfo)
@@ -113,177 +188,263 @@ func dnsManagement(dnsInfo DnsInfo) (status bool) {
 			defaultDnsHostProject)
 	}
 
-	ips = dnsInfo.IPs
-	action = dnsInfo.Action
+	target := resolveDnsTarget(dnsInfo)
+	dns_host_name, dnsZone, dnsDomain, dnsHostProject := target.HostName, target.Zone, target.Domain, target.HostProject
+	ips := dnsInfo.IPs
+	action := dnsInfo.Action
 
 	if debug != "" {
 		fmt.Printf("From dns.go file: %q\t %q\n", dnsInfo.VMName, dns_host_name)
 	}
 
-	if dns_host_name == "" {
-		fmt.Println("dns_host_name is null, hence noop")
-		return
-	} else if dnsInfo.VMProject == "" {
-		fmt.Println("VMProject is null, hence noop")
-		return
+	dns_name := fmt.Sprintf(dns_host_name + "." + dnsDomain)
+	result = dnsResult{FQDN: dns_name}
+
+	if authResult, authorized := authorizeDnsInfo(ctx, dnsInfo, target); !authorized {
+		return authResult
 	} else {
-		ctx := context.Background()
+		conflictPolicy := conflictPolicyFor(dnsInfo.VMProject, dnsZone)
 
-		dnsService, err := dns.NewService(ctx)
-		if err != nil {
-			checkErr("Error creating DNS service: ", err)
+		if debug != "" {
+			fmt.Printf("DNS recordset info\ndnsHostProject: %v\t, dnsZone: %v\t, host: %v, conflict policy: %v\n", dnsHostProject, dnsZone, dns_name, conflictPolicy)
 		}
 
-		// Allow list check
-		dns_name := fmt.Sprintf(dns_host_name + "." + dnsDomain)
-		if !checkAllowList(dns_name, dnsInfo.VMProject) {
-			fmt.Printf("%q is not in the allow list for %q\n", dns_name, dnsInfo.VMProject)
-			return false
-		} else if len(ips) == 0 {
-			fmt.Printf("%q returned no IPs: %v\n", dnsInfo.VMName, ips)
+		// Service mode, plain A and PTR changes are coalesced with concurrent events
+		if batcher != nil && dnsInfo.RecordMode != recordModeCNAME && len(ips) > 0 {
+			if batched, ok := batchDnsManagement(ctx, dnsInfo, target, dns_name, conflictPolicy); ok {
+				return batched
+			}
 		}
 
-		/* change record
-		conditional recordSet support can be added - TDB */
-		dnsRecordSet := &dns.ResourceRecordSet{
-			Name:             dns_host_name + "." + dnsDomain,
-			Rrdatas:          ips,
-			SignatureRrdatas: []string{},
-			Ttl:              60,
-			Type:             "A",
+		// Serializes events on the same name and PTR
+		lock_keys := []string{recordKey(dnsHostProject, dnsZone, dns_name)}
+		if len(ips) > 0 && dnsInfo.RecordMode != recordModeCNAME {
+			lock_keys = append(lock_keys, recordKey(target.PTRHostProject, target.PTRZone, ptrRecordConverter(ips[0])))
 		}
+		unlock, err := lockRecords(ctx, lock_keys...)
+		if err != nil {
+			fmt.Println(err)
+			result.Status, result.Reason, result.Err = dnsFailed, "record locked", err
+			return
+		}
+		defer unlock()
 
-		// PTR record is created for VM's eth0 primary IP
-		ptrRecordSet := &dns.ResourceRecordSet{
-			Name:    ptrRecordConverter(ips[0]),
-			Rrdatas: []string{dns_host_name + "." + dnsDomain},
-			Ttl:     60,
-			Type:    "PTR",
+		// CNAME to the VM's zonal internal DNS name, no IPs or PTR involved
+		if dnsInfo.RecordMode == recordModeCNAME {
+			return cnameManagement(ctx, dnsInfo, target, conflictPolicy)
 		}
 
-		if action == "create" {
-			patch_check := true
+		if len(ips) == 0 {
+			fmt.Printf("%q returned no IPs: %v\n", dnsInfo.VMName, ips)
+			result.Status, result.Reason = dnsSkipped, "no VM IPs"
+			return
+		}
 
-			if patch_check {
-				// check if hostname exist - TDB.
-				// If exists patch an existing record - TBD.
-				if debug != "" {
-					fmt.Printf("DNS recordset info\ndnsHostProject: %v\t, dnsZone: %v\t, host: %v\n", dnsHostProject, dnsZone, dns_host_name+"."+dnsDomain)
-				}
+		txn := &dnsTransaction{}
+		a_record := rrset{Name: dns_name, Rrdatas: ips, TTL: 60, Type: "A"}
+		status := dnsCreated
 
-				recordSetName, err := dnsService.ResourceRecordSets.List(dnsHostProject, dnsZone).Name(dns_host_name + "." + dnsDomain).Do()
-				if err != nil {
-					checkErr("Error listing RecordSets: ", err)
-				}
-				rs_resp, err := recordSetName.MarshalJSON()
-				if err != nil {
-					checkErr("Error parsing RecordSet response: ", err)
-				}
-				// fmt.Printf("RS list resp: %v\n", string(rs_resp))
+		if action == "create" {
+			record, exists, err := getRecordSet(ctx, dnsHostProject, dnsZone, dns_name, "A")
+			if err != nil {
+				return lookupFailed(result, err)
+			}
 
-				rsdata := rdSet{}
-				if err = json.Unmarshal(rs_resp, &rsdata); err != nil {
-					checkErr("Error unmarshalling recordSet "+dns_name+": ", err)
+			if exists && !ipsOverlap(record.Rrdatas, ips) {
+				// Record is owned by other VMs
+				result.Conflict = conflictPolicy
+
+				switch conflictPolicy {
+				case conflictReject:
+					fmt.Printf("%q already exists with %v, rejected for %q\n", dns_name, record.Rrdatas, dnsInfo.VMName)
+					result.Status, result.Code, result.Reason = dnsDenied, denyConflict, fmt.Sprintf("record exists with %v", record.Rrdatas)
+					return
+				case conflictReplace:
+					txn.replace(dnsHostProject, dnsZone, record, a_record)
+					status, result.Reason = dnsUpdated, fmt.Sprintf("replaced %v", record.Rrdatas)
+				case conflictSuffix:
+					suffix_name, suffix_exists, err := nextFreeName(ctx, dnsHostProject, dnsZone, dns_host_name, dnsDomain, "A", ips)
+					if err != nil {
+						return lookupFailed(result, err)
+					} else if suffix_name == "" {
+						result.Status, result.Reason = dnsFailed, "no free suffixed name"
+						return
+					}
+					result.FQDN = suffix_name
+					if !checkAllowList(ctx, suffix_name, dnsInfo.VMProject) {
+						fmt.Printf("%q is not in the allow list for %q\n", suffix_name, dnsInfo.VMProject)
+						result.Status, result.Code, result.Reason = dnsDenied, denyAllowList, "not in the allow list for "+dnsInfo.VMProject
+						return
+					}
+					if suffix_exists {
+						result.Status = dnsUnchanged
+						return
+					}
+					dns_name = suffix_name
+					a_record.Name = suffix_name
+					txn.add(dnsHostProject, dnsZone, a_record)
+				default:
+					// merge, explicit round-robin
+					merged := record.clone()
+					merged.Rrdatas = ipCreateChecker(merged.Rrdatas, ips)
+					txn.replace(dnsHostProject, dnsZone, record, merged)
+					status = dnsUpdated
 				}
-				// PATCH call to update existing entry - TBD.
-				// Support other types of records, ex: CNAME
-				for _, record := range rsdata.Rrsets {
-					if record.Name == dns_name {
-						// Create PTR record
-						ptrcreateChange := &dns.Change{
-							Additions: []*dns.ResourceRecordSet{ptrRecordSet},
-						}
-						if !dnsChange(ptrHostProject, ptrZone, ptrcreateChange) {
-							fmt.Printf("Error creating PTR record: %q\n", ptrRecordSet.Rrdatas[0])
-						}
-						// Patch A record
-						return patchRS(dnsHostProject, dnsZone, dns_name, "A", ipCreateChecker(record.Rrdatas, ips))
+			} else if exists {
+				// Record already holds this VM's IPs, only the PTR may be missing
+				status = dnsUpdated
+			} else {
+				if conflictPolicy == conflictSuffix {
+					// A retried event may already hold a suffixed name, the base name's VM may be gone since
+					suffixed, found, err := findSuffixedName(ctx, dnsHostProject, dnsZone, dns_host_name, dnsDomain, "A", ips)
+					if err != nil {
+						return lookupFailed(result, err)
+					} else if found {
+						result.FQDN, result.Status = suffixed.Name, dnsUnchanged
+						return
 					}
 				}
+				txn.add(dnsHostProject, dnsZone, a_record)
+			}
+		} else if action == "delete" {
+			record, exists, err := getRecordSet(ctx, dnsHostProject, dnsZone, dns_name, "A")
+			if err != nil {
+				return lookupFailed(result, err)
 			}
 
-			createChange := &dns.Change{
-				Additions: []*dns.ResourceRecordSet{dnsRecordSet},
+			// auto-suffix records carry a suffixed name, find the one holding this VM's IPs,
+			// the base name may be gone already
+			if conflictPolicy == conflictSuffix && (!exists || !ipsOverlap(record.Rrdatas, ips)) {
+				suffixed, found, err := findSuffixedName(ctx, dnsHostProject, dnsZone, dns_host_name, dnsDomain, "A", ips)
+				if err != nil {
+					return lookupFailed(result, err)
+				} else if found {
+					dns_name, result.FQDN = suffixed.Name, suffixed.Name
+					record, exists = suffixed, true
+				}
 			}
-			if !dnsChange(dnsHostProject, dnsZone, createChange) {
-				fmt.Printf("Error creating A record: %q\n", dnsRecordSet.Name)
+			if !exists {
+				result.Status, result.Reason = dnsUnchanged, "no record found"
+				return
 			}
 
-			ptrcreateChange := &dns.Change{
-				Additions: []*dns.ResourceRecordSet{ptrRecordSet},
-			}
-			if !dnsChange(ptrHostProject, ptrZone, ptrcreateChange) {
-				fmt.Printf("Error creating PTR record: %q\n", ptrRecordSet.Rrdatas[0])
+			remaining_ips := ipDeleteChecker(record.Rrdatas, ips)
+			if len(remaining_ips) == 0 {
+				txn.remove(dnsHostProject, dnsZone, record)
+				status = dnsDeleted
+			} else {
+				if len(remaining_ips) != len(record.Rrdatas) {
+					remaining := record.clone()
+					remaining.Rrdatas = remaining_ips
+					txn.replace(dnsHostProject, dnsZone, record, remaining)
+				}
+				status = dnsUpdated
 			}
-		} else if action == "delete" {
+		}
 
-			// PATCH check
-			patch_check := true
+		// A and PTR go out as one transaction
+		if err := planPTR(ctx, txn, target, ips[0], dns_name, action); err != nil {
+			return lookupFailed(result, err)
+		}
+		if txn.empty() {
+			result.Status = dnsUnchanged
+			return
+		}
+		if result.Status, err = txn.commit(ctx, status); err != nil {
+			result.Reason, result.Err = err.Error(), err
+		}
+	}
+	return result
+}
 
-			if patch_check {
-				// check if hostname exist - TDB.
-				// If exists patch an existing record - TBD.
-				if debug != "" {
-					fmt.Printf("DNS recordset info\ndnsHostProject: %v\t, dnsZone: %v\t, host: %v\n", dnsHostProject, dnsZone, dns_host_name+"."+dnsDomain)
-				}
+// Naming, allow list and zone policy checks, none of them need the VM's IPs
+func authorizeDnsInfo(ctx context.Context, dnsInfo DnsInfo, target dnsTarget) (result dnsResult, authorized bool) {
+	dns_name := target.fqdn()
+	result = dnsResult{FQDN: dns_name}
 
-				recordSetName, err := dnsService.ResourceRecordSets.List(dnsHostProject, dnsZone).Name(dns_host_name + "." + dnsDomain).Do()
-				if err != nil {
-					checkErr("Error listing RecordSets: ", err)
-				}
-				rs_resp, err := recordSetName.MarshalJSON()
-				if err != nil {
-					checkErr("Error parsing RecordSet response: ", err)
-				}
-				// fmt.Printf("RS list resp: %v\n", string(rs_resp))
+	if target.HostName == "" {
+		fmt.Println("dns_host_name is null, hence noop")
+		result.Status, result.Reason = dnsSkipped, "no dns host name"
+		return
+	} else if dnsInfo.VMProject == "" {
+		fmt.Println("VMProject is null, hence noop")
+		result.Status, result.Reason = dnsSkipped, "no VM project"
+		return
+	}
 
-				rsdata := rdSet{}
-				if err = json.Unmarshal(rs_resp, &rsdata); err != nil {
-					checkErr("Error unmarshalling recordSet "+dns_name+": ", err)
-				}
-				// PATCH call to update existing entry - TBD.
-				for _, record := range rsdata.Rrsets {
-					if record.Name == dns_name {
-
-						sort.Strings(record.Rrdatas)
-						sort.Strings(ips)
-
-						if reflect.DeepEqual(record.Rrdatas, ips) {
-
-							deleteChange := &dns.Change{
-								Deletions: []*dns.ResourceRecordSet{dnsRecordSet},
-							}
-							// _, err = dnsService.Changes.Create(dnsHostProject, dnsZone, deleteChange).Context(ctx).Do()
-							// if err != nil {
-							// 	checkErr("Error deleting DNS change: ", err)
-							// 	return false
-							// }
-							if !dnsChange(dnsHostProject, dnsZone, deleteChange) {
-								fmt.Printf("Error creating A record: %q\n", dnsRecordSet.Name)
-							}
-							ptrDeleteChange := &dns.Change{
-								Deletions: []*dns.ResourceRecordSet{ptrRecordSet},
-							}
-							if !dnsChange(ptrHostProject, ptrZone, ptrDeleteChange) {
-								fmt.Printf("Error deleting PTR record: %q\n", ptrRecordSet.Rrdatas[0])
-							}
-						} else {
-							// Delete PTR record
-							ptrDeleteChange := &dns.Change{
-								Deletions: []*dns.ResourceRecordSet{ptrRecordSet},
-							}
-							if !dnsChange(ptrHostProject, ptrZone, ptrDeleteChange) {
-								fmt.Printf("Error creating PTR record: %q\n", ptrRecordSet.Rrdatas[0])
-							}
-							// Patch A record
-							return patchRS(dnsHostProject, dnsZone, dns_name, "A", ipDeleteChecker(record.Rrdatas, ips))
-						}
-					}
-				}
-			}
+	// Allow list check
+	if !checkAllowList(ctx, dns_name, dnsInfo.VMProject) {
+		fmt.Printf("%q is not in the allow list for %q\n", dns_name, dnsInfo.VMProject)
+		result.Status, result.Code, result.Reason = dnsDenied, denyAllowList, "not in the allow list for "+dnsInfo.VMProject
+		return
+	}
+
+	// Zone policy check, labels can point the record to any zone
+	rs_type := "A"
+	if dnsInfo.RecordMode == recordModeCNAME {
+		rs_type = "CNAME"
+	}
+	if !checkZonePolicy(dnsInfo.VMProject, target.HostProject, target.Zone, rs_type) {
+		fmt.Printf("%q is not allowed to write to zone %q in %q, denied %q\n", dnsInfo.VMProject, target.Zone, target.HostProject, dns_name)
+		result.Status, result.Code, result.Reason = dnsDenied, denyZonePolicy, fmt.Sprintf("zone %v in %v is not allowed for %v", target.Zone, target.HostProject, dnsInfo.VMProject)
+		return
+	}
+	if dnsInfo.RecordMode != recordModeCNAME && !checkZonePolicy(dnsInfo.VMProject, target.PTRHostProject, target.PTRZone, "PTR") {
+		fmt.Printf("%q is not allowed to write to PTR zone %q in %q, denied %q\n", dnsInfo.VMProject, target.PTRZone, target.PTRHostProject, dns_name)
+		result.Status, result.Code, result.Reason = dnsDenied, denyZonePolicy, fmt.Sprintf("PTR zone %v in %v is not allowed for %v", target.PTRZone, target.PTRHostProject, dnsInfo.VMProject)
+		return
+	}
+	return result, true
+}
+
+// Plans the PTR of the VM's eth0 primary IP pointing to dns_name, or its removal
+func planPTR(ctx context.Context, txn *dnsTransaction, target dnsTarget, ip, dns_name, action string) error {
+	ptr := rrset{Name: ptrRecordConverter(ip), Rrdatas: []string{dns_name}, TTL: 60, Type: "PTR"}
+	record, exists, err := getRecordSet(ctx, target.PTRHostProject, target.PTRZone, ptr.Name, "PTR")
+	if err != nil {
+		return err
+	}
+
+	if action == "create" {
+		if !exists {
+			txn.add(target.PTRHostProject, target.PTRZone, ptr)
+		} else if len(record.Rrdatas) != 1 || record.Rrdatas[0] != dns_name {
+			// Left over by a previous owner of the IP
+			txn.replace(target.PTRHostProject, target.PTRZone, record, ptr)
+		}
+	} else if action == "delete" && exists && ipsOverlap(record.Rrdatas, ptr.Rrdatas) {
+		if remaining_names := ipDeleteChecker(record.Rrdatas, ptr.Rrdatas); len(remaining_names) == 0 {
+			txn.remove(target.PTRHostProject, target.PTRZone, record)
+		} else {
+			remaining := record.clone()
+			remaining.Rrdatas = remaining_names
+			txn.replace(target.PTRHostProject, target.PTRZone, record, remaining)
+		}
+	}
+	return nil
+}
+
+// Lookup an existing recordSet by name and type.
+func getRecordSet(ctx context.Context, project, zone, dns_name, rs_type string) (record rrset, exists bool, err error) {
+	ctx, span := startSpan(ctx, "dns.resourceRecordSets.list", "project", project, "zone", zone, "name", dns_name, "type", rs_type)
+	records, err := dnsAPI.listRecordSets(ctx, project, zone, dns_name, rs_type)
+	span.end(err)
+	if err != nil {
+		return rrset{}, false, fmt.Errorf("Error listing RecordSets of %v in %v/%v: %w", dns_name, project, zone, err)
+	}
+	for _, record := range records {
+		if record.Name == dns_name && record.Type == rs_type {
+			return record, true, nil
 		}
 	}
-	return true
+	return rrset{}, false, nil
+}
+
+// A failed lookup fails the event instead of the process
+func lookupFailed(result dnsResult, err error) dnsResult {
+	fmt.Println(err)
+	result.Status, result.Reason, result.Err = dnsFailed, err.Error(), err
+	return result
 }
 
 /* Helper func to compare IPs for exiting records for create request */
@@ -342,86 +503,108 @@ func ptrRecordConverter(ip string) (ptr_record string) {
 	return strings.Join(ip_strings, ".") + "." + defaultPTRDomain
 }
 
-type pathBody struct {
-	RRdatas []string `json:"rrdatas"`
-}
-
-// PATCH implementation for updating records as dns library doesn't cover this
-func patchRS(project, zone, dns_name, rs_type string, ips []string) (status bool) {
-
-	if debug != "" {
-		fmt.Println("Patch operation details")
-		fmt.Printf("Project: %q, Zone: %q, dns_name: %q, rs_type: %q, ips %v\n", project, zone, dns_name, rs_type, ips)
-	}
-
+// Raw Cloud DNS API request, body is JSON encoded when set.
+// apiMethod names the call in retry logs, ex: dns.resourceRecordSets.patch
+func dnsRequest(ctx context.Context, apiMethod, method, url string, body interface{}) (statusCode int, respBody []byte, err error) {
 	// oAuth from ADC
-	client, err := google.DefaultClient(context.Background(), "https://www.googleapis.com/auth/cloud-platform")
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
 	if err != nil {
-		checkErr("Error creating PATCH client: ", err)
+		return 0, nil, fmt.Errorf("Error creating DNS API client: %w", err)
 	}
 
-	url := fmt.Sprintf("https://dns.googleapis.com/dns/v1/projects/%v/managedZones/%v/rrsets/%v/%v?alt=json", project, zone, url.QueryEscape(dns_name), rs_type)
-	// fmt.Println("PATCH url: " + url)
-	body, err := json.Marshal(pathBody{
-		RRdatas: ips,
-	})
-	if err != nil {
-		checkErr("Error marshalling PATCH request body: ", err)
-	}
-	req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(body))
-	if err != nil {
-		checkErr("Error patching "+dns_name+": ", err)
+	var reqBody []byte
+	if body != nil {
+		if reqBody, err = json.Marshal(body); err != nil {
+			return 0, nil, fmt.Errorf("Error marshalling %v request body: %w", method, err)
+		}
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		checkErr("Error patching "+dns_name+": ", err)
-	}
+	err = withRetry(ctx, apiMethod, func() error {
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(reqBody))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
 
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		respBody, _ := ioutil.ReadAll(resp.Body)
-		fmt.Println("Non 200 resp code received on patch operation")
-		fmt.Printf("PATCH resp: %v\n", string(respBody))
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		statusCode = resp.StatusCode
+		respBody, _ = ioutil.ReadAll(resp.Body)
+		if retryable(&googleapi.Error{Code: statusCode}) {
+			return &googleapi.Error{Code: statusCode, Body: string(respBody)}
+		}
+		return nil
+	})
+	if err != nil && statusCode == 0 {
+		return 0, nil, fmt.Errorf("Error sending %v request: %w", method, err)
+	}
+	// Non retryable errors are returned with their status code
+	if err == nil && statusCode >= 400 {
+		apiErrorsTotal.inc(apiMethod, strconv.Itoa(statusCode))
 	}
-	return resp.StatusCode == 200
+	return statusCode, respBody, nil
 }
 
-// DNS record changes
-func dnsChange(recordHostProject, recordZone string, dnsChange *dns.Change) (status bool) {
+func checkAllowList(ctx context.Context, dnsFQDN_Requested, vmProjectID string) (allowed bool) {
+	_, span := startSpan(ctx, "checkAllowList", "name", dnsFQDN_Requested, "project", vmProjectID)
+	defer func() {
+		span.set("allowed", strconv.FormatBool(allowed))
+		span.end(nil)
+	}()
 
-	ctx := context.Background()
-
-	dnsService, err := dns.NewService(ctx)
+	allow_list, err := loadAllowList()
 	if err != nil {
-		checkErr("Error creating DNS service: ", err)
+		log.Fatal(err)
 	}
 
-	_, err = dnsService.Changes.Create(recordHostProject, recordZone, dnsChange).Context(ctx).Do()
-	if err != nil {
-		fmt.Printf("DNS change request metadata. recordHostProject: %v, recordZone: %v, dnsChange: %v\n", recordHostProject, recordZone, dnsChange)
-		checkErr("Error making DNS change: ", err)
+	if allow_list[vmProjectID] == "" {
 		return false
+	} else {
+		prj_allow, _ := regexp.Compile(allow_list[vmProjectID])
+		return prj_allow.MatchString(dnsFQDN_Requested)
 	}
-	return true
 }
 
-func checkAllowList(dnsFQDN_Requested, vmProjectID string) bool {
-	// Read the allowed dns list from local yaml file
-	allowListData, err := ioutil.ReadFile("./serverless_function_source_code/dns_allow_list.yaml")
+// Read the allowed dns list from local yaml file, VM project -> FQDN regex
+func loadAllowList() (map[string]string, error) {
+	allowListData, err := ioutil.ReadFile(dnsAllowListFile)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	allow_list := make(map[string]string)
-
 	if err := yaml.Unmarshal(allowListData, &allow_list); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return allow_list, nil
+}
 
-	if allow_list[vmProjectID] == "" {
-		return false
-	} else {
-		prj_allow, _ := regexp.Compile(allow_list[vmProjectID])
-		return prj_allow.MatchString(dnsFQDN_Requested)
+// VM projects whose allow list covers the record, A and CNAME records by name, PTRs by target.
+// Records covered by none aren't managed here.
+func recordOwners(record rrset, allow_list map[string]string) (projects []string) {
+	names := []string{record.Name}
+	switch record.Type {
+	case "A", "CNAME":
+	case "PTR":
+		names = record.Rrdatas
+	default:
+		return nil
+	}
+	for project, pattern := range allow_list {
+		prj_allow, err := regexp.Compile(pattern)
+		if err != nil || pattern == "" {
+			continue
+		}
+		for _, name := range names {
+			if prj_allow.MatchString(name) {
+				projects = append(projects, project)
+				break
+			}
+		}
 	}
+	sort.Strings(projects)
+	return projects
 }
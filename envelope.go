@@ -0,0 +1,44 @@
+package gcedns
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/functions/metadata"
+)
+
+/* Pub/Sub envelope
+Cloud Functions pass the message ID and publish time in the event metadata, service mode
+sets them from the pulled message. Messages older than DNS_MAX_MESSAGE_AGE seconds, e.g. stuck
+in retries for hours, are dead-lettered instead of applied long after the fact.
+*/
+
+// 0 disables the max age
+var maxMessageAge = envSeconds("DNS_MAX_MESSAGE_AGE", 0)
+
+// Fills the message ID and publish time from the Cloud Functions event metadata
+func messageEnvelope(ctx context.Context, m PubSubMessage) PubSubMessage {
+	if m.MessageID != "" && !m.PublishTime.IsZero() {
+		return m
+	}
+	if meta, err := metadata.FromContext(ctx); err == nil {
+		if m.MessageID == "" {
+			m.MessageID = meta.EventID
+		}
+		if m.PublishTime.IsZero() {
+			m.PublishTime = meta.Timestamp
+		}
+	}
+	return m
+}
+
+// Time since the message was published, or since the audit log entry without a publish time
+func messageAge(m PubSubMessage, logMessage logMetadata) time.Duration {
+	switch {
+	case !m.PublishTime.IsZero():
+		return time.Since(m.PublishTime)
+	case !logMessage.Timestamp.IsZero():
+		return time.Since(logMessage.Timestamp)
+	}
+	return 0
+}
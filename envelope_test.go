@@ -0,0 +1,50 @@
+package gcedns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/functions/metadata"
+)
+
+func TestMessageEnvelope(t *testing.T) {
+	published := time.Date(2021, 7, 10, 10, 0, 0, 0, time.UTC)
+	ctx := metadata.NewContext(context.Background(), &metadata.Metadata{EventID: "2797262539811474", Timestamp: published})
+
+	m := messageEnvelope(ctx, PubSubMessage{Data: []byte(`{}`)})
+	if m.MessageID != "2797262539811474" || !m.PublishTime.Equal(published) {
+		t.Errorf("FAILED: got %v, %v\n", m.MessageID, m.PublishTime)
+	}
+	// Service mode messages keep their own envelope
+	if m := messageEnvelope(ctx, PubSubMessage{MessageID: "42", PublishTime: published.Add(time.Hour)}); m.MessageID != "42" {
+		t.Errorf("FAILED: got %v expected 42\n", m.MessageID)
+	}
+
+	if key := eventKey(logMetadata{}, "42"); key != "message/42" {
+		t.Errorf("FAILED: key got %v expected message/42\n", key)
+	}
+}
+
+func TestMaxMessageAge(t *testing.T) {
+	events = newMemoryDedup(10)
+	maxMessageAge = time.Hour
+	defer func() {
+		events = newEventStore("DNS_DEDUP_STORE")
+		maxMessageAge = envSeconds("DNS_MAX_MESSAGE_AGE", 0)
+	}()
+
+	m := PubSubMessage{Data: insertAuditLog(`[{"key": "dns_skip_record", "value": "true"}]`), MessageID: "42", PublishTime: time.Now().Add(-3 * time.Hour)}
+	if err := PubSubMsgReader(context.Background(), m); err != nil {
+		t.Errorf("FAILED: got %v expected the message to be acknowledged\n", err)
+	}
+	if _, seen, _ := events.get(context.Background(), "-abc123/operation-1627-abc"); seen {
+		t.Errorf("FAILED: message older than the max age was processed\n")
+	}
+
+	m.PublishTime = time.Now()
+	PubSubMsgReader(context.Background(), m)
+	if _, seen, _ := events.get(context.Background(), "-abc123/operation-1627-abc"); !seen {
+		t.Errorf("FAILED: recent message wasn't processed\n")
+	}
+}
@@ -0,0 +1,240 @@
+package gcedns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Export of the managed records
+The managed records of each zone (see snapshot.go) are rendered for review, or to mirror them:
+- zone: RFC 1035 master file, routing policies are commented out as they can't be expressed
+- terraform: google_dns_record_set resources
+- json: a list of recordSets
+Records are annotated with the VM and project of the last event that wrote the name, from the
+state store, and the VM projects whose allow list covers them. The export runs in its own process,
+so only a shared state store (file or firestore) knows the VMs.
+*/
+
+// Managed record of an export
+type exportedRecord struct {
+	Project       string              `json:"project"`
+	Zone          string              `json:"zone"`
+	Name          string              `json:"name"`
+	Type          string              `json:"type"`
+	TTL           int                 `json:"ttl"`
+	Rrdatas       []string            `json:"rrdatas,omitempty"`
+	RoutingPolicy *rrsetRoutingPolicy `json:"routing_policy,omitempty"`
+	VMName        string              `json:"vm_name,omitempty"`
+	VMProject     string              `json:"vm_project,omitempty"`
+	// VM projects whose allow list covers the record
+	OwnerProjects []string `json:"owner_projects"`
+}
+
+var exportFormats = map[string]string{"zone": ".zone", "terraform": ".tf", "json": ".json"}
+
+// Managed records of the zone with their owners
+func exportZone(ctx context.Context, project, zone string) ([]exportedRecord, error) {
+	allow_list, err := loadAllowList()
+	if err != nil {
+		return nil, err
+	}
+	records, err := managedRecords(ctx, project, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	exported := []exportedRecord{}
+	for _, record := range records {
+		e := exportedRecord{Project: project, Zone: zone, Name: record.Name, Type: record.Type, TTL: record.TTL,
+			Rrdatas: record.Rrdatas, RoutingPolicy: record.RoutingPolicy, OwnerProjects: recordOwners(record, allow_list)}
+		// PTRs are owned by the VM of the name they point to
+		name := record.Name
+		if record.Type == "PTR" && len(record.Rrdatas) > 0 {
+			name = record.Rrdatas[0]
+		}
+		if state, seen := loadEventState(ctx, nameStateKey(name)); seen {
+			e.VMName, e.VMProject = state.VMName, state.VMProject
+		}
+		exported = append(exported, e)
+	}
+	return exported, nil
+}
+
+func (e exportedRecord) owner() string {
+	owner := "owner " + strings.Join(e.OwnerProjects, ",")
+	if e.VMName != "" {
+		owner = fmt.Sprintf("vm %v in %v, %v", e.VMName, e.VMProject, owner)
+	}
+	return owner
+}
+
+func writeZoneFile(w io.Writer, project, zone string, records []exportedRecord) error {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "; Managed records of %v/%v, exported %v\n", project, zone, time.Now().UTC().Format(time.RFC3339))
+	for _, e := range records {
+		fmt.Fprintf(&out, "; %v\n", e.owner())
+		if e.RoutingPolicy != nil {
+			policy, _ := json.Marshal(e.RoutingPolicy)
+			fmt.Fprintf(&out, "; %v %v IN %v routing policy %s\n", e.Name, e.TTL, e.Type, policy)
+			continue
+		}
+		for _, data := range e.Rrdatas {
+			fmt.Fprintf(&out, "%v\t%v\tIN\t%v\t%v\n", e.Name, e.TTL, e.Type, data)
+		}
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+var terraformName = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// Resource name, ex: default_zone_devserver01_gcp_company_com_a
+func terraformResourceName(e exportedRecord) string {
+	name := strings.ToLower(terraformName.ReplaceAllString(strings.Join([]string{e.Zone, strings.TrimSuffix(e.Name, "."), e.Type}, "_"), "_"))
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "r_" + name
+	}
+	return name
+}
+
+// Resource name unique within the export, names of the export so far are in taken.
+// Names differing only by - and _, ex: zones a-b and a_b, get a _2, _3... suffix.
+func uniqueResourceName(e exportedRecord, taken map[string]bool) string {
+	name := terraformResourceName(e)
+	unique := name
+	for n := 2; taken[unique]; n++ {
+		unique = fmt.Sprintf("%v_%v", name, n)
+	}
+	taken[unique] = true
+	return unique
+}
+
+func terraformList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = strconv.Quote(value)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+func writeTerraform(w io.Writer, project, zone string, records []exportedRecord, taken map[string]bool) error {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "# Managed records of %v/%v, exported %v\n", project, zone, time.Now().UTC().Format(time.RFC3339))
+	for _, e := range records {
+		fmt.Fprintf(&out, "\n# %v\n", e.owner())
+		fmt.Fprintf(&out, "resource \"google_dns_record_set\" %q {\n", uniqueResourceName(e, taken))
+		fmt.Fprintf(&out, "  project      = %q\n", e.Project)
+		fmt.Fprintf(&out, "  managed_zone = %q\n", e.Zone)
+		fmt.Fprintf(&out, "  name         = %q\n", e.Name)
+		fmt.Fprintf(&out, "  type         = %q\n", e.Type)
+		fmt.Fprintf(&out, "  ttl          = %v\n", e.TTL)
+		switch {
+		case e.RoutingPolicy == nil:
+			fmt.Fprintf(&out, "  rrdatas      = %v\n", terraformList(e.Rrdatas))
+		case e.RoutingPolicy.Wrr != nil:
+			fmt.Fprintf(&out, "\n  routing_policy {\n")
+			for _, item := range e.RoutingPolicy.Wrr.Items {
+				fmt.Fprintf(&out, "    wrr {\n      weight  = %v\n      rrdatas = %v\n    }\n", item.Weight, terraformList(item.Rrdatas))
+			}
+			fmt.Fprintf(&out, "  }\n")
+		case e.RoutingPolicy.Geo != nil:
+			fmt.Fprintf(&out, "\n  routing_policy {\n")
+			for _, item := range e.RoutingPolicy.Geo.Items {
+				fmt.Fprintf(&out, "    geo {\n      location = %q\n      rrdatas  = %v\n    }\n", item.Location, terraformList(item.Rrdatas))
+			}
+			fmt.Fprintf(&out, "  }\n")
+		}
+		fmt.Fprintf(&out, "}\n")
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// Terraform resource names are unique across the calls sharing taken
+func writeExport(w io.Writer, format, project, zone string, records []exportedRecord, taken map[string]bool) error {
+	switch format {
+	case "zone":
+		return writeZoneFile(w, project, zone, records)
+	case "terraform":
+		return writeTerraform(w, project, zone, records, taken)
+	case "json":
+		data, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	}
+	return fmt.Errorf("unknown export format %q, expected zone, terraform or json", format)
+}
+
+// ExportRecords writes the managed records of the zones (PROJECT/ZONE), of the default and
+// policy zones when none are given, as a zone file, Terraform or JSON. Zones are written to
+// PROJECT_ZONE.zone|.tf|.json files in dir, or one after the other to stdout when dir is empty.
+func ExportRecords(ctx context.Context, format, dir string, zones []string) error {
+	extension, known := exportFormats[format]
+	if !known {
+		return fmt.Errorf("unknown export format %q, expected zone, terraform or json", format)
+	}
+	if len(zones) == 0 {
+		var err error
+		if zones, err = managedZones(); err != nil {
+			return err
+		}
+	}
+	if _, memory := eventStates.(*memoryDedup); memory || eventStates == nil {
+		// On stderr, stdout may be the export
+		fmt.Fprintf(os.Stderr, "Warning: DNS_STATE_STORE is not a shared store, records are exported without their VM\n")
+	}
+
+	var all []exportedRecord
+	// Terraform resources of all zones share a module
+	taken := make(map[string]bool)
+	for _, zone := range zones {
+		project, name, err := splitZone(zone)
+		if err != nil {
+			return err
+		}
+		records, err := exportZone(ctx, project, name)
+		if err != nil {
+			return fmt.Errorf("Error exporting %v: %v", zone, err)
+		}
+
+		switch {
+		case dir != "":
+			var out bytes.Buffer
+			if err := writeExport(&out, format, project, name, records, taken); err != nil {
+				return err
+			}
+			file := filepath.Join(dir, project+"_"+name+extension)
+			if err := ioutil.WriteFile(file, out.Bytes(), 0644); err != nil {
+				return err
+			}
+			fmt.Printf("Exported %v records of %v to %v\n", len(records), zone, file)
+		case format == "json":
+			// A single list on stdout
+			all = append(all, records...)
+		default:
+			if err := writeExport(os.Stdout, format, project, name, records, taken); err != nil {
+				return err
+			}
+		}
+	}
+	if dir == "" && format == "json" {
+		if all == nil {
+			all = []exportedRecord{}
+		}
+		return writeExport(os.Stdout, format, "", "", all, taken)
+	}
+	return nil
+}
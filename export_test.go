@@ -0,0 +1,89 @@
+package gcedns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportRecords(t *testing.T) {
+	backend := setupTestDns(t)
+	eventStates = newMemoryDedup(100)
+	defer func() { eventStates = newEventStore("DNS_STATE_STORE") }()
+	ctx := context.Background()
+
+	dnsManagement(ctx, DnsInfo{DnsHostName: "devserver01", Action: "create", IPs: []string{"10.0.0.5"}, VMName: "vm-01", VMProject: "prj-dev-4328"})
+	recordEventState(ctx, eventState{Timestamp: time.Now(), Action: "create", InstanceID: "1", VMName: "vm-01", VMProject: "prj-dev-4328"},
+		nameStateKey("devserver01.gcp.company.com."))
+	// Not managed
+	backend.createChange(ctx, "prj-c-dnshub", "default-zone", rrChange{Additions: []rrset{{Name: "www.gcp.company.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.1.0.1"}}}})
+
+	records, err := exportZone(ctx, "prj-c-dnshub", "default-zone")
+	if err != nil || len(records) != 1 {
+		t.Fatalf("FAILED: got %+v, %v expected devserver01 only\n", records, err)
+	}
+
+	var zone bytes.Buffer
+	writeZoneFile(&zone, "prj-c-dnshub", "default-zone", records)
+	if !strings.Contains(zone.String(), "; vm vm-01 in prj-dev-4328, owner prj-dev-4328\ndevserver01.gcp.company.com.\t60\tIN\tA\t10.0.0.5\n") {
+		t.Errorf("FAILED: got zone file\n%v\n", zone.String())
+	}
+
+	var tf bytes.Buffer
+	writeTerraform(&tf, "prj-c-dnshub", "default-zone", records, map[string]bool{})
+	for _, line := range []string{`resource "google_dns_record_set" "default_zone_devserver01_gcp_company_com_a" {`, `managed_zone = "default-zone"`, `rrdatas      = ["10.0.0.5"]`} {
+		if !strings.Contains(tf.String(), line) {
+			t.Errorf("FAILED: %q missing from\n%v\n", line, tf.String())
+		}
+	}
+
+	// PTRs are annotated with the VM of their target
+	dir := t.TempDir()
+	if err := ExportRecords(ctx, "json", dir, []string{"prj-c-dnshub/ptr-zone"}); err != nil {
+		t.Fatalf("FAILED: export got %v\n", err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "prj-c-dnshub_ptr-zone.json"))
+	var ptrs []exportedRecord
+	if err := json.Unmarshal(data, &ptrs); err != nil || len(ptrs) != 1 || ptrs[0].Type != "PTR" || ptrs[0].VMName != "vm-01" {
+		t.Errorf("FAILED: got %s, %v\n", data, err)
+	}
+
+	if err := ExportRecords(ctx, "bind", dir, nil); err == nil {
+		t.Errorf("FAILED: unknown format accepted\n")
+	}
+}
+
+func TestTerraformRoutingPolicy(t *testing.T) {
+	record := exportedRecord{Project: "prj-c-dnshub", Zone: "default-zone", Name: "api.gcp.company.com.", Type: "A", TTL: 60,
+		RoutingPolicy: &rrsetRoutingPolicy{Geo: &geoPolicy{Items: []geoPolicyItem{{Location: "us-central1", Rrdatas: []string{"10.0.0.5"}}}}}}
+	var tf bytes.Buffer
+	writeTerraform(&tf, "prj-c-dnshub", "default-zone", []exportedRecord{record}, map[string]bool{})
+	if !strings.Contains(tf.String(), "  routing_policy {\n    geo {\n      location = \"us-central1\"\n      rrdatas  = [\"10.0.0.5\"]\n    }\n  }\n") ||
+		strings.Contains(tf.String(), "rrdatas      =") {
+		t.Errorf("FAILED: got\n%v\n", tf.String())
+	}
+}
+
+func TestUniqueResourceName(t *testing.T) {
+	taken := map[string]bool{}
+	test_data := []struct {
+		zone     string
+		name     string
+		expected string
+	}{
+		{"a-b", "web-01.gcp.company.com.", "a_b_web_01_gcp_company_com_a"},
+		{"a_b", "web_01.gcp.company.com.", "a_b_web_01_gcp_company_com_a_2"},
+		{"a-b", "web_01.gcp.company.com.", "a_b_web_01_gcp_company_com_a_3"},
+		{"1-zone", "web.gcp.company.com.", "r_1_zone_web_gcp_company_com_a"},
+	}
+	for _, data := range test_data {
+		if name := uniqueResourceName(exportedRecord{Zone: data.zone, Name: data.name, Type: "A"}, taken); name != data.expected {
+			t.Errorf("FAILED: %v %v got %v expected %v\n", data.zone, data.name, name, data.expected)
+		}
+	}
+}
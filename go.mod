@@ -3,7 +3,11 @@ module gcedns.com/gcedns
 go 1.16
 
 require (
-	cloud.google.com/go v0.86.0 // indirect
+	cloud.google.com/go v0.86.0
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
 	golang.org/x/oauth2 v0.0.0-20210628180205-a41e5a781914
 	google.golang.org/api v0.50.0
 	google.golang.org/genproto v0.0.0-20210707164411-8c882eb9abba // indirect
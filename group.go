@@ -0,0 +1,180 @@
+package gcedns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+/* Group records
+A group name holds the nic0 IP of every current member of the group, members are
+added and removed as VMs join or leave and the record is deleted once the group is empty.
+The group is either set through the dns_group VM label, or is the MIG the VM was created by.
+*/
+
+const (
+	addInstancesType    = "type.googleapis.com/compute.instanceGroups.addInstances"
+	removeInstancesType = "type.googleapis.com/compute.instanceGroups.removeInstances"
+)
+
+// Group record name for a VM, empty if the VM isn't part of a group
+func vmGroupName(vm_info VMInfo) string {
+	if vm_info.Labels["dns_group"] != "" {
+		return vm_info.Labels["dns_group"]
+	}
+	// MIG instances carry the instance group manager in the created-by metadata key
+	// ex: projects/PROJECT_NUMBER/zones/ZONE/instanceGroupManagers/NAME
+	if created_by := vm_info.Metadata["created-by"]; strings.Contains(created_by, "/instanceGroupManagers/") {
+		_, _, name := parseResourceURL(created_by)
+		return name
+	}
+	return ""
+}
+
+// Unmanaged instance group addInstances/removeInstances processing
+func gceGroupEventOperation(logMessage logMetadata, ctx context.Context) (result string, err error) {
+	action := "create"
+	if logMessage.ProtoPayload.Request.Type == removeInstancesType {
+		action = "delete"
+	}
+
+	for _, member := range logMessage.ProtoPayload.Request.Instances {
+		project, zone, name := parseResourceURL(member.Instance)
+		var (
+			vm_info        VMInfo
+			receivedVMData bool
+		)
+		if replaying {
+			vm_info, receivedVMData = replayVM(member.Instance)
+		} else {
+			vm_info, receivedVMData = getInstance(ctx, project, zone, name)
+		}
+		if !receivedVMData {
+			result += fmt.Sprintf("No VM info received for group member %v\n", member.Instance)
+			continue
+		}
+
+		if vm_info.Labels["dns_skip_record"] != "" {
+			result += fmt.Sprintf("dns_skip_record is set for %v\n", member.Instance)
+			continue
+		}
+
+		group := vm_info.Labels["dns_group"]
+		if group == "" {
+			group = logMessage.Resource.Labels.InstanceGroupName
+		}
+
+		dnsRes := groupManagement(ctx, groupDnsInfo(vm_info, group, action))
+		err = firstFailure(err, dnsRes)
+		result += fmt.Sprintf("%v's group record: %v\n", member.Instance, dnsRes)
+	}
+	return result, err
+}
+
+// Group record request for a member VM
+func groupDnsInfo(vm_info VMInfo, group, action string) DnsInfo {
+	routing_policy, weight := vmRoutingPolicy(vm_info)
+	return DnsInfo{
+		DnsHostName:        group,
+		DnsZoneName:        vm_info.Labels["dns_zone_name"],
+		DnsZoneHostProject: vm_info.Labels["dns_zone_host_project"],
+		DnsDomain:          vm_info.Labels["dns_domain"],
+		Action:             action,
+		IPs:                vm_info.IPs,
+		VMName:             vm_info.Name,
+		VMProject:          vm_info.VMProject,
+		RoutingPolicy:      routing_policy,
+		Region:             zoneRegion(vm_info.Zone),
+		Weight:             weight,
+	}
+}
+
+// Adds or removes a VM's nic0 IP to/from the group's A record. dnsInfo.DnsHostName is the group name.
+func groupManagement(ctx context.Context, dnsInfo DnsInfo) (result dnsResult) {
+	defer func() { reportResult(ctx, result) }()
+
+	target := resolveDnsTarget(dnsInfo)
+	dns_name := target.HostName + "." + target.Domain
+	result = dnsResult{FQDN: dns_name}
+
+	if len(dnsInfo.IPs) == 0 {
+		result.Status, result.Reason = dnsSkipped, "no VM IPs"
+		return
+	}
+	member_ips := dnsInfo.IPs[:1]
+
+	if !checkAllowList(ctx, dns_name, dnsInfo.VMProject) {
+		fmt.Printf("%q is not in the allow list for %q\n", dns_name, dnsInfo.VMProject)
+		result.Status, result.Code, result.Reason = dnsDenied, denyAllowList, "not in the allow list for "+dnsInfo.VMProject
+		return
+	}
+	if !checkZonePolicy(dnsInfo.VMProject, target.HostProject, target.Zone, "A") {
+		fmt.Printf("%q is not allowed to write to zone %q in %q, denied %q\n", dnsInfo.VMProject, target.Zone, target.HostProject, dns_name)
+		result.Status, result.Code, result.Reason = dnsDenied, denyZonePolicy, fmt.Sprintf("zone %v in %v is not allowed for %v", target.Zone, target.HostProject, dnsInfo.VMProject)
+		return
+	}
+
+	if batcher != nil && dnsInfo.RoutingPolicy == "" {
+		results := batcher.submit(ctx, recordOp{Project: target.HostProject, Zone: target.Zone, Name: dns_name, Type: "A", Action: dnsInfo.Action, Rrdatas: member_ips})
+		if results[0].Status != batchFallback {
+			return results[0]
+		}
+	}
+
+	// Members join and leave concurrently on scale out/in
+	unlock, err := lockRecords(ctx, recordKey(target.HostProject, target.Zone, dns_name))
+	if err != nil {
+		fmt.Println(err)
+		result.Status, result.Reason, result.Err = dnsFailed, "record locked", err
+		return
+	}
+	defer unlock()
+
+	if dnsInfo.RoutingPolicy != "" {
+		return routedGroupManagement(ctx, dnsInfo, target, dns_name, member_ips[0])
+	}
+
+	record, exists, err := getRecordSet(ctx, target.HostProject, target.Zone, dns_name, "A")
+	if err != nil {
+		return lookupFailed(result, err)
+	} else if record.RoutingPolicy != nil {
+		result.Status, result.Code, result.Reason = dnsDenied, denyRoutingPolicy, "record has a routing policy, set dns_routing_policy"
+		return
+	}
+
+	txn := &dnsTransaction{}
+	status := dnsUnchanged
+
+	if dnsInfo.Action == "create" {
+		if !exists {
+			txn.add(target.HostProject, target.Zone, rrset{Name: dns_name, Rrdatas: member_ips, TTL: 60, Type: "A"})
+			status = dnsCreated
+		} else if !ipsOverlap(record.Rrdatas, member_ips) {
+			merged := record.clone()
+			merged.Rrdatas = ipCreateChecker(merged.Rrdatas, member_ips)
+			txn.replace(target.HostProject, target.Zone, record, merged)
+			status = dnsUpdated
+		}
+	} else if dnsInfo.Action == "delete" && exists && ipsOverlap(record.Rrdatas, member_ips) {
+		remaining_ips := ipDeleteChecker(record.Rrdatas, member_ips)
+		if len(remaining_ips) == 0 {
+			// Last member left the group
+			txn.remove(target.HostProject, target.Zone, record)
+			status = dnsDeleted
+		} else {
+			remaining := record.clone()
+			remaining.Rrdatas = remaining_ips
+			txn.replace(target.HostProject, target.Zone, record, remaining)
+			status = dnsUpdated
+		}
+	}
+
+	if txn.empty() {
+		result.Status = dnsUnchanged
+		return
+	}
+	if result.Status, err = txn.commit(ctx, status); err != nil {
+		result.Reason, result.Err = err.Error(), err
+	}
+	return result
+}
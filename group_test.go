@@ -0,0 +1,75 @@
+package gcedns
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestVMGroupName(t *testing.T) {
+
+	test_data := []struct {
+		vm_info  VMInfo
+		expected string
+	}{
+		{VMInfo{Labels: map[string]string{"dns_group": "web"}, Metadata: map[string]string{"created-by": "projects/123/zones/us-central1-a/instanceGroupManagers/web-mig"}}, "web"},
+		{VMInfo{Metadata: map[string]string{"created-by": "projects/123/zones/us-central1-a/instanceGroupManagers/web-mig"}}, "web-mig"},
+		{VMInfo{Metadata: map[string]string{"created-by": "projects/123/regions/us-central1/instanceGroupManagers/web-rmig"}}, "web-rmig"},
+		{VMInfo{Labels: map[string]string{"dns_host_name": "dev01"}}, ""},
+	}
+
+	for _, data := range test_data {
+		if got := vmGroupName(data.vm_info); got != data.expected {
+			t.Errorf("FAILED: got %q expected %q\n", got, data.expected)
+		}
+	}
+}
+
+func TestParseResourceURL(t *testing.T) {
+
+	project, zone, name := parseResourceURL("https://www.googleapis.com/compute/v1/projects/prj-dev-4328/zones/us-central1-a/instances/dev01")
+	if project != "prj-dev-4328" || zone != "us-central1-a" || name != "dev01" {
+		t.Errorf("FAILED: got %q, %q, %q\n", project, zone, name)
+	}
+}
+
+// A MIG member's delete finds the group recorded on create, its created-by metadata may be gone
+func TestMIGMemberDelete(t *testing.T) {
+	setupTestDns(t)
+	ctx := context.Background()
+	eventStates, replaying, replayVMs.vms = newMemoryDedup(100), true, map[string]VMInfo{}
+	t.Cleanup(func() {
+		eventStates, replaying, replayVMs.vms = newEventStore("DNS_STATE_STORE"), false, nil
+	})
+
+	insert := map[string]interface{}{}
+	json.Unmarshal(insertAuditLog(`[{"key": "dns_host_name", "value": "devserver01"}]`), &insert)
+	insert["timestamp"] = "2021-07-10T10:00:00Z"
+	request := insert["protoPayload"].(map[string]interface{})["request"].(map[string]interface{})
+	request["networkInterfaces"] = []map[string]string{{"networkIP": "10.0.0.5"}}
+	request["metadata"] = map[string]interface{}{"items": []map[string]string{
+		{"key": "created-by", "value": "projects/123/zones/us-central1-a/instanceGroupManagers/devserver-pool"}}}
+	insert_data, _ := json.Marshal(insert)
+	if result, err := gceEventCheckOperation(insert_data, ctx); err != nil || !strings.Contains(result, "group record") {
+		t.Fatalf("FAILED: insert got %v, %v\n", result, err)
+	}
+	if record, _, _ := getRecordSet(ctx, "prj-c-dnshub", "default-zone", "devserver-pool.gcp.company.com.", "A"); len(record.Rrdatas) != 1 {
+		t.Fatalf("FAILED: got group record %v\n", record.Rrdatas)
+	}
+
+	// The VM as seen on delete, without its metadata
+	replayVMs.vms["projects/prj-dev-4328/zones/us-central1-a/instances/dev-vm-01"] = VMInfo{Name: "dev-vm-01", VMProject: "prj-dev-4328",
+		Zone: "us-central1-a", IPs: []string{"10.0.0.5"}, Labels: map[string]string{"dns_host_name": "devserver01"}}
+	delete := map[string]interface{}{}
+	json.Unmarshal(deleteAuditLog("dev-vm-01"), &delete)
+	delete["timestamp"] = "2021-07-10T11:00:00Z"
+	delete["resource"].(map[string]interface{})["labels"].(map[string]interface{})["instance_id"] = "123"
+	delete_data, _ := json.Marshal(delete)
+	if result, err := gceEventCheckOperation(delete_data, ctx); err != nil || !strings.Contains(result, "group record") {
+		t.Errorf("FAILED: delete got %v, %v\n", result, err)
+	}
+	if _, exists, _ := getRecordSet(ctx, "prj-c-dnshub", "default-zone", "devserver-pool.gcp.company.com.", "A"); exists {
+		t.Errorf("FAILED: group record left after its only member was deleted\n")
+	}
+}
@@ -0,0 +1,312 @@
+package gcedns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+)
+
+/* Record locks
+Events read-modify-write the same recordSets, ex: MIG members joining a group record.
+Records are locked by key within the process, and across instances through a lease
+backend when DNS_LOCK_BUCKET is set.
+*/
+
+var (
+	// Lease lifetime, renewed while held, a crashed holder's lease is taken over once expired
+	lockTTL = envSeconds("DNS_LOCK_TTL", 60)
+	// Max time to wait for a record lock
+	lockTimeout = envSeconds("DNS_LOCK_TIMEOUT", 60)
+)
+
+// In-process locks by record key
+type keyedMutex struct {
+	sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+func (k *keyedMutex) lock(key string) (unlock func()) {
+	k.Lock()
+	l, exists := k.locks[key]
+	if !exists {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.Unlock()
+	}
+}
+
+// Distributed leases, acquire returns false while another holder's lease is live
+type leaseStore interface {
+	acquire(ctx context.Context, key, holder string, ttl time.Duration) (bool, error)
+	// Extends the holder's lease, fails once it was taken over
+	renew(ctx context.Context, key, holder string, ttl time.Duration) error
+	release(ctx context.Context, key, holder string) error
+}
+
+var (
+	recordLocks = newKeyedMutex()
+	leases      = newLeaseStore()
+	// Lease holder name of this instance
+	lockHolder = fmt.Sprintf("%v-%v-%v", hostname(), os.Getpid(), time.Now().UnixNano())
+)
+
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
+
+func newLeaseStore() leaseStore {
+	if bucket := os.Getenv("DNS_LOCK_BUCKET"); bucket != "" {
+		return &gcsLeases{Bucket: bucket}
+	}
+	return nil
+}
+
+// Lock key of a recordSet
+func recordKey(project, zone, dns_name string) string {
+	return project + "/" + zone + "/" + dns_name
+}
+
+// Locks the records in key order so concurrent events can't deadlock, unlock releases all of them
+func lockRecords(ctx context.Context, keys ...string) (unlock func(), err error) {
+	sort.Strings(keys)
+	var unlocks []func()
+	unlock = func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		unlocks = append(unlocks, recordLocks.lock(key))
+		if leases == nil {
+			continue
+		}
+
+		if err := acquireLease(ctx, key); err != nil {
+			unlock()
+			return nil, err
+		}
+		key := key
+		stop := renewLease(key)
+		unlocks = append(unlocks, func() {
+			stop()
+			if err := leases.release(context.Background(), key, lockHolder); err != nil {
+				fmt.Printf("Error releasing lease on %q: %v\n", key, err)
+			}
+		})
+	}
+	return unlock, nil
+}
+
+// Polls for the lease until lockTimeout
+func acquireLease(ctx context.Context, key string) error {
+	wait := newBackoff(200*time.Millisecond, 2*time.Second, lockTimeout)
+	wait.Jitter = 0.5
+	for {
+		acquired, err := leases.acquire(ctx, key, lockHolder, lockTTL)
+		if err != nil {
+			return fmt.Errorf("Error acquiring lease on %q: %v", key, err)
+		} else if acquired {
+			return nil
+		}
+		if debug != "" {
+			fmt.Printf("%q is locked, waiting\n", key)
+		}
+		if !wait.Wait(ctx) {
+			return fmt.Errorf("%q still locked after %v", key, lockTimeout)
+		}
+	}
+}
+
+// Renews the lease every third of lockTTL until stopped, critical sections can outlast the TTL,
+// ex: a change waiting on Cloud DNS
+func renewLease(key string) (stop func()) {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(lockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := leases.renew(context.Background(), key, lockHolder, lockTTL); err != nil {
+					fmt.Printf("Error renewing lease on %q: %v\n", key, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// Local stand-in for the lease backend
+type memoryLeases struct {
+	sync.Mutex
+	holders map[string]memoryLease
+}
+
+type memoryLease struct {
+	Holder  string
+	Expires time.Time
+}
+
+func newMemoryLeases() *memoryLeases {
+	return &memoryLeases{holders: make(map[string]memoryLease)}
+}
+
+func (m *memoryLeases) acquire(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	if lease, exists := m.holders[key]; exists && lease.Holder != holder && time.Now().Before(lease.Expires) {
+		return false, nil
+	}
+	m.holders[key] = memoryLease{Holder: holder, Expires: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (m *memoryLeases) renew(ctx context.Context, key, holder string, ttl time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	if lease := m.holders[key]; lease.Holder != holder {
+		return fmt.Errorf("lease taken over by %v", lease.Holder)
+	}
+	m.holders[key] = memoryLease{Holder: holder, Expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *memoryLeases) release(ctx context.Context, key, holder string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.holders[key].Holder == holder {
+		delete(m.holders, key)
+	}
+	return nil
+}
+
+// Leases as Cloud Storage objects, created only if absent (ifGenerationMatch=0).
+// Precondition calls aren't retried, a 412 means the lease is held.
+type gcsLeases struct {
+	Bucket string
+
+	once    sync.Once
+	service *storage.Service
+	err     error
+}
+
+func (g *gcsLeases) storage(ctx context.Context) (*storage.Service, error) {
+	g.once.Do(func() {
+		g.service, g.err = storage.NewService(context.Background())
+	})
+	return g.service, g.err
+}
+
+func leaseObject(key string) string {
+	return "dns-locks/" + strings.NewReplacer("/", "_").Replace(key)
+}
+
+func (g *gcsLeases) acquire(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	gcs, err := g.storage(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	object := &storage.Object{
+		Name:     leaseObject(key),
+		Metadata: map[string]string{"holder": holder, "expires": time.Now().Add(ttl).Format(time.RFC3339Nano)},
+	}
+	_, err = gcs.Objects.Insert(g.Bucket, object).IfGenerationMatch(0).Media(bytes.NewReader(nil)).Context(ctx).Do()
+	if err == nil {
+		return true, nil
+	} else if e, ok := err.(*googleapi.Error); !ok || e.Code != http.StatusPreconditionFailed {
+		return false, err
+	}
+
+	// Held, take it over once expired
+	current, err := gcs.Objects.Get(g.Bucket, object.Name).Context(ctx).Do()
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	expires, err := time.Parse(time.RFC3339Nano, current.Metadata["expires"])
+	if err == nil && time.Now().Before(expires) {
+		return false, nil
+	}
+	fmt.Printf("Lease on %q held by %v expired, taking over\n", key, current.Metadata["holder"])
+	// Not if it was renewed since
+	err = gcs.Objects.Delete(g.Bucket, object.Name).IfGenerationMatch(current.Generation).IfMetagenerationMatch(current.Metageneration).Context(ctx).Do()
+	if e, ok := err.(*googleapi.Error); ok && (e.Code == http.StatusPreconditionFailed || e.Code == http.StatusNotFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+// Updates the expiry in the object's metadata, unless it changed since read
+func (g *gcsLeases) renew(ctx context.Context, key, holder string, ttl time.Duration) error {
+	gcs, err := g.storage(ctx)
+	if err != nil {
+		return err
+	}
+	current, err := gcs.Objects.Get(g.Bucket, leaseObject(key)).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	if current.Metadata["holder"] != holder {
+		return fmt.Errorf("lease taken over by %v", current.Metadata["holder"])
+	}
+	update := &storage.Object{Metadata: map[string]string{"holder": holder, "expires": time.Now().Add(ttl).Format(time.RFC3339Nano)}}
+	_, err = gcs.Objects.Patch(g.Bucket, current.Name, update).IfGenerationMatch(current.Generation).IfMetagenerationMatch(current.Metageneration).Context(ctx).Do()
+	return err
+}
+
+func (g *gcsLeases) release(ctx context.Context, key, holder string) error {
+	gcs, err := g.storage(ctx)
+	if err != nil {
+		return err
+	}
+	current, err := gcs.Objects.Get(g.Bucket, leaseObject(key)).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	if current.Metadata["holder"] != holder {
+		return fmt.Errorf("lease taken over by %v", current.Metadata["holder"])
+	}
+	return gcs.Objects.Delete(g.Bucket, current.Name).IfGenerationMatch(current.Generation).Context(ctx).Do()
+}
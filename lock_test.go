@@ -0,0 +1,94 @@
+package gcedns
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentGroupMembers(t *testing.T) {
+	setupTestDns(t)
+	leases = newMemoryLeases()
+	defer func() { leases = newLeaseStore() }()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dnsInfo := DnsInfo{DnsHostName: "devserver-pool", Action: "create", IPs: []string{fmt.Sprintf("10.0.0.%v", i)}, VMName: fmt.Sprintf("vm-%v", i), VMProject: "prj-dev-4328"}
+			if result := groupManagement(context.Background(), dnsInfo); !result.ok() {
+				t.Errorf("FAILED: member %v got %v\n", i, result)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	record, _, _ := getRecordSet(context.Background(), "prj-c-dnshub", "default-zone", "devserver-pool.gcp.company.com.", "A")
+	if len(record.Rrdatas) != 20 {
+		t.Errorf("FAILED: got %v member IPs expected 20: %v\n", len(record.Rrdatas), record.Rrdatas)
+	}
+}
+
+func TestMemoryLeases(t *testing.T) {
+	store := newMemoryLeases()
+	ctx := context.Background()
+
+	if acquired, _ := store.acquire(ctx, "zone/a.", "holder-1", time.Minute); !acquired {
+		t.Errorf("FAILED: free lease not acquired\n")
+	}
+	if acquired, _ := store.acquire(ctx, "zone/a.", "holder-2", time.Minute); acquired {
+		t.Errorf("FAILED: live lease acquired by another holder\n")
+	}
+	store.release(ctx, "zone/a.", "holder-1")
+	if acquired, _ := store.acquire(ctx, "zone/a.", "holder-2", -time.Second); !acquired {
+		t.Errorf("FAILED: released lease not acquired\n")
+	}
+	// Expired leases are taken over
+	if acquired, _ := store.acquire(ctx, "zone/a.", "holder-3", time.Minute); !acquired {
+		t.Errorf("FAILED: expired lease not taken over\n")
+	}
+}
+
+func TestLeaseRenewedWhileHeld(t *testing.T) {
+	leases = newMemoryLeases()
+	defer func() { leases = newLeaseStore() }()
+	lockTTL = 60 * time.Millisecond
+	defer func() { lockTTL = envSeconds("DNS_LOCK_TTL", 60) }()
+
+	unlock, err := lockRecords(context.Background(), "prj/zone/a.")
+	if err != nil {
+		t.Fatalf("FAILED: %v\n", err)
+	}
+	// Held for several TTLs, ex: a slow change
+	time.Sleep(4 * lockTTL)
+	if acquired, _ := leases.acquire(context.Background(), "prj/zone/a.", "other-instance", time.Minute); acquired {
+		t.Errorf("FAILED: lease taken over while held\n")
+	}
+	unlock()
+	if acquired, _ := leases.acquire(context.Background(), "prj/zone/a.", "other-instance", time.Minute); !acquired {
+		t.Errorf("FAILED: lease not released\n")
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	leases = newMemoryLeases()
+	defer func() { leases = newLeaseStore() }()
+	lockTimeout = 300 * time.Millisecond
+	defer func() { lockTimeout = envSeconds("DNS_LOCK_TIMEOUT", 60) }()
+
+	// Lease held by another instance
+	leases.acquire(context.Background(), "prj/zone/a.", "other-instance", time.Minute)
+	if _, err := lockRecords(context.Background(), "prj/zone/a."); err == nil {
+		t.Errorf("FAILED: lock acquired while leased by another instance\n")
+	}
+	// The in-process lock was released on failure
+	unlock, err := lockRecords(context.Background(), "prj/zone/b.", "prj/zone/b.")
+	if err != nil {
+		t.Errorf("FAILED: %v\n", err)
+	} else {
+		unlock()
+	}
+}
@@ -16,7 +16,10 @@ import (
 // https://cloud.google.com/pubsub/docs/reference/rest/v1/PubsubMessage
 // https://cloud.google.com/functions/docs/calling/pubsub
 type PubSubMessage struct {
-	Data []byte `json:"data"`
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes"`
+	MessageID   string            `json:"messageId"`
+	PublishTime time.Time         `json:"publishTime"`
 }
 
 // Below struct represents gce_instance auditlog schema
@@ -66,13 +69,23 @@ type logMetadata struct {
 			DisplayDevice struct {
 				EnableDisplay bool `json:"enableDisplay"`
 			} `json:"displayDevice"`
+			Instances []struct {
+				Instance string `json:"instance"`
+			} `json:"instances"`
 			Labels []struct {
 				Key   string `json:"key"`
 				Value string `json:"value"`
 			} `json:"labels"`
-			MachineType       string `json:"machineType"`
+			MachineType string `json:"machineType"`
+			Metadata    struct {
+				Items []struct {
+					Key   string `json:"key"`
+					Value string `json:"value"`
+				} `json:"items"`
+			} `json:"metadata"`
 			Name              string `json:"name"`
 			NetworkInterfaces []struct {
+				NetworkIP  string `json:"networkIP"`
 				Subnetwork string `json:"subnetwork"`
 			} `json:"networkInterfaces"`
 			ReservationAffinity struct {
@@ -130,9 +143,11 @@ type logMetadata struct {
 	ReceiveTimestamp time.Time `json:"receiveTimestamp"`
 	Resource         struct {
 		Labels struct {
-			InstanceID string `json:"instance_id"`
-			ProjectID  string `json:"project_id"`
-			Zone       string `json:"zone"`
+			InstanceID        string `json:"instance_id"`
+			InstanceGroupName string `json:"instance_group_name"`
+			Location          string `json:"location"`
+			ProjectID         string `json:"project_id"`
+			Zone              string `json:"zone"`
 		} `json:"labels"`
 		Type string `json:"type"`
 	} `json:"resource"`
@@ -186,17 +201,63 @@ func checkErr(msg string, err error) {
 // }
 
 func PubSubMsgReader(ctx context.Context, m PubSubMessage) error {
-	var mutex sync.Mutex
-	mutex.Lock()
-	defer mutex.Unlock()
+	_, err := readMessage(ctx, m)
+	// Service mode exports in the background
+	if batcher == nil {
+		flushSpans(ctx)
+	}
+	return err
+}
+
+// Processes the message, deadLettered is set when it went to the dead-letter sink instead
+func readMessage(ctx context.Context, m PubSubMessage) (deadLettered bool, err error) {
+	m = messageEnvelope(ctx, m)
+	// One trace per event, continuing the publisher's trace when the message carries one
+	ctx, span := startSpan(contextWithMessageTrace(ctx, m.Attributes), "gcedns.event", "message_id", m.MessageID)
+	defer func() { span.end(err) }()
 
 	logMessage := logMetadata{}
 	json.Unmarshal(m.Data, &logMessage)
+	span.set("resource_name", logMessage.ProtoPayload.ResourceName)
+
+	if age := messageAge(m, logMessage); maxMessageAge > 0 && age > maxMessageAge {
+		reason := fmt.Sprintf("message is %v old, max age is %v", age.Round(time.Second), maxMessageAge)
+		if !publishDeadLetter(ctx, m, reason, errorExpired, 0) {
+			return false, errors.New("error publishing dead letter")
+		}
+		return true, nil
+	}
+
+	// Redelivered entries are acknowledged with their first outcome
+	key := eventKey(logMessage, m.MessageID)
+	if key != "" && events != nil {
+		unlock := recordLocks.lock("event/" + key)
+		defer unlock()
+		if outcome, seen, err := events.get(ctx, key); err != nil {
+			fmt.Printf("Error reading the dedup store for %v: %v\n", key, err)
+		} else if seen {
+			fmt.Printf("Message %v: event %v already processed, skipped: %v\n", m.MessageID, key, outcome)
+			return false, nil
+		}
+	}
 
 	result, err := gceEventCheckOperation(m.Data, ctx)
-	fmt.Println(result)
+	fmt.Printf("Message %v: %v\n", m.MessageID, result)
 
-	return err
+	if err == nil && key != "" && events != nil {
+		if err := events.put(ctx, key, result); err != nil {
+			fmt.Printf("Error recording event %v: %v\n", key, err)
+		}
+	}
+
+	// Permanent failures and events out of attempts go to the dead-letter sink
+	if err != nil {
+		class, attempts := errorClass(err), eventAttempt(ctx, key)
+		if (class == errorPermanent || attempts >= maxEventAttempts) && publishDeadLetter(ctx, m, fmt.Sprintf("%v: %v", err, result), class, attempts) {
+			return true, nil
+		}
+	}
+	return false, err
 }
 
 // contains all VM/DNS info required to create the DNS record
@@ -211,39 +272,195 @@ type DnsInfo struct {
 	VMProject          string
 	PTRZoneHostProject string
 	PTRZoneName        string
+	// A records (default) or a CNAME to the VM's zonal internal DNS name
+	RecordMode string
+	VMZone     string
+	// Group records with a Cloud DNS routing policy
+	RoutingPolicy string
+	Region        string
+	Weight        float64
+}
+
+// Record request for a VM based on its labels
+func vmDnsInfo(vm_info VMInfo, action string) DnsInfo {
+	return DnsInfo{
+		DnsHostName:        vm_info.Labels["dns_host_name"],
+		DnsZoneName:        vm_info.Labels["dns_zone_name"],
+		DnsZoneHostProject: vm_info.Labels["dns_zone_host_project"],
+		DnsDomain:          vm_info.Labels["dns_domain"],
+		Action:             action,
+		IPs:                vm_info.IPs,
+		VMName:             vm_info.Name,
+		VMProject:          vm_info.VMProject,
+		RecordMode:         vmRecordMode(vm_info),
+		VMZone:             vm_info.Zone,
+	}
+}
+
+// create for granted instance inserts, delete for granted instance deletes
+func eventAction(logMessage logMetadata) string {
+	for _, task := range logMessage.ProtoPayload.AuthorizationInfo {
+		if task.Granted && task.Permission == "compute.instances.create" {
+			return "create"
+		} else if task.Granted && task.Permission == "compute.instances.delete" {
+			return "delete"
+		}
+	}
+	return ""
+}
+
+// VM name, labels and metadata from an insert audit log request, IPs are not known yet
+func eventVMInfo(logMessage logMetadata) (event_vm VMInfo, isInsert bool) {
+	request := logMessage.ProtoPayload.Request
+	if request.Name == "" || eventAction(logMessage) != "create" {
+		return VMInfo{}, false
+	}
+
+	labels := make(map[string]string)
+	for _, label := range request.Labels {
+		labels[label.Key] = label.Value
+	}
+	metadata := make(map[string]string)
+	for _, item := range request.Metadata.Items {
+		metadata[item.Key] = item.Value
+	}
+
+	return VMInfo{
+		Labels:     labels,
+		Metadata:   metadata,
+		Name:       request.Name,
+		VMProject:  logMessage.Resource.Labels.ProjectID,
+		Zone:       logMessage.Resource.Labels.Zone,
+		InstanceID: logMessage.Resource.Labels.InstanceID,
+	}, true
+}
+
+// Skip and deny decisions for an insert event, decided is false when the event needs the VM's IPs
+func eventDecision(ctx context.Context, logMessage logMetadata, event_vm VMInfo) (result string, decided bool) {
+	if event_vm.Labels["dns_skip_record"] != "" {
+		if default_mode {
+			return "", false
+		}
+		writeEventStatus(ctx, logMessage, event_vm, dnsResult{Status: dnsSkipped, Reason: "dns_skip_record is set"})
+		return fmt.Sprintf("dns_skip_record is set for %v\n", logMessage.ProtoPayload.ResourceName), true
+	}
+
+	// Group records and public PTRs are decided on their own
+	if vmGroupName(event_vm) != "" || event_vm.Labels["dns_public_ptr"] == "true" {
+		return "", false
+	}
+
+	dnsCreateInfo := vmDnsInfo(event_vm, "create")
+	if dnsRes, authorized := authorizeDnsInfo(ctx, dnsCreateInfo, resolveDnsTarget(dnsCreateInfo)); !authorized {
+		reportResult(ctx, dnsRes)
+		writeEventStatus(ctx, logMessage, event_vm, dnsRes)
+		return fmt.Sprintf("%v's DNS record is not created: %v\n", logMessage.ProtoPayload.ResourceName, dnsRes), true
+	}
+	return "", false
+}
+
+// Fast path decisions are made before the VM exists, the status is written once the insert is DONE,
+// off the decision path: the wait and write are queued and the event returns right away
+func writeEventStatus(ctx context.Context, logMessage logMetadata, event_vm VMInfo, dnsRes dnsResult) {
+	if writeBack == "" || replaying {
+		return
+	}
+	statusWrites.Add(1)
+	go func() {
+		defer statusWrites.Done()
+		// Outlives the event's context
+		ctx, cancel := context.WithTimeout(context.Background(), operationTimeout+time.Minute)
+		defer cancel()
+		writeOperationStatus(ctx, logMessage, event_vm, dnsRes)
+	}()
+}
+
+// Status writes queued by writeEventStatus
+var statusWrites sync.WaitGroup
+
+var writeOperationStatus = func(ctx context.Context, logMessage logMetadata, event_vm VMInfo, dnsRes dnsResult) {
+	if err := waitForOperation(ctx, event_vm.VMProject, event_vm.Zone, logMessage.Operation.ID); err != nil {
+		fmt.Printf("DNS status not written to %q: %v\n", event_vm.Name, err)
+		return
+	}
+	writeDnsStatus(ctx, event_vm, dnsRes)
 }
 
 // GCE VM create/delete event processing
 func gceEventCheckOperation(data []byte, ctx context.Context) (result string, err error) {
-	var mutex sync.Mutex
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	if len(data) == 0 {
-		return "gceEventCheckOperation received no data", errors.New("error parsing pubsub message")
+		return "gceEventCheckOperation received no data", errNoData
 	}
 
+	_, span := startSpan(ctx, "parse")
 	logMessage := logMetadata{}
-	json.Unmarshal(data, &logMessage)
+	span.end(json.Unmarshal(data, &logMessage))
+	ctx = withAuditEvent(ctx, logMessage)
 
 	if debug != "" {
 		fmt.Printf("gceEventCheckOperation received data: %v\n", string(data))
 	}
 
+	eventsTotal.inc(eventType(logMessage))
+
+	// Unmanaged instance group membership changes only update the group record
+	if logMessage.ProtoPayload.Request.Type == addInstancesType || logMessage.ProtoPayload.Request.Type == removeInstancesType {
+		return gceGroupEventOperation(logMessage, ctx)
+	}
+
+	// Out of order events, ex: a create retried after the VM's delete was applied
+	event := eventState{
+		Timestamp:  logMessage.Timestamp,
+		Action:     eventAction(logMessage),
+		InstanceID: logMessage.Resource.Labels.InstanceID,
+		VMProject:  logMessage.Resource.Labels.ProjectID,
+	}
+	instanceKey := ""
+	if event.InstanceID != "" {
+		instanceKey = instanceStateKey(event.InstanceID)
+	}
+	if reason := staleEvent(ctx, event, instanceKey, ""); reason != "" {
+		fmt.Printf("%v %v event is stale, dropped: %v\n", logMessage.ProtoPayload.ResourceName, event.Action, reason)
+		return fmt.Sprintf("%v %v event is stale, dropped: %v\n", logMessage.ProtoPayload.ResourceName, event.Action, reason), nil
+	}
+
+	// Fast path: insert audit logs carry the VM name and labels, skip and deny decisions are
+	// made straight from the event without any Compute API call. Only the IP lookup is deferred.
+	if event_vm, isInsert := eventVMInfo(logMessage); isInsert {
+		if result, decided := eventDecision(ctx, logMessage, event_vm); decided {
+			return result, nil
+		}
+	}
+
+	// The log sink picks up operation.first, inserts are looked up once their operation is DONE.
+	// Deletes are looked up right away, while the VM still exists. Replayed inserts are long done.
+	if eventAction(logMessage) == "create" && logMessage.Operation.ID != "" && !replaying {
+		if err := waitForOperation(ctx, logMessage.Resource.Labels.ProjectID, logMessage.Resource.Labels.Zone, logMessage.Operation.ID); err != nil {
+			if _, failed := err.(*operationError); failed {
+				fmt.Printf("%v insert failed, skipped: %v\n", logMessage.ProtoPayload.ResourceName, err)
+				return fmt.Sprintf("%v insert failed, skipped: %v\n", logMessage.ProtoPayload.ResourceName, err), nil
+			}
+			return "Insert operation not done.", err
+		}
+	}
+
 	// Variables used in downstream code
-	vm_info, receivedVMData := getGCEMetadata(data, ctx)
+	var (
+		vm_info        VMInfo
+		receivedVMData bool
+	)
+	if replaying {
+		// Offline, the VM may be long gone
+		vm_info, receivedVMData = replayVMInfo(logMessage)
+	} else {
+		vm_info, receivedVMData = getGCEMetadata(data, ctx)
+	}
 
 	if debug != "" {
 		fmt.Printf("vm_info: %v\n", vm_info)
 		fmt.Printf("IP in request: %v, count: %d\n", vm_info.IPs, len(vm_info.IPs))
 	}
 
-	// retry in case of delay in nic0 assigment
-	if len(vm_info.IPs) == 0 {
-		time.Sleep(5 * time.Second) //consider adding an exponential backoff or check if assetAPI is more reliable.
-		vm_info, receivedVMData = getGCEMetadata(data, ctx)
-	}
-
 	if !receivedVMData {
 		log.Println("No VM info received. " + logMessage.ProtoPayload.ResourceName)
 		return "No VM info received.", fmt.Errorf("no vm info received: %v", logMessage.ProtoPayload.ResourceName)
@@ -252,6 +469,7 @@ func gceEventCheckOperation(data []byte, ctx context.Context) (result string, er
 	labels := vm_info.Labels
 	ips := vm_info.IPs
 	vm_name := vm_info.Name
+	event.VMName = vm_name
 
 	if debug != "" {
 		fmt.Printf("VM_Labels: %v,\t VM_Name: %q,\t  VM_IPs: %v\n", labels, vm_name, ips)
@@ -265,29 +483,54 @@ func gceEventCheckOperation(data []byte, ctx context.Context) (result string, er
 	}
 
 	for _, task := range logMessage.ProtoPayload.AuthorizationInfo {
-		if task.Granted && task.Permission == "compute.instances.create" || logMessage.ProtoPayload.Request.Type == "type.googleapis.com/compute.instanceGroups.addInstances" {
+		if task.Granted && task.Permission == "compute.instances.create" {
 			if labels["dns_skip_record"] == "" {
-				dnsCreateInfo := DnsInfo{
-					DnsHostName:        labels["dns_host_name"],
-					DnsZoneName:        labels["dns_zone_name"],
-					DnsZoneHostProject: labels["dns_zone_host_project"],
-					DnsDomain:          labels["dns_domain"],
-					Action:             "create",
-					IPs:                ips,
-					VMName:             vm_name,
-					VMProject:          vm_info.VMProject,
+				dnsCreateInfo := vmDnsInfo(vm_info, "create")
+				nameKey := nameStateKey(resolveDnsTarget(dnsCreateInfo).fqdn())
+				if reason := staleEvent(ctx, event, "", nameKey); reason != "" {
+					result = fmt.Sprintf("%v create event is stale, dropped: %v\n", logMessage.ProtoPayload.ResourceName, reason)
+					continue
 				}
-				var dns_record string
 
-				if dnsManagement(dnsCreateInfo) {
-					if dnsCreateInfo.DnsHostName == "" {
-						dns_record = dnsCreateInfo.VMName
-					} else {
-						dns_record = dnsCreateInfo.DnsHostName
-					}
-					result = fmt.Sprintf("%v's DNS record: %v is created with IP: %v\n", logMessage.ProtoPayload.ResourceName, dns_record, ips)
+				// Readiness gating, records are only published once the workload is up
+				readiness, ready := "", true
+				if check, gated := vmReadinessCheck(vm_info); gated && !replaying {
+					readiness, ready = waitForReadiness(ctx, vm_info, check)
+				}
+
+				var dnsRes dnsResult
+				if ready {
+					dnsRes = dnsManagement(ctx, dnsCreateInfo)
+					dnsRes.Readiness = readiness
+				} else {
+					dnsRes = notReadyResult(resolveDnsTarget(dnsCreateInfo).fqdn(), readiness)
+				}
+				err = firstFailure(err, dnsRes)
+
+				if dnsRes.ok() {
+					recordEventState(ctx, event, instanceKey, nameKey, nameStateKey(dnsRes.FQDN))
+					observePublication(logMessage, dnsRes)
+					result = fmt.Sprintf("%v's DNS record: %v with IP: %v\n", logMessage.ProtoPayload.ResourceName, dnsRes, ips)
 				} else {
-					result = fmt.Sprintf("%v's DNS record: %v is not created\n", logMessage.ProtoPayload.ResourceName, dns_record)
+					result = fmt.Sprintf("%v's DNS record is not created: %v\n", logMessage.ProtoPayload.ResourceName, dnsRes)
+				}
+				writeDnsStatus(ctx, vm_info, dnsRes)
+
+				if group := vmGroupName(vm_info); group != "" && ready {
+					groupRes := groupManagement(ctx, groupDnsInfo(vm_info, group, "create"))
+					err = firstFailure(err, groupRes)
+					if groupRes.ok() {
+						group_event := event
+						group_event.Group = group
+						recordEventState(ctx, group_event, instanceKey)
+					}
+					result += fmt.Sprintf("%v's group record: %v\n", logMessage.ProtoPayload.ResourceName, groupRes)
+				}
+				if ready {
+					if ptrRes := publicPTRManagement(ctx, vm_info, "create"); ptrRes.Status != dnsSkipped {
+						err = firstFailure(err, ptrRes)
+						result += fmt.Sprintf("%v's public PTR: %v\n", logMessage.ProtoPayload.ResourceName, ptrRes)
+					}
 				}
 			} else if default_mode { // Default mode ignores VM labels and forces to use the default Zone/Domain values set by the DNS/Admin team.
 				dnsCreateInfo := DnsInfo{
@@ -300,41 +543,71 @@ func gceEventCheckOperation(data []byte, ctx context.Context) (result string, er
 					VMName:             vm_name,
 					VMProject:          vm_info.VMProject,
 				}
+				nameKey := nameStateKey(resolveDnsTarget(dnsCreateInfo).fqdn())
+				if reason := staleEvent(ctx, event, "", nameKey); reason != "" {
+					result = fmt.Sprintf("%v create event is stale, dropped: %v\n", logMessage.ProtoPayload.ResourceName, reason)
+					continue
+				}
 				// Default mode creates DNS records based on VM names
-				if dnsManagement(dnsCreateInfo) {
-					result = fmt.Sprintf("%v's DNS record: %v is created with IP: %v\n", logMessage.ProtoPayload.ResourceName, dnsCreateInfo.VMName, ips)
+				dnsRes := dnsManagement(ctx, dnsCreateInfo)
+				err = firstFailure(err, dnsRes)
+				if dnsRes.ok() {
+					recordEventState(ctx, event, instanceKey, nameKey, nameStateKey(dnsRes.FQDN))
+					observePublication(logMessage, dnsRes)
+					result = fmt.Sprintf("%v's DNS record: %v with IP: %v\n", logMessage.ProtoPayload.ResourceName, dnsRes, ips)
 				} else {
-					result = fmt.Sprintf("%v's DNS record: %v is not created\n", logMessage.ProtoPayload.ResourceName, dnsCreateInfo.VMName)
+					result = fmt.Sprintf("%v's DNS record is not created: %v\n", logMessage.ProtoPayload.ResourceName, dnsRes)
 				}
+				writeDnsStatus(ctx, vm_info, dnsRes)
 			} else {
 				result = fmt.Sprintf("dns_skip_record is set for %v\n", logMessage.ProtoPayload.ResourceName)
+				writeDnsStatus(ctx, vm_info, dnsResult{Status: dnsSkipped, Reason: "dns_skip_record is set"})
 			}
-		} else if task.Granted && task.Permission == "compute.instances.delete" || logMessage.ProtoPayload.Request.Type == "type.googleapis.com/compute.instanceGroups.removeInstances" {
+		} else if task.Granted && task.Permission == "compute.instances.delete" {
 			if labels["dns_skip_record"] == "" {
-				dnsDeleteInfo := DnsInfo{
-					DnsHostName:        labels["dns_host_name"],
-					DnsZoneName:        labels["dns_zone_name"],
-					DnsZoneHostProject: labels["dns_zone_host_project"],
-					DnsDomain:          labels["dns_domain"],
-					Action:             "delete",
-					IPs:                ips,
-					VMName:             vm_name,
-					VMProject:          vm_info.VMProject,
-				}
-				var dns_record string
-				if dnsDeleteInfo.DnsHostName == "" {
-					dns_record = dnsDeleteInfo.VMName
-				} else {
-					dns_record = dnsDeleteInfo.DnsHostName
+				// MIG members are found by their created-by metadata, which a VM on its way out may no
+				// longer have, the group recorded on create is used then
+				group := vmGroupName(vm_info)
+				if last, seen := loadEventState(ctx, instanceKey); seen && group == "" {
+					group = last.Group
 				}
 
-				if dnsManagement(dnsDeleteInfo) {
-					result = fmt.Sprintf("%qs DNS record: %q is deleted for IP: %v\n", logMessage.ProtoPayload.ResourceName, dns_record, ips)
+				dnsDeleteInfo := vmDnsInfo(vm_info, "delete")
+				nameKey := nameStateKey(resolveDnsTarget(dnsDeleteInfo).fqdn())
+				if reason := staleEvent(ctx, event, "", nameKey); reason != "" {
+					result = fmt.Sprintf("%qs delete event is stale, dropped: %v\n", logMessage.ProtoPayload.ResourceName, reason)
+					continue
+				}
+				dnsRes := dnsManagement(ctx, dnsDeleteInfo)
+				err = firstFailure(err, dnsRes)
+				if dnsRes.ok() {
+					recordEventState(ctx, event, instanceKey, nameKey, nameStateKey(dnsRes.FQDN))
+					observePublication(logMessage, dnsRes)
+					result = fmt.Sprintf("%qs DNS record: %v for IP: %v\n", logMessage.ProtoPayload.ResourceName, dnsRes, ips)
 				} else {
-					result = fmt.Sprintf("%qs DNS record: %q is not deleted\n", logMessage.ProtoPayload.ResourceName, dns_record)
+					result = fmt.Sprintf("%qs DNS record is not deleted: %v\n", logMessage.ProtoPayload.ResourceName, dnsRes)
+				}
+				if group != "" {
+					groupRes := groupManagement(ctx, groupDnsInfo(vm_info, group, "delete"))
+					err = firstFailure(err, groupRes)
+					result += fmt.Sprintf("%qs group record: %v\n", logMessage.ProtoPayload.ResourceName, groupRes)
+				}
+				if ptrRes := publicPTRManagement(ctx, vm_info, "delete"); ptrRes.Status != dnsSkipped {
+					err = firstFailure(err, ptrRes)
+					result += fmt.Sprintf("%qs public PTR: %v\n", logMessage.ProtoPayload.ResourceName, ptrRes)
 				}
 			}
 		}
 	}
-	return result, nil
+	return result, err
+}
+
+// Keeps the first failure of the event's results, the event is retried or dead-lettered
+func firstFailure(err error, results ...dnsResult) error {
+	for _, result := range results {
+		if err == nil {
+			err = result.failure()
+		}
+	}
+	return err
 }
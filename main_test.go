@@ -2,8 +2,12 @@ package gcedns
 
 import (
 	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 type CheckOperationTestData struct {
@@ -17,7 +21,7 @@ func TestCheckOperation(t *testing.T) {
 	test_data := []CheckOperationTestData{
 		{
 			logSnippet:     []byte(""),
-			expectedResult: "checkOperation received null data",
+			expectedResult: "gceEventCheckOperation received no data",
 			testcaseStatus: true,
 		},
 		{
@@ -28,7 +32,7 @@ func TestCheckOperation(t *testing.T) {
 	}
 
 	for _, data := range test_data {
-		result := checkOperation(data.logSnippet, context.Background())
+		result, _ := gceEventCheckOperation(data.logSnippet, context.Background())
 
 		if data.testcaseStatus {
 			if !strings.Contains(result, data.expectedResult) {
@@ -45,3 +49,100 @@ func TestCheckOperation(t *testing.T) {
 		}
 	}
 }
+
+func insertAuditLog(labels string) []byte {
+	return []byte(`{
+		"insertId": "-abc123",
+		"operation": {"first": true, "id": "operation-1627-abc", "producer": "compute.googleapis.com"},
+		"protoPayload": {
+			"authorizationInfo": [{"granted": true, "permission": "compute.instances.create"}],
+			"methodName": "v1.compute.instances.insert",
+			"request": {
+				"@type": "type.googleapis.com/compute.instances.insert",
+				"name": "dev-vm-01",
+				"labels": ` + labels + `
+			},
+			"resourceName": "projects/prj-dev-4328/zones/us-central1-a/instances/dev-vm-01"
+		},
+		"resource": {"labels": {"instance_id": "123", "project_id": "prj-dev-4328", "zone": "us-central1-a"}, "type": "gce_instance"}
+	}`)
+}
+
+func TestEventFastPath(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dns_allow_list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	restoreDnsGlobals(t)
+
+	dnsAllowListFile = filepath.Join(dir, "dns_allow_list.yaml")
+	if err := ioutil.WriteFile(dnsAllowListFile, []byte(`prj-dev-4328: "^(devserver|qa).*$"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defaultDnsDomain = "gcp.company.com."
+
+	test_data := []CheckOperationTestData{
+		{
+			logSnippet:     insertAuditLog(`[{"key": "dns_skip_record", "value": "true"}]`),
+			expectedResult: "dns_skip_record is set",
+		},
+		{
+			logSnippet:     insertAuditLog(`[{"key": "dns_host_name", "value": "prod01"}]`),
+			expectedResult: "prod01.gcp.company.com. denied: not in the allow list for prj-dev-4328",
+		},
+	}
+
+	for _, data := range test_data {
+		start := time.Now()
+		result, err := gceEventCheckOperation(data.logSnippet, context.Background())
+		if err != nil || !strings.Contains(result, data.expectedResult) {
+			t.Errorf("FAILED: got %v, %v expected %v\n", result, err, data.expectedResult)
+		}
+		// Decided without waiting for the VM
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("FAILED: fast path decision took %v\n", elapsed)
+		}
+	}
+}
+
+func TestFastPathStatusWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns_allow_list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	restoreDnsGlobals(t)
+
+	dnsAllowListFile = filepath.Join(dir, "dns_allow_list.yaml")
+	if err := ioutil.WriteFile(dnsAllowListFile, []byte(`prj-dev-4328: "^(devserver|qa).*$"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defaultDnsDomain = "gcp.company.com."
+
+	// The insert operation isn't DONE until released
+	done := make(chan struct{})
+	written := make(chan string, 1)
+	writeBack = "true"
+	defer func(write func(context.Context, logMetadata, VMInfo, dnsResult)) {
+		writeBack, writeOperationStatus = "", write
+	}(writeOperationStatus)
+	writeOperationStatus = func(ctx context.Context, logMessage logMetadata, event_vm VMInfo, dnsRes dnsResult) {
+		<-done
+		written <- dnsRes.Status
+	}
+
+	start := time.Now()
+	if _, err := gceEventCheckOperation(insertAuditLog(`[{"key": "dns_host_name", "value": "prod01"}]`), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("FAILED: fast path decision waited %v for the status write\n", elapsed)
+	}
+	close(done)
+	statusWrites.Wait()
+	if status := <-written; status != dnsDenied {
+		t.Errorf("FAILED: wrote %v expected %v\n", status, dnsDenied)
+	}
+}
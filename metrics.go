@@ -0,0 +1,276 @@
+package gcedns
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+/* Metrics
+Counters and histograms of the event processing, exported in the Prometheus text format on
+DNS_METRICS_ADDR (ex: ":9090", path /metrics) in service mode. An OpenTelemetry Collector
+can scrape it with its prometheus receiver and forward over OTLP.
+*/
+
+var metricsAddr = os.Getenv("DNS_METRICS_ADDR")
+
+var (
+	registry []metric
+
+	eventsTotal      = newCounter("gcedns_events_total", "Audit log events processed, by type.", "type")
+	recordsTotal     = newCounter("gcedns_records_total", "Recordsets changed, by action (created, patched, deleted) and record type.", "action", "type")
+	denialsTotal     = newCounter("gcedns_denials_total", "Policy denials, by reason.", "reason")
+	apiErrorsTotal   = newCounter("gcedns_api_errors_total", "Failed Google API calls, by method and HTTP code, retried attempts included.", "method", "code")
+	apiRetries       = newCounter("gcedns_api_retries_total", "Retried Google API calls, by method.", "method")
+	deadLettersTotal = newCounter("gcedns_dead_letters_total", "Dead-lettered events, by error class.", "error_class")
+	eventLatency     = newHistogram("gcedns_event_latency_seconds", "Audit log timestamp to record publication, by action.",
+		[]float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300, 600}, "action")
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// Series are keyed on their label values
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names []string, key string, extra ...string) string {
+	var values []string
+	if len(names) > 0 {
+		values = strings.Split(key, "\xff")
+	}
+	var pairs []string
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, name, escape.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type counter struct {
+	name   string
+	help   string
+	labels []string
+
+	sync.Mutex
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	c := &counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	registry = append(registry, c)
+	return c
+}
+
+func (c *counter) inc(values ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[seriesKey(values)]++
+}
+
+func (c *counter) value(values ...string) float64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.values[seriesKey(values)]
+}
+
+func (c *counter) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%v%v %v\n", c.name, formatLabels(c.labels, key), c.values[key])
+	}
+}
+
+type histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	// Per bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	h := &histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	registry = append(registry, h)
+	return h
+}
+
+func (h *histogram) observe(value float64, values ...string) {
+	h.Lock()
+	defer h.Unlock()
+	key := seriesKey(values)
+	series, found := h.series[key]
+	if !found {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := h.series[key]
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, formatLabels(h.labels, key, "le", strconv.FormatFloat(bound, 'g', -1, 64)), cumulative)
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.name, formatLabels(h.labels, key), series.sum)
+		fmt.Fprintf(w, "%v_count%v %v\n", h.name, formatLabels(h.labels, key), series.count)
+	}
+}
+
+// Prometheus text exposition of all metrics
+func writeMetrics(w io.Writer) {
+	for _, m := range registry {
+		m.write(w)
+	}
+}
+
+// Serves /metrics until ctx is done
+func serveMetrics(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	fmt.Printf("Serving metrics on %v/metrics\n", listener.Addr())
+	go server.Serve(listener)
+	return nil
+}
+
+// create, delete, add_instances or remove_instances
+func eventType(logMessage logMetadata) string {
+	switch logMessage.ProtoPayload.Request.Type {
+	case addInstancesType:
+		return "add_instances"
+	case removeInstancesType:
+		return "remove_instances"
+	}
+	if action := eventAction(logMessage); action != "" {
+		return action
+	}
+	return "unknown"
+}
+
+// HTTP code of a failed call, or the kind of failure
+func errorCode(err error) string {
+	switch e := err.(type) {
+	case *googleapi.Error:
+		return strconv.Itoa(e.Code)
+	case net.Error:
+		if e.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return "canceled"
+	}
+	return "error"
+}
+
+// Reason code of the denial, the detailed reasons carry names and IPs
+func observeResult(result dnsResult) {
+	if result.Status == dnsDenied {
+		code := result.Code
+		if code == "" {
+			code = "other"
+		}
+		denialsTotal.inc(code)
+	}
+}
+
+// A recordSet both deleted and added in a change is patched
+func observeChange(change rrChange) {
+	deleted := make(map[string]bool)
+	for _, record := range change.Deletions {
+		deleted[record.Name+" "+record.Type] = true
+	}
+	added := make(map[string]bool)
+	for _, record := range change.Additions {
+		added[record.Name+" "+record.Type] = true
+		if deleted[record.Name+" "+record.Type] {
+			recordsTotal.inc("patched", record.Type)
+		} else {
+			recordsTotal.inc("created", record.Type)
+		}
+	}
+	for _, record := range change.Deletions {
+		if !added[record.Name+" "+record.Type] {
+			recordsTotal.inc("deleted", record.Type)
+		}
+	}
+}
+
+// End to end latency of a published record, replayed events would skew it
+func observePublication(logMessage logMetadata, result dnsResult) {
+	if logMessage.Timestamp.IsZero() || replaying {
+		return
+	}
+	switch result.Status {
+	case dnsCreated, dnsUpdated, dnsDeleted:
+		latency := time.Since(logMessage.Timestamp).Seconds()
+		eventLatency.observe(math.Max(latency, 0), eventAction(logMessage))
+	}
+}
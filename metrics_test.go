@@ -0,0 +1,95 @@
+package gcedns
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestRecordMetrics(t *testing.T) {
+	setupTestDns(t)
+	created, deleted := recordsTotal.value("created", "A"), recordsTotal.value("deleted", "PTR")
+	denied := denialsTotal.value("allow_list")
+
+	dnsInfo := DnsInfo{DnsHostName: "devserver01", Action: "create", IPs: []string{"10.0.0.5"}, VMName: "vm-01", VMProject: "prj-dev-4328"}
+	dnsManagement(context.Background(), dnsInfo)
+	dnsInfo.Action = "delete"
+	dnsManagement(context.Background(), dnsInfo)
+	dnsManagement(context.Background(), DnsInfo{DnsHostName: "prod01", Action: "create", IPs: []string{"10.0.0.6"}, VMName: "vm-02", VMProject: "prj-dev-4328"})
+
+	if got := recordsTotal.value("created", "A") - created; got != 1 {
+		t.Errorf("FAILED: got %v created A records expected 1\n", got)
+	}
+	if got := recordsTotal.value("deleted", "PTR") - deleted; got != 1 {
+		t.Errorf("FAILED: got %v deleted PTR records expected 1\n", got)
+	}
+	if got := denialsTotal.value("allow_list") - denied; got != 1 {
+		t.Errorf("FAILED: got %v allow list denials expected 1\n", got)
+	}
+}
+
+func TestObserveChange(t *testing.T) {
+	patched := recordsTotal.value("patched", "A")
+	observeChange(rrChange{
+		Deletions: []rrset{{Name: "qa01.gcp.company.com.", Type: "A", Rrdatas: []string{"10.0.0.5"}}},
+		Additions: []rrset{{Name: "qa01.gcp.company.com.", Type: "A", Rrdatas: []string{"10.0.0.5", "10.0.0.6"}}},
+	})
+	if got := recordsTotal.value("patched", "A") - patched; got != 1 {
+		t.Errorf("FAILED: got %v patched A records expected 1\n", got)
+	}
+}
+
+func TestPrometheusFormat(t *testing.T) {
+	c := &counter{name: "test_total", help: "Test.", labels: []string{"method"}, values: map[string]float64{}}
+	c.inc(`dns."changes"`)
+	h := &histogram{name: "test_seconds", help: "Test.", buckets: []float64{1, 5}, series: map[string]*histogramSeries{}}
+	h.observe(0.5)
+	h.observe(3)
+	h.observe(10)
+
+	var out bytes.Buffer
+	c.write(&out)
+	h.write(&out)
+	for _, line := range []string{
+		"# TYPE test_total counter",
+		`test_total{method="dns.\"changes\""} 1`,
+		`test_seconds_bucket{le="1"} 1`,
+		`test_seconds_bucket{le="5"} 2`,
+		`test_seconds_bucket{le="+Inf"} 3`,
+		"test_seconds_sum 13.5",
+		"test_seconds_count 3",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("FAILED: %q missing from\n%v\n", line, out.String())
+		}
+	}
+
+}
+
+func TestDenialCodes(t *testing.T) {
+	setupTestDns(t)
+	if err := ioutil.WriteFile(dnsPolicyFile, []byte("conflicts:\n  default: reject\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	dnsManagement(ctx, DnsInfo{DnsHostName: "devserver01", Action: "create", IPs: []string{"10.0.0.5"}, VMName: "vm-01", VMProject: "prj-dev-4328"})
+
+	test_data := []struct {
+		dnsInfo DnsInfo
+		code    string
+	}{
+		{DnsInfo{DnsHostName: "prod01", Action: "create", IPs: []string{"10.0.0.6"}, VMName: "vm-02", VMProject: "prj-dev-4328"}, denyAllowList},
+		{DnsInfo{DnsHostName: "devserver01", Action: "create", IPs: []string{"10.0.0.7"}, VMName: "vm-03", VMProject: "prj-dev-4328"}, denyConflict},
+	}
+	for _, data := range test_data {
+		denied := denialsTotal.value(data.code)
+		if result := dnsManagement(ctx, data.dnsInfo); result.Status != dnsDenied || result.Code != data.code {
+			t.Errorf("FAILED: %v got %v %v expected %v\n", data.dnsInfo.DnsHostName, result.Status, result.Code, data.code)
+		}
+		if got := denialsTotal.value(data.code) - denied; got != 1 {
+			t.Errorf("FAILED: got %v %v denials expected 1\n", got, data.code)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package gcedns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+/* Notifications
+Denied and failed records are posted to the webhooks of the notifications section of
+dns_policy.yaml, so the engineer creating the VM finds out. Every route matching the VM
+project and outcome is notified, within its rate limit.
+*/
+
+// Webhook route of the DNS policy
+type notificationRoute struct {
+	URL string `yaml:"url"`
+	// json (default), slack or chat
+	Format string `yaml:"format"`
+	// VM projects, all when empty
+	Projects []string `yaml:"projects"`
+	// denied, failed or both when empty
+	Outcomes []string `yaml:"outcomes"`
+	// text/template over the notification fields
+	Template string `yaml:"template"`
+	// Adds the principal that created or deleted the VM
+	IncludePrincipal bool `yaml:"include_principal"`
+	// Max notifications per minute, 30 when unset
+	RateLimit int `yaml:"rate_limit"`
+}
+
+const defaultNotificationTemplate = "DNS record {{.FQDN}} {{.Status}} for {{.VMName}} in {{.Project}}: {{.Reason}}" +
+	"{{if .Principal}} (requested by {{.Principal}}){{end}}"
+
+type notification struct {
+	Status    string `json:"status"`
+	FQDN      string `json:"fqdn"`
+	Reason    string `json:"reason,omitempty"`
+	Conflict  string `json:"conflict_policy,omitempty"`
+	Project   string `json:"vm_project"`
+	Instance  string `json:"instance"`
+	VMName    string `json:"vm_name"`
+	Principal string `json:"principal_email,omitempty"`
+	Text      string `json:"text"`
+}
+
+var (
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+	// Notifications sent in the current minute, per webhook
+	webhookLimits = struct {
+		sync.Mutex
+		window time.Time
+		sent   map[string]int
+	}{sent: make(map[string]int)}
+)
+
+func (r notificationRoute) matches(project, status string) bool {
+	outcomes := r.Outcomes
+	if len(outcomes) == 0 {
+		outcomes = []string{dnsDenied, dnsFailed}
+	}
+	if !containsString(outcomes, status) {
+		return false
+	}
+	return len(r.Projects) == 0 || containsString(r.Projects, project)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// False once the webhook's notifications of the current minute are used up
+func allowNotification(route notificationRoute) bool {
+	limit := route.RateLimit
+	if limit <= 0 {
+		limit = 30
+	}
+	webhookLimits.Lock()
+	defer webhookLimits.Unlock()
+	if window := time.Now().Truncate(time.Minute); !window.Equal(webhookLimits.window) {
+		webhookLimits.window, webhookLimits.sent = window, make(map[string]int)
+	}
+	if webhookLimits.sent[route.URL] >= limit {
+		return false
+	}
+	webhookLimits.sent[route.URL]++
+	return true
+}
+
+// Posts denied and failed results to the matching webhooks
+func notifyResult(ctx context.Context, result dnsResult) {
+	if result.Status != dnsDenied && result.Status != dnsFailed || dryRun {
+		return
+	}
+	policy, err := loadDnsPolicy()
+	if err != nil || len(policy.Notifications) == 0 {
+		return
+	}
+
+	n := notification{Status: result.Status, FQDN: result.FQDN, Reason: result.Reason, Conflict: result.Conflict}
+	principal := ""
+	if e := eventAudit(ctx); e != nil {
+		n.Project, n.Instance, principal = e.VMProject, e.Instance, e.PrincipalEmail
+		n.VMName = n.Instance[strings.LastIndex(n.Instance, "/")+1:]
+	}
+
+	// Webhook URLs carry their credentials, routes are logged by position
+	for i, route := range policy.Notifications {
+		if !route.matches(n.Project, result.Status) {
+			continue
+		}
+		if !allowNotification(route) {
+			fmt.Printf("Notification of %v %v dropped, rate limit of notification route %d reached\n", n.FQDN, n.Status, i+1)
+			continue
+		}
+		route_n := n
+		if route.IncludePrincipal {
+			route_n.Principal = principal
+		}
+		if err := postNotification(ctx, route, route_n); err != nil {
+			fmt.Printf("Error notifying %v %v on notification route %d: %v\n", n.FQDN, n.Status, i+1, err)
+		}
+	}
+}
+
+func renderNotification(route notificationRoute, n notification) (body []byte, err error) {
+	text := route.Template
+	if text == "" {
+		text = defaultNotificationTemplate
+	}
+	tmpl, err := template.New("notification").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification template: %v", err)
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, n); err != nil {
+		return nil, err
+	}
+	n.Text = rendered.String()
+
+	switch route.Format {
+	case "slack", "chat":
+		// Slack incoming webhooks and Google Chat spaces both take a text message
+		return json.Marshal(map[string]string{"text": n.Text})
+	case "", "json":
+		return json.Marshal(n)
+	}
+	return nil, fmt.Errorf("unknown notification format %q", route.Format)
+}
+
+func postNotification(ctx context.Context, route notificationRoute, n notification) error {
+	body, err := renderNotification(route, n)
+	if err != nil {
+		return err
+	}
+	return withRetry(ctx, "webhook.post", func() error {
+		req, err := http.NewRequest("POST", route.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		resp, err := webhookClient.Do(req.WithContext(ctx))
+		if e, ok := err.(*url.Error); ok {
+			// Without the URL
+			return e.Err
+		} else if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return &googleapi.Error{Code: resp.StatusCode, Message: "webhook " + resp.Status}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,72 @@
+package gcedns
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testWebhook struct {
+	sync.Mutex
+	bodies map[string][]string
+}
+
+func startTestWebhook(t *testing.T) (*testWebhook, string) {
+	hook := &testWebhook{bodies: make(map[string][]string)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		hook.Lock()
+		hook.bodies[r.URL.Path] = append(hook.bodies[r.URL.Path], string(body))
+		hook.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return hook, server.URL
+}
+
+func TestDenialNotifications(t *testing.T) {
+	setupTestDns(t)
+	hook, url := startTestWebhook(t)
+	ioutil.WriteFile(dnsPolicyFile, []byte(`
+notifications:
+  - url: "`+url+`/generic"
+    include_principal: true
+  - url: "`+url+`/slack"
+    format: "slack"
+    projects: ["prj-dev-4328"]
+    outcomes: ["denied"]
+    template: "{{.FQDN}} {{.Status}}: {{.Reason}}"
+    rate_limit: 1
+  - url: "`+url+`/other-project"
+    format: "chat"
+    projects: ["prj-prod-1234"]
+`), 0644)
+
+	for _, host := range []string{"prod01", "prod02"} {
+		dnsManagement(testAuditEvent(), DnsInfo{DnsHostName: host, Action: "create", IPs: []string{"10.0.0.7"}, VMName: "dev-vm-01", VMProject: "prj-dev-4328"})
+	}
+	// Not notified
+	dnsManagement(testAuditEvent(), DnsInfo{DnsHostName: "devserver01", Action: "create", IPs: []string{"10.0.0.5"}, VMName: "dev-vm-01", VMProject: "prj-dev-4328"})
+
+	generic := hook.bodies["/generic"]
+	if len(generic) != 2 {
+		t.Fatalf("FAILED: got %v generic notifications expected 2\n", len(generic))
+	}
+	n := notification{}
+	json.Unmarshal([]byte(generic[0]), &n)
+	if n.Status != dnsDenied || n.FQDN != "prod01.gcp.company.com." || n.VMName != "dev-vm-01" || n.Principal != "jane@company.com" ||
+		!strings.Contains(n.Text, "requested by jane@company.com") {
+		t.Errorf("FAILED: got %+v\n", n)
+	}
+
+	// Rate limited to one
+	if slack := hook.bodies["/slack"]; len(slack) != 1 || slack[0] != `{"text":"prod01.gcp.company.com. denied: not in the allow list for prj-dev-4328"}` {
+		t.Errorf("FAILED: got slack notifications %v\n", slack)
+	}
+	if other := hook.bodies["/other-project"]; len(other) != 0 {
+		t.Errorf("FAILED: got notifications for another project %v\n", other)
+	}
+}
@@ -0,0 +1,78 @@
+package gcedns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DNS policy managed by the DNS/Network team, next to dns_allow_list.yaml.
+// The allow list controls which hostnames a project may request, this policy
+// controls where those records may be written to.
+var dnsPolicyFile = "./serverless_function_source_code/dns_policy.yaml"
+
+// zoneGrant is a managed zone (and the project hosting it) a VM project may write to
+type zoneGrant struct {
+	Zone        string `yaml:"zone"`
+	HostProject string `yaml:"host_project"`
+}
+
+type dnsPolicy struct {
+	// VM project -> zones the project is allowed to write records to
+	Zones map[string][]zoneGrant `yaml:"zones"`
+	// How to handle names already taken by other VMs
+	Conflicts conflictPolicies `yaml:"conflicts"`
+	// VM project -> public domain used for public PTR records of external IPs
+	PublicPTR map[string]publicPTRGrant `yaml:"public_ptr"`
+	// VM project -> record mode, a (default) or cname
+	RecordModes map[string]string `yaml:"record_modes"`
+	// Webhooks notified of denied and failed records
+	Notifications []notificationRoute `yaml:"notifications"`
+}
+
+// Read the DNS policy from the local yaml file. A missing file is an empty policy.
+func loadDnsPolicy() (policy dnsPolicy, err error) {
+	policyData, err := ioutil.ReadFile(dnsPolicyFile)
+	if os.IsNotExist(err) {
+		return dnsPolicy{}, nil
+	} else if err != nil {
+		return dnsPolicy{}, err
+	}
+
+	if err = yaml.Unmarshal(policyData, &policy); err != nil {
+		return dnsPolicy{}, fmt.Errorf("error parsing %v: %v", dnsPolicyFile, err)
+	}
+	return policy, nil
+}
+
+// Checks if vmProjectID may write rs_type records to zone hosted in hostProject.
+// Default zones set through env.yaml are always allowed for their type: the default zone for
+// A and CNAME records, the default PTR zone for PTRs. Any other zone has to be granted to the
+// VM project explicitly. A grant with zone "*" covers all zones of its host project.
+func (p dnsPolicy) zoneAllowed(vmProjectID, hostProject, zone, rs_type string) bool {
+	if rs_type != "PTR" && hostProject == defaultDnsHostProject && zone == defaultDnsZone {
+		return true
+	}
+	if rs_type == "PTR" && hostProject == defaultPTRHostProject && zone == defaultPTRZone {
+		return true
+	}
+
+	for _, grant := range p.Zones[vmProjectID] {
+		if grant.HostProject == hostProject && (grant.Zone == zone || grant.Zone == "*") {
+			return true
+		}
+	}
+	return false
+}
+
+func checkZonePolicy(vmProjectID, hostProject, zone, rs_type string) bool {
+	policy, err := loadDnsPolicy()
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return policy.zoneAllowed(vmProjectID, hostProject, zone, rs_type)
+}
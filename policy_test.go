@@ -0,0 +1,158 @@
+package gcedns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type ZonePolicyTestData struct {
+	vmProject   string
+	hostProject string
+	zone        string
+	rsType      string
+	allowed     bool
+}
+
+func TestZonePolicy(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dns_policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	restoreDnsGlobals(t)
+
+	policy_yaml := []byte(`
+zones:
+  prj-dev-4328:
+    - zone: dev-zone
+      host_project: prj-c-dnshub
+  prj-ops-1001:
+    - zone: "*"
+      host_project: prj-c-ops
+`)
+	dnsPolicyFile = filepath.Join(dir, "dns_policy.yaml")
+	if err := ioutil.WriteFile(dnsPolicyFile, policy_yaml, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defaultDnsHostProject, defaultDnsZone = "prj-c-dnshub", "default-zone"
+	defaultPTRHostProject, defaultPTRZone = "prj-c-dnshub", "ptr-zone"
+
+	test_data := []ZonePolicyTestData{
+		{"prj-dev-4328", "prj-c-dnshub", "dev-zone", "A", true},
+		{"prj-dev-4328", "prj-c-dnshub", "dev-zone", "PTR", true},
+		{"prj-dev-4328", "prj-c-dnshub", "default-zone", "A", true},
+		{"prj-dev-4328", "prj-c-dnshub", "default-zone", "CNAME", true},
+		{"prj-dev-4328", "prj-c-dnshub", "default-zone", "PTR", false},
+		{"prj-dev-4328", "prj-c-dnshub", "ptr-zone", "PTR", true},
+		{"prj-dev-4328", "prj-c-dnshub", "ptr-zone", "A", false},
+		{"prj-dev-4328", "prj-c-dnshub", "prod-zone", "A", false},
+		{"prj-dev-4328", "prj-other", "dev-zone", "A", false},
+		{"prj-ops-1001", "prj-c-ops", "any-zone", "A", true},
+		{"prj-unknown", "prj-c-dnshub", "dev-zone", "A", false},
+	}
+
+	for _, data := range test_data {
+		if got := checkZonePolicy(data.vmProject, data.hostProject, data.zone, data.rsType); got != data.allowed {
+			t.Errorf("FAILED: %v writing %v to %v/%v: got %v expected %v\n", data.vmProject, data.rsType, data.hostProject, data.zone, got, data.allowed)
+		}
+	}
+}
+
+func TestConflictPolicy(t *testing.T) {
+
+	policy := dnsPolicy{
+		Conflicts: conflictPolicies{
+			Default:  conflictReject,
+			Projects: map[string]string{"prj-dev-4328": conflictSuffix, "prj-bad": "unknown"},
+			Zones:    map[string]string{"rr-zone": conflictMerge},
+		},
+	}
+
+	test_data := []struct {
+		vmProject string
+		zone      string
+		expected  string
+	}{
+		{"prj-dev-4328", "dev-zone", conflictSuffix},
+		{"prj-dev-4328", "rr-zone", conflictMerge},
+		{"prj-other", "dev-zone", conflictReject},
+		{"prj-bad", "dev-zone", conflictReject},
+	}
+
+	for _, data := range test_data {
+		if got := policy.conflictPolicy(data.vmProject, data.zone); got != data.expected {
+			t.Errorf("FAILED: %v/%v: got %v expected %v\n", data.vmProject, data.zone, got, data.expected)
+		}
+	}
+
+	// Unconfigured policy keeps the merge behaviour
+	if got := (dnsPolicy{}).conflictPolicy("prj-other", "dev-zone"); got != conflictMerge {
+		t.Errorf("FAILED: empty policy: got %v expected %v\n", got, conflictMerge)
+	}
+}
+
+func TestPublicPTRName(t *testing.T) {
+
+	policy := dnsPolicy{
+		PublicPTR: map[string]publicPTRGrant{
+			"prj-web-1001": {Domain: "example.com", Allow: "^(www|api)[0-9]*\\.example\\.com\\.$"},
+		},
+	}
+
+	test_data := []struct {
+		vm_info  VMInfo
+		expected string
+		allowed  bool
+	}{
+		{VMInfo{VMProject: "prj-web-1001", Name: "vm-1", Labels: map[string]string{"dns_host_name": "www01"}}, "www01.example.com.", true},
+		{VMInfo{VMProject: "prj-web-1001", Name: "vm-1"}, "vm-1.example.com.", false},
+		{VMInfo{VMProject: "prj-dev-4328", Name: "www01"}, "", false},
+	}
+
+	for _, data := range test_data {
+		public_name, allowed := policy.publicPTRName(data.vm_info)
+		if public_name != data.expected || allowed != data.allowed {
+			t.Errorf("FAILED: got %q/%v expected %q/%v\n", public_name, allowed, data.expected, data.allowed)
+		}
+	}
+
+	defer func() { lookupHost = net.LookupHost }()
+	lookupHost = func(host string) ([]string, error) {
+		return []string{"203.0.113.10"}, nil
+	}
+	if !forwardResolves("www01.example.com.", "203.0.113.10") || forwardResolves("www01.example.com.", "203.0.113.11") {
+		t.Errorf("FAILED: forward resolution check\n")
+	}
+}
+
+func TestRecordMode(t *testing.T) {
+
+	policy := dnsPolicy{RecordModes: map[string]string{"prj-dev-4328": recordModeCNAME}}
+
+	test_data := []struct {
+		vm_info  VMInfo
+		expected string
+	}{
+		{VMInfo{VMProject: "prj-dev-4328"}, recordModeCNAME},
+		{VMInfo{VMProject: "prj-dev-4328", Labels: map[string]string{"dns_record_mode": "a"}}, recordModeA},
+		{VMInfo{VMProject: "prj-other", Labels: map[string]string{"dns_record_mode": "cname"}}, recordModeCNAME},
+		{VMInfo{VMProject: "prj-other", Labels: map[string]string{"dns_record_mode": "aaaa"}}, recordModeA},
+	}
+
+	for _, data := range test_data {
+		if got := policy.recordMode(data.vm_info); got != data.expected {
+			t.Errorf("FAILED: %v: got %v expected %v\n", data.vm_info, got, data.expected)
+		}
+	}
+
+	if got := zonalInternalName("dev01", "us-central1-a", "prj-dev-4328"); got != "dev01.us-central1-a.c.prj-dev-4328.internal." {
+		t.Errorf("FAILED: got %v\n", got)
+	}
+	if got := zonalInternalName("dev01", "us-central1-a", "example.com:prj-dev"); got != "dev01.us-central1-a.c.prj-dev.example.com.internal." {
+		t.Errorf("FAILED: got %v\n", got)
+	}
+}
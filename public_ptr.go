@@ -0,0 +1,137 @@
+package gcedns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/compute/v1"
+)
+
+/* Public PTR records for external IPs
+Reverse DNS of external IPs is owned by Google, it's set on the VM's access config
+https://cloud.google.com/compute/docs/instances/create-ptr-record
+GCE requires the public name to resolve to the external IP before the PTR can be set.
+*/
+
+// Public domain and the public hostnames allowed for a VM project
+type publicPTRGrant struct {
+	Domain string `yaml:"domain"`
+	Allow  string `yaml:"allow"`
+}
+
+// Overridden in tests
+var lookupHost = net.LookupHost
+
+// Public PTR name for a VM with the dns_public_ptr label, <dns_host_name or VM name>.<project's public domain>
+func (p dnsPolicy) publicPTRName(vm_info VMInfo) (public_name string, allowed bool) {
+	grant, exists := p.PublicPTR[vm_info.VMProject]
+	if !exists || grant.Domain == "" {
+		return "", false
+	}
+
+	host_name := vm_info.Labels["dns_host_name"]
+	if host_name == "" {
+		host_name = vm_info.Name
+	}
+	public_name = host_name + "." + strings.TrimSuffix(grant.Domain, ".") + "."
+
+	if grant.Allow == "" {
+		return public_name, false
+	}
+	allow, err := regexp.Compile(grant.Allow)
+	if err != nil {
+		fmt.Printf("Invalid public_ptr allow regex for %q: %v\n", vm_info.VMProject, err)
+		return public_name, false
+	}
+	return public_name, allow.MatchString(public_name)
+}
+
+// Checks that public_name resolves to the external IP
+func forwardResolves(public_name, ip string) bool {
+	addrs, err := lookupHost(strings.TrimSuffix(public_name, "."))
+	if err != nil {
+		fmt.Printf("Error resolving %q: %v\n", public_name, err)
+		return false
+	}
+	for _, addr := range addrs {
+		if addr == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets (create) or clears (delete) the public PTR on the VM's external IPs
+func publicPTRManagement(ctx context.Context, vm_info VMInfo, action string) (result dnsResult) {
+	defer func() { reportResult(ctx, result) }()
+	if vm_info.Labels["dns_public_ptr"] != "true" || len(vm_info.AccessConfigs) == 0 {
+		return dnsResult{Status: dnsSkipped}
+	}
+
+	policy, err := loadDnsPolicy()
+	if err != nil {
+		fmt.Println(err)
+		return dnsResult{Status: dnsFailed, Reason: "error loading dns policy", Err: err}
+	}
+
+	public_name, allowed := policy.publicPTRName(vm_info)
+	result = dnsResult{FQDN: public_name}
+	if public_name == "" {
+		result.Status, result.Code, result.Reason = dnsDenied, denyPublicPTRPolicy, "no public domain for "+vm_info.VMProject
+		return
+	} else if !allowed {
+		fmt.Printf("%q is not an allowed public name for %q\n", public_name, vm_info.VMProject)
+		result.Status, result.Code, result.Reason = dnsDenied, denyPublicPTRPolicy, "not an allowed public name for "+vm_info.VMProject
+		return
+	}
+
+	gce := computeService(ctx)
+	for _, ac := range vm_info.AccessConfigs {
+		update := &compute.AccessConfig{Name: ac.Name, Type: ac.Type}
+
+		if action == "create" {
+			if ac.SetPublicPtr && ac.PublicPtrDomainName == public_name {
+				result.Status = dnsUnchanged
+				continue
+			}
+			if !forwardResolves(public_name, ac.NatIP) {
+				fmt.Printf("%q doesn't resolve to %v, public PTR not set\n", public_name, ac.NatIP)
+				result.Status, result.Code, result.Reason = dnsDenied, denyForwardMismatch, fmt.Sprintf("doesn't resolve to %v", ac.NatIP)
+				return
+			}
+			update.SetPublicPtr = true
+			update.PublicPtrDomainName = public_name
+		} else if action == "delete" {
+			// Only clear what this function set
+			if !ac.SetPublicPtr || ac.PublicPtrDomainName != public_name {
+				result.Status = dnsUnchanged
+				continue
+			}
+			update.ForceSendFields = []string{"SetPublicPtr"}
+		}
+
+		if dryRun {
+			fmt.Printf("Dry run, would %v the public PTR of %v on %q\n", action, ac.NatIP, vm_info.Name)
+			result.Status = dnsUnchanged
+			continue
+		}
+		err := withRetry(ctx, "compute.instances.updateAccessConfig", func() error {
+			_, err := gce.Instances.UpdateAccessConfig(vm_info.VMProject, vm_info.Zone, vm_info.Name, ac.NIC, update).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			fmt.Printf("Error updating public PTR of %v on %q: %v\n", ac.NatIP, vm_info.Name, err)
+			result.Status, result.Reason, result.Err = dnsFailed, err.Error(), err
+			return
+		}
+		if action == "create" {
+			result.Status = dnsCreated
+		} else {
+			result.Status = dnsDeleted
+		}
+	}
+	return result
+}
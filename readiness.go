@@ -0,0 +1,152 @@
+package gcedns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+/* Readiness gating
+A VM's records are published only once the workload reports ready, through one of the labels:
+- dns_ready_metadata: metadata key the workload sets to "true", ex: dns-ready
+- dns_ready_guest_attribute: guest attribute key under the "dns" namespace set to "true"
+- dns_ready_port: TCP port answering on nic0
+*/
+
+const (
+	readyMetadata       = "metadata"
+	readyGuestAttribute = "guest-attribute"
+	readyTCP            = "tcp"
+
+	guestAttributeNamespace = "dns"
+)
+
+var (
+	// Max time to wait for a VM to become ready, with the operation wait it must stay below the function timeout
+	readinessTimeout  = envSeconds("DNS_READY_TIMEOUT", 150)
+	readinessInterval = 10 * time.Second
+	// --timeout of the function in deploy.sh
+	functionTimeout = envSeconds("DNS_FUNCTION_TIMEOUT", 300)
+)
+
+// The event fails and is redelivered, the wait starts over until it's out of attempts
+var errNotReady = errors.New("VM not ready")
+
+func init() {
+	if err := checkTimeouts(operationTimeout, readinessTimeout, functionTimeout); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+}
+
+// An insert waits for its operation then for readiness, the function is killed if both run out
+func checkTimeouts(operation, ready, function time.Duration) error {
+	if operation+ready >= function {
+		return fmt.Errorf("DNS_OPERATION_TIMEOUT %v + DNS_READY_TIMEOUT %v exceed the function timeout %v, readiness gated events time out before they're retried",
+			operation, ready, function)
+	}
+	return nil
+}
+
+type readinessCheck struct {
+	Kind string
+	Key  string
+}
+
+func (c readinessCheck) String() string {
+	return c.Kind + " " + c.Key
+}
+
+// Result of a VM not ready by readinessTimeout
+func notReadyResult(fqdn, state string) dnsResult {
+	return dnsResult{Status: dnsFailed, FQDN: fqdn, Reason: "VM not ready", Err: errNotReady, Readiness: state}
+}
+
+func envSeconds(name string, defaultSeconds int) time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv(name)); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(defaultSeconds) * time.Second
+}
+
+// Readiness check requested through the VM labels
+func vmReadinessCheck(vm_info VMInfo) (check readinessCheck, gated bool) {
+	switch {
+	case vm_info.Labels["dns_ready_metadata"] != "":
+		return readinessCheck{Kind: readyMetadata, Key: vm_info.Labels["dns_ready_metadata"]}, true
+	case vm_info.Labels["dns_ready_guest_attribute"] != "":
+		return readinessCheck{Kind: readyGuestAttribute, Key: vm_info.Labels["dns_ready_guest_attribute"]}, true
+	case vm_info.Labels["dns_ready_port"] != "":
+		return readinessCheck{Kind: readyTCP, Key: vm_info.Labels["dns_ready_port"]}, true
+	}
+	return readinessCheck{}, false
+}
+
+// Polls the VM until the readiness check passes or readinessTimeout expires.
+// state describes the outcome of the wait, ex: "ready after 40s (metadata dns-ready)"
+func waitForReadiness(ctx context.Context, vm_info VMInfo, check readinessCheck) (state string, ready bool) {
+	start := time.Now()
+	deadline := start.Add(readinessTimeout)
+
+	for {
+		if isReady(ctx, vm_info, check) {
+			state = fmt.Sprintf("ready after %v (%v)", time.Since(start).Round(time.Second), check)
+			fmt.Printf("%q is %v\n", vm_info.Name, state)
+			return state, true
+		}
+		if time.Now().Add(readinessInterval).After(deadline) {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			state = fmt.Sprintf("not ready, wait cancelled after %v (%v)", time.Since(start).Round(time.Second), check)
+			fmt.Printf("%q is %v\n", vm_info.Name, state)
+			return state, false
+		case <-time.After(readinessInterval):
+		}
+	}
+	state = fmt.Sprintf("not ready after %v (%v)", time.Since(start).Round(time.Second), check)
+	fmt.Printf("%q is %v\n", vm_info.Name, state)
+	return state, false
+}
+
+func isReady(ctx context.Context, vm_info VMInfo, check readinessCheck) bool {
+	switch check.Kind {
+	case readyMetadata:
+		current, received := getInstance(ctx, vm_info.VMProject, vm_info.Zone, vm_info.Name)
+		return received && current.Metadata[check.Key] == "true"
+	case readyGuestAttribute:
+		var attribute *compute.GuestAttributes
+		err := withRetry(ctx, "compute.instances.getGuestAttributes", func() (err error) {
+			attribute, err = computeService(ctx).Instances.GetGuestAttributes(vm_info.VMProject, vm_info.Zone, vm_info.Name).
+				VariableKey(guestAttributeNamespace + "/" + check.Key).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			// 404 until the guest sets the attribute
+			if debug != "" {
+				fmt.Printf("guest attribute %v/%v on %q: %v\n", guestAttributeNamespace, check.Key, vm_info.Name, err)
+			}
+			return false
+		}
+		return attribute.VariableValue == "true"
+	case readyTCP:
+		if len(vm_info.IPs) == 0 {
+			return false
+		}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(vm_info.IPs[0], check.Key), 3*time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package gcedns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVMReadinessCheck(t *testing.T) {
+
+	check, gated := vmReadinessCheck(VMInfo{Labels: map[string]string{"dns_ready_metadata": "dns-ready"}})
+	if !gated || check.Kind != readyMetadata || check.Key != "dns-ready" {
+		t.Errorf("FAILED: got %v, gated: %v\n", check, gated)
+	}
+
+	if _, gated := vmReadinessCheck(VMInfo{Labels: map[string]string{"dns_host_name": "dev01"}}); gated {
+		t.Errorf("FAILED: VM without readiness labels is gated\n")
+	}
+}
+
+func TestWaitForTCPReadiness(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	timeout, interval := readinessTimeout, readinessInterval
+	t.Cleanup(func() { readinessTimeout, readinessInterval = timeout, interval })
+	readinessTimeout, readinessInterval = 200*time.Millisecond, 50*time.Millisecond
+	vm_info := VMInfo{Name: "dev01", IPs: []string{"127.0.0.1"}}
+	check := readinessCheck{Kind: readyTCP, Key: port}
+
+	if state, ready := waitForReadiness(context.Background(), vm_info, check); !ready || !strings.HasPrefix(state, "ready after") {
+		t.Errorf("FAILED: got %q, ready: %v\n", state, ready)
+	}
+
+	listener.Close()
+	if state, ready := waitForReadiness(context.Background(), vm_info, check); ready || !strings.HasPrefix(state, "not ready after") {
+		t.Errorf("FAILED: got %q, ready: %v\n", state, ready)
+	}
+}
+
+// Retried, then dead-lettered once out of attempts
+func TestNotReadyRetried(t *testing.T) {
+	err := firstFailure(nil, notReadyResult("devserver01.gcp.company.com.", "not ready after 150s (tcp 8080)"))
+	if !errors.Is(err, errNotReady) || errorClass(err) != errorTransient {
+		t.Errorf("FAILED: got %v expected a transient VM not ready error\n", err)
+	}
+}
+
+func TestCheckTimeouts(t *testing.T) {
+	if err := checkTimeouts(120*time.Second, 240*time.Second, 300*time.Second); err == nil {
+		t.Errorf("FAILED: 120s + 240s accepted within a 300s function timeout\n")
+	}
+	if err := checkTimeouts(envSeconds("", 120), envSeconds("", 150), envSeconds("", 300)); err != nil {
+		t.Errorf("FAILED: defaults got %v\n", err)
+	}
+}
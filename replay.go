@@ -0,0 +1,357 @@
+package gcedns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/* Offline replay of exported audit logs
+VM audit logs exported from Cloud Logging (JSON arrays, NDJSON, or sink files) are fed through
+the event pipeline in timestamp order, against any DNS backend:
+- dry run (default): DNS changes are logged and applied to an in-memory copy of the touched
+  zones, VM metadata and public PTRs are left untouched
+- apply: changes are made on the backend, ex: after a sink outage
+Replay is offline: VMs aren't looked up, their name, labels and metadata come from the insert
+entries and their IPs from the insert request (static IPs) or a seed file of
+{"projects/PROJECT/zones/ZONE/instances/NAME": {"ips": [...], "labels": {...}}}. Deletes use what
+the VM's insert entry or the seed file said, so VMs deleted since can be replayed. Readiness
+checks and waits on insert operations are skipped, and no status is written back to VMs.
+*/
+
+var (
+	// Set while replaying, historical insert operations aren't waited on
+	replaying bool
+	// Compute and DNS writes are logged instead of applied
+	dryRun bool
+)
+
+// ReplayOptions of ReplayAuditLogs
+type ReplayOptions struct {
+	// cloud (default), memory, or memory:FILE seeded with {"PROJECT/ZONE": [recordSets]}
+	Backend string
+	// Apply the changes, only log them otherwise
+	Apply bool
+	// Seed file of VM IPs, labels and metadata by instance resource name
+	VMs string
+}
+
+// VM of the replay seed file
+type replaySeed struct {
+	IPs      []string          `json:"ips"`
+	Labels   map[string]string `json:"labels"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// VMs known to the replay by instance resource name, from the seed file and the replayed inserts
+var replayVMs = struct {
+	sync.Mutex
+	vms map[string]VMInfo
+}{vms: make(map[string]VMInfo)}
+
+func loadReplaySeed(path string) (map[string]VMInfo, error) {
+	vms := make(map[string]VMInfo)
+	if path == "" {
+		return vms, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seeds := make(map[string]replaySeed)
+	if err := json.Unmarshal(data, &seeds); err != nil {
+		return nil, fmt.Errorf("error parsing %v: %v", path, err)
+	}
+	for resource, seed := range seeds {
+		project, zone, name := parseResourceURL(resource)
+		vms[resource] = VMInfo{IPs: seed.IPs, Labels: seed.Labels, Metadata: seed.Metadata, Name: name, VMProject: project, Zone: zone}
+	}
+	return vms, nil
+}
+
+// VM known to the replay by its instance resource name
+func replayVM(resource string) (vm_info VMInfo, known bool) {
+	replayVMs.Lock()
+	defer replayVMs.Unlock()
+	project, zone, name := parseResourceURL(resource)
+	vm_info, known = replayVMs.vms["projects/"+project+"/zones/"+zone+"/instances/"+name]
+	return vm_info, known && len(vm_info.IPs) > 0
+}
+
+// VM of a replayed entry, built from the audit payload without any Compute API call.
+// Inserts are remembered for the VM's later entries, seeded IPs win over the request's.
+func replayVMInfo(logMessage logMetadata) (vm_info VMInfo, status bool) {
+	resource := logMessage.ProtoPayload.ResourceName
+	project, zone, name := parseResourceURL(resource)
+	key := "projects/" + project + "/zones/" + zone + "/instances/" + name
+
+	replayVMs.Lock()
+	defer replayVMs.Unlock()
+	known, seen := replayVMs.vms[key]
+
+	if event_vm, isInsert := eventVMInfo(logMessage); isInsert {
+		vm_info = event_vm
+		for _, nic := range logMessage.ProtoPayload.Request.NetworkInterfaces {
+			if nic.NetworkIP != "" {
+				vm_info.IPs = append(vm_info.IPs, nic.NetworkIP)
+			}
+		}
+		if len(known.IPs) > 0 {
+			vm_info.IPs = known.IPs
+		}
+		replayVMs.vms[key] = vm_info
+	} else if seen {
+		vm_info = known
+	} else {
+		vm_info = VMInfo{Name: name, VMProject: project, Zone: zone}
+	}
+	if vm_info.InstanceID == "" {
+		vm_info.InstanceID = logMessage.Resource.Labels.InstanceID
+	}
+
+	if len(vm_info.IPs) == 0 {
+		fmt.Printf("No IPs of %v in its insert entry or the seed file\n", resource)
+		return vm_info, false
+	}
+	return vm_info, true
+}
+
+func newDnsBackend(name string) (dnsBackend, error) {
+	switch {
+	case name == "" || name == "cloud":
+		return cloudDNS{}, nil
+	case name == "memory":
+		return newMemoryDNS(), nil
+	case strings.HasPrefix(name, "memory:"):
+		return loadMemoryDNS(strings.TrimPrefix(name, "memory:"))
+	}
+	return nil, fmt.Errorf("unknown DNS backend %q, expected cloud, memory or memory:FILE", name)
+}
+
+func loadMemoryDNS(path string) (*memoryDNS, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	backend := newMemoryDNS()
+	if err := json.Unmarshal(data, &backend.zones); err != nil {
+		return nil, fmt.Errorf("error parsing %v: %v", path, err)
+	}
+	return backend, nil
+}
+
+// Reads through to the backend, changes are logged and applied to an in-memory copy of the touched zones
+type dryRunDNS struct {
+	backend dnsBackend
+	overlay *memoryDNS
+
+	sync.Mutex
+	loaded  map[string]bool
+	changes int
+}
+
+func newDryRunDNS(backend dnsBackend) *dryRunDNS {
+	return &dryRunDNS{backend: backend, overlay: newMemoryDNS(), loaded: make(map[string]bool)}
+}
+
+func (d *dryRunDNS) load(ctx context.Context, project, zone string) error {
+	d.Lock()
+	defer d.Unlock()
+	key := project + "/" + zone
+	if d.loaded[key] {
+		return nil
+	}
+	records, err := d.backend.listRecordSets(ctx, project, zone, "", "")
+	if err != nil {
+		return err
+	}
+	d.overlay.Lock()
+	d.overlay.zones[key] = records
+	d.overlay.Unlock()
+	d.loaded[key] = true
+	return nil
+}
+
+func (d *dryRunDNS) listRecordSets(ctx context.Context, project, zone, dns_name, rs_type string) ([]rrset, error) {
+	if err := d.load(ctx, project, zone); err != nil {
+		return nil, err
+	}
+	return d.overlay.listRecordSets(ctx, project, zone, dns_name, rs_type)
+}
+
+func (d *dryRunDNS) createChange(ctx context.Context, project, zone string, change rrChange) (rrChange, error) {
+	if err := d.load(ctx, project, zone); err != nil {
+		return rrChange{}, err
+	}
+	for _, record := range change.Deletions {
+		fmt.Printf("Dry run, %v/%v would delete %v %v %v\n", project, zone, record.Name, record.Type, record.Rrdatas)
+	}
+	for _, record := range change.Additions {
+		fmt.Printf("Dry run, %v/%v would add %v %v %v\n", project, zone, record.Name, record.Type, record.Rrdatas)
+	}
+	d.Lock()
+	d.changes++
+	d.Unlock()
+	return d.overlay.createChange(ctx, project, zone, change)
+}
+
+func (d *dryRunDNS) getChange(ctx context.Context, project, zone, id string) (rrChange, error) {
+	return d.overlay.getChange(ctx, project, zone, id)
+}
+
+// Exported audit log entry
+type auditEntry struct {
+	Raw      json.RawMessage
+	Metadata logMetadata
+	Source   string
+}
+
+// Audit log files under the paths, directories are walked for .json, .jsonl and .ndjson files
+func auditLogFiles(paths []string) (files []string, err error) {
+	for _, path := range paths {
+		err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			switch filepath.Ext(file) {
+			case ".json", ".jsonl", ".ndjson":
+				files = append(files, file)
+			default:
+				if file == path {
+					files = append(files, file)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Entries of a JSON array, or of a stream of JSON objects (NDJSON)
+func readAuditLog(path string) (entries []auditEntry, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("error parsing %v: %v", path, err)
+		}
+
+		var raws []json.RawMessage
+		if strings.HasPrefix(strings.TrimSpace(string(raw)), "[") {
+			if err := json.Unmarshal(raw, &raws); err != nil {
+				return nil, fmt.Errorf("error parsing %v: %v", path, err)
+			}
+		} else {
+			raws = []json.RawMessage{raw}
+		}
+		for _, raw := range raws {
+			entry := auditEntry{Raw: raw, Source: path}
+			if err := json.Unmarshal(raw, &entry.Metadata); err != nil {
+				fmt.Printf("Invalid entry in %v, skipped: %v\n", path, err)
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+}
+
+// Same selection as the log sink filter in deploy.sh
+func sinkFilter(logMessage logMetadata) bool {
+	if logMessage.Operation.ID != "" && !logMessage.Operation.First {
+		return false
+	}
+	switch logMessage.ProtoPayload.Request.Type {
+	case "type.googleapis.com/compute.instances.insert", "type.googleapis.com/compute.instances.delete", addInstancesType, removeInstancesType:
+		return true
+	}
+	return false
+}
+
+// ReplayAuditLogs feeds exported audit log entries through the event pipeline in timestamp order
+func ReplayAuditLogs(ctx context.Context, paths []string, opts ReplayOptions) error {
+	files, err := auditLogFiles(paths)
+	if err != nil {
+		return err
+	}
+	var entries []auditEntry
+	for _, file := range files {
+		file_entries, err := readAuditLog(file)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, file_entries...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Metadata.Timestamp.Before(entries[j].Metadata.Timestamp)
+	})
+
+	backend, err := newDnsBackend(opts.Backend)
+	if err != nil {
+		return err
+	}
+	seed, err := loadReplaySeed(opts.VMs)
+	if err != nil {
+		return err
+	}
+	replayVMs.Lock()
+	replayVMs.vms = seed
+	replayVMs.Unlock()
+	dry_run_backend := newDryRunDNS(backend)
+	previous, previous_states := dnsAPI, eventStates
+	if opts.Apply {
+		dnsAPI = backend
+	} else {
+		// The sequencing state of a dry run is thrown away with it
+		dnsAPI, eventStates = dry_run_backend, newMemoryDedup(len(entries)*2+1)
+	}
+	replaying, dryRun = true, !opts.Apply
+	defer func() {
+		dnsAPI, eventStates = previous, previous_states
+		replaying, dryRun = false, false
+	}()
+
+	replayed, failed := 0, 0
+	for _, entry := range entries {
+		if !sinkFilter(entry.Metadata) {
+			continue
+		}
+		replayed++
+		result, err := gceEventCheckOperation(entry.Raw, ctx)
+		if err != nil {
+			failed++
+			result = fmt.Sprintf("%v error: %v", strings.TrimSpace(result), err)
+		}
+		fmt.Printf("%v %v %v: %v\n", entry.Metadata.Timestamp.Format("2006-01-02T15:04:05Z07:00"), entry.Metadata.ProtoPayload.MethodName,
+			entry.Metadata.ProtoPayload.ResourceName, strings.TrimSpace(result))
+	}
+
+	fmt.Printf("Replayed %v of %v entries from %v files, %v failed\n", replayed, len(entries), len(files), failed)
+	if !opts.Apply {
+		fmt.Printf("Dry run, %v changes would have been made\n", dry_run_backend.changes)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v of %v entries failed", failed, replayed)
+	}
+	return nil
+}
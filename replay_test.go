@@ -0,0 +1,177 @@
+package gcedns
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func auditLogAt(timestamp, labels string) string {
+	log_entry := map[string]interface{}{}
+	json.Unmarshal(insertAuditLog(labels), &log_entry)
+	log_entry["timestamp"] = timestamp
+	data, _ := json.Marshal(log_entry)
+	return string(data)
+}
+
+func TestReadAuditLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit_logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	skip := `[{"key": "dns_skip_record", "value": "true"}]`
+	// gcloud logging read --format=json writes arrays, sinks to GCS write JSON lines
+	files := map[string]string{
+		"export.json":    "[" + auditLogAt("2021-07-10T10:02:00Z", skip) + "," + auditLogAt("2021-07-10T10:00:00Z", skip) + "]",
+		"sink/00.jsonl":  auditLogAt("2021-07-10T10:01:00Z", skip) + "\n" + auditLogAt("2021-07-10T10:03:00Z", skip) + "\n",
+		"sink/README.md": "not an audit log",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := auditLogFiles([]string{dir})
+	if err != nil || len(found) != 2 {
+		t.Fatalf("FAILED: got %v, %v expected the 2 audit log files\n", found, err)
+	}
+	var entries []auditEntry
+	for _, file := range found {
+		file_entries, err := readAuditLog(file)
+		if err != nil {
+			t.Fatalf("FAILED: reading %v: %v\n", file, err)
+		}
+		entries = append(entries, file_entries...)
+	}
+	if len(entries) != 4 {
+		t.Errorf("FAILED: got %v entries expected 4\n", len(entries))
+	}
+
+	if err := ReplayAuditLogs(context.Background(), []string{dir}, ReplayOptions{Backend: "memory"}); err != nil {
+		t.Errorf("FAILED: replay got %v\n", err)
+	}
+
+	// Delete of a VM with no insert entry or seed, the replay reports it
+	delete_entry := map[string]interface{}{}
+	json.Unmarshal(deleteAuditLog("dev-vm-09"), &delete_entry)
+	delete_entry["timestamp"] = "2021-07-10T10:04:00Z"
+	data, _ := json.Marshal(delete_entry)
+	ioutil.WriteFile(filepath.Join(dir, "sink/01.jsonl"), append(data, '\n'), 0644)
+	if err := ReplayAuditLogs(context.Background(), []string{dir}, ReplayOptions{Backend: "memory"}); err == nil || err.Error() != "1 of 5 entries failed" {
+		t.Errorf("FAILED: replay got %v expected 1 of 5 entries failed\n", err)
+	}
+}
+
+func TestSinkFilter(t *testing.T) {
+	test_data := []struct {
+		entry    string
+		replayed bool
+	}{
+		{`{"operation": {"id": "op-1", "first": true}, "protoPayload": {"request": {"@type": "type.googleapis.com/compute.instances.insert"}}}`, true},
+		{`{"operation": {"id": "op-1", "last": true}, "protoPayload": {"request": {"@type": "type.googleapis.com/compute.instances.insert"}}}`, false},
+		{`{"protoPayload": {"request": {"@type": "type.googleapis.com/compute.instanceGroups.addInstances"}}}`, true},
+		{`{"operation": {"id": "op-2", "first": true}, "protoPayload": {"request": {"@type": "type.googleapis.com/compute.instances.stop"}}}`, false},
+	}
+	for _, data := range test_data {
+		logMessage := logMetadata{}
+		json.Unmarshal([]byte(data.entry), &logMessage)
+		if sinkFilter(logMessage) != data.replayed {
+			t.Errorf("FAILED: %v expected replayed %v\n", data.entry, data.replayed)
+		}
+	}
+}
+
+func TestDryRunDNS(t *testing.T) {
+	setupTestDns(t)
+	seed := filepath.Join(t.TempDir(), "zones.json")
+	ioutil.WriteFile(seed, []byte(`{"prj-c-dnshub/default-zone": [
+		{"name": "devserver01.gcp.company.com.", "type": "A", "ttl": 300, "rrdatas": ["10.0.0.5"]}
+	]}`), 0644)
+
+	backend, err := newDnsBackend("memory:" + seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dry_run := newDryRunDNS(backend)
+	dnsAPI = dry_run
+
+	dnsInfo := DnsInfo{DnsHostName: "devserver01", Action: "delete", IPs: []string{"10.0.0.5"}, VMName: "vm-01", VMProject: "prj-dev-4328"}
+	if result := dnsManagement(context.Background(), dnsInfo); result.Status != dnsDeleted {
+		t.Errorf("FAILED: dry run delete got %v expected %v\n", result, dnsDeleted)
+	}
+	if records, _ := dry_run.listRecordSets(context.Background(), "prj-c-dnshub", "default-zone", "devserver01.gcp.company.com.", "A"); len(records) != 0 {
+		t.Errorf("FAILED: record still in the dry run copy: %v\n", records)
+	}
+	if records, _ := backend.listRecordSets(context.Background(), "prj-c-dnshub", "default-zone", "devserver01.gcp.company.com.", "A"); len(records) != 1 {
+		t.Errorf("FAILED: dry run changed the backend: %v\n", records)
+	}
+	if dry_run.changes != 1 {
+		t.Errorf("FAILED: got %v changes expected 1\n", dry_run.changes)
+	}
+
+	if _, err := newDnsBackend("route53"); err == nil {
+		t.Errorf("FAILED: unknown backend accepted\n")
+	}
+}
+
+func deleteAuditLog(instance string) []byte {
+	return []byte(`{
+		"insertId": "-def456",
+		"protoPayload": {
+			"authorizationInfo": [{"granted": true, "permission": "compute.instances.delete"}],
+			"methodName": "v1.compute.instances.delete",
+			"request": {"@type": "type.googleapis.com/compute.instances.delete"},
+			"resourceName": "projects/prj-dev-4328/zones/us-central1-a/instances/` + instance + `"
+		},
+		"resource": {"labels": {"instance_id": "456", "project_id": "prj-dev-4328", "zone": "us-central1-a"}, "type": "gce_instance"}
+	}`)
+}
+
+// Deletes of VMs long gone are replayed from their insert entry or the seed file, without any Compute API call
+func TestReplayDeletedVM(t *testing.T) {
+	setupTestDns(t)
+	ctx := context.Background()
+	replaying = true
+	defer func() { replaying = false }()
+
+	seed_file := filepath.Join(t.TempDir(), "vms.json")
+	ioutil.WriteFile(seed_file, []byte(`{"projects/prj-dev-4328/zones/us-central1-a/instances/dev-vm-02": {"ips": ["10.0.0.6"], "labels": {"dns_host_name": "qa01"}}}`), 0644)
+	seed, err := loadReplaySeed(seed_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayVMs.vms = seed
+
+	// The insert request carries the static IP
+	insert := map[string]interface{}{}
+	json.Unmarshal(insertAuditLog(`[{"key": "dns_host_name", "value": "devserver01"}]`), &insert)
+	insert["protoPayload"].(map[string]interface{})["request"].(map[string]interface{})["networkInterfaces"] = []map[string]string{{"networkIP": "10.0.0.5"}}
+	insert_data, _ := json.Marshal(insert)
+
+	if result, err := gceEventCheckOperation(insert_data, ctx); err != nil || !strings.Contains(result, "created") {
+		t.Fatalf("FAILED: insert got %v, %v\n", result, err)
+	}
+	dnsManagement(ctx, DnsInfo{DnsHostName: "qa01", Action: "create", IPs: []string{"10.0.0.6"}, VMName: "dev-vm-02", VMProject: "prj-dev-4328"})
+
+	for name, instance := range map[string]string{"devserver01.gcp.company.com.": "dev-vm-01", "qa01.gcp.company.com.": "dev-vm-02"} {
+		if result, err := gceEventCheckOperation(deleteAuditLog(instance), ctx); err != nil || !strings.Contains(result, "deleted") {
+			t.Errorf("FAILED: delete of %v got %v, %v\n", instance, result, err)
+		}
+		if _, exists, _ := getRecordSet(ctx, "prj-c-dnshub", "default-zone", name, "A"); exists {
+			t.Errorf("FAILED: %v not deleted\n", name)
+		}
+	}
+
+	// Neither replayed nor seeded
+	if _, err := gceEventCheckOperation(deleteAuditLog("dev-vm-03"), ctx); err == nil {
+		t.Errorf("FAILED: delete of an unknown VM succeeded\n")
+	}
+}
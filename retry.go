@@ -0,0 +1,97 @@
+package gcedns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Retry policy shared by all Google API calls
+type retryPolicy struct {
+	MaxAttempts int
+	Initial     time.Duration
+	Max         time.Duration
+	// Overall deadline across all attempts of a call
+	Timeout time.Duration
+	Jitter  float64
+}
+
+var apiRetryPolicy = retryPolicy{
+	MaxAttempts: envInt("DNS_API_MAX_ATTEMPTS", 5),
+	Initial:     500 * time.Millisecond,
+	Max:         16 * time.Second,
+	Timeout:     envSeconds("DNS_API_TIMEOUT", 60),
+	Jitter:      0.5,
+}
+
+func envInt(name string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(name)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+func apiRetryCount(method string) int {
+	return int(apiRetries.value(method))
+}
+
+// 429 and 5xx, plus network timeouts
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *googleapi.Error:
+		return e.Code == http.StatusTooManyRequests || e.Code >= 500
+	case net.Error:
+		return e.Timeout()
+	}
+	return false
+}
+
+// 412 precondition failures too, only when fn re-reads what it sends
+func rebuildRetryable(err error) bool {
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusPreconditionFailed {
+		return true
+	}
+	return retryable(err)
+}
+
+// Calls fn until it succeeds, fails with a non retryable error, or the retry policy is exhausted.
+// A 412 isn't retried, fn would resend the body built from the stale read.
+func withRetry(ctx context.Context, method string, fn func() error) error {
+	return retryCalls(ctx, method, fn, retryable)
+}
+
+// Like withRetry, also retrying 412s, for fn that re-reads and rebuilds its request on each call
+func withRebuildRetry(ctx context.Context, method string, fn func() error) error {
+	return retryCalls(ctx, method, fn, rebuildRetryable)
+}
+
+func retryCalls(ctx context.Context, method string, fn func() error, retryable func(error) bool) (err error) {
+	policy := apiRetryPolicy
+	b := &backoff{Initial: policy.Initial, Max: policy.Max, Deadline: time.Now().Add(policy.Timeout), Jitter: policy.Jitter}
+
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		apiErrorsTotal.inc(method, errorCode(err))
+		if !retryable(err) {
+			return err
+		}
+		if attempt >= policy.MaxAttempts {
+			return fmt.Errorf("%v failed after %d attempts: %w", method, attempt, err)
+		}
+
+		apiRetries.inc(method)
+		fmt.Printf("%v attempt %d failed, retrying: %v\n", method, attempt, err)
+
+		if !b.Wait(ctx) {
+			return fmt.Errorf("%v failed, retry deadline exceeded after %d attempts: %w", method, attempt, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package gcedns
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestWithRetry(t *testing.T) {
+
+	apiRetryPolicy = retryPolicy{MaxAttempts: 3, Initial: time.Millisecond, Max: 4 * time.Millisecond, Timeout: time.Second, Jitter: 0.5}
+
+	test_data := []struct {
+		method   string
+		errs     []error
+		attempts int
+		success  bool
+		rebuild  bool
+	}{
+		{"test.transient", []error{&googleapi.Error{Code: 503}, &googleapi.Error{Code: 429}, nil}, 3, true, false},
+		{"test.precondition", []error{&googleapi.Error{Code: 412}}, 1, false, false},
+		{"test.rebuild", []error{&googleapi.Error{Code: 412}, nil}, 2, true, true},
+		{"test.notfound", []error{&googleapi.Error{Code: 404}}, 1, false, false},
+		{"test.other", []error{errors.New("bad request")}, 1, false, false},
+		{"test.exhausted", []error{&googleapi.Error{Code: 500}, &googleapi.Error{Code: 500}, &googleapi.Error{Code: 500}}, 3, false, false},
+	}
+
+	for _, data := range test_data {
+		attempts := 0
+		call := withRetry
+		if data.rebuild {
+			call = withRebuildRetry
+		}
+		err := call(context.Background(), data.method, func() error {
+			attempts++
+			return data.errs[attempts-1]
+		})
+		if attempts != data.attempts || (err == nil) != data.success {
+			t.Errorf("FAILED: %v: got %d attempts, err %v expected %d attempts\n", data.method, attempts, err, data.attempts)
+		}
+		if retries := apiRetryCount(data.method); retries != data.attempts-1 && data.success {
+			t.Errorf("FAILED: %v: got %d retries counted expected %d\n", data.method, retries, data.attempts-1)
+		}
+	}
+}
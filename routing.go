@@ -0,0 +1,201 @@
+package gcedns
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/* Cloud DNS routing policies for multi-region groups
+https://cloud.google.com/dns/docs/reference/v1/resourceRecordSets#resource
+Group members set dns_routing_policy=wrr|geo. geo keeps an item per VM region holding
+the region's member IPs, wrr keeps an item per member weighted by its dns_weight label.
+*/
+
+const (
+	routingWRR = "wrr"
+	routingGeo = "geo"
+)
+
+type rrsetRoutingPolicy struct {
+	Wrr *wrrPolicy `json:"wrr,omitempty"`
+	Geo *geoPolicy `json:"geo,omitempty"`
+}
+
+type wrrPolicy struct {
+	Items []wrrPolicyItem `json:"items"`
+}
+
+type wrrPolicyItem struct {
+	Weight  float64  `json:"weight"`
+	Rrdatas []string `json:"rrdatas"`
+}
+
+type geoPolicy struct {
+	Items []geoPolicyItem `json:"items"`
+}
+
+type geoPolicyItem struct {
+	Location string   `json:"location"`
+	Rrdatas  []string `json:"rrdatas"`
+}
+
+// Routing policy requested through the VM labels, empty for a flat rrdatas list
+func vmRoutingPolicy(vm_info VMInfo) (policy string, weight float64) {
+	policy = vm_info.Labels["dns_routing_policy"]
+	if policy != routingWRR && policy != routingGeo {
+		if policy != "" {
+			fmt.Printf("Unknown dns_routing_policy %q on %q, using a flat record\n", policy, vm_info.Name)
+		}
+		return "", 0
+	}
+
+	weight = 1
+	if vm_info.Labels["dns_weight"] != "" {
+		w, err := strconv.ParseFloat(vm_info.Labels["dns_weight"], 64)
+		if err != nil || w < 0 {
+			fmt.Printf("Invalid dns_weight %q on %q, using 1\n", vm_info.Labels["dns_weight"], vm_info.Name)
+		} else {
+			weight = w
+		}
+	}
+	return policy, weight
+}
+
+// Helper func to get the region out of a zone, ex: us-central1-a -> us-central1
+func zoneRegion(zone string) string {
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+// Adds a member IP to the routing policy, returns false if it's already part of it
+func addRoutingMember(policy *rrsetRoutingPolicy, policyType, region string, weight float64, ip string) bool {
+	switch policyType {
+	case routingGeo:
+		if policy.Geo == nil {
+			policy.Geo = &geoPolicy{}
+		}
+		for i, item := range policy.Geo.Items {
+			if item.Location == region {
+				if ipsOverlap(item.Rrdatas, []string{ip}) {
+					return false
+				}
+				policy.Geo.Items[i].Rrdatas = append(item.Rrdatas, ip)
+				return true
+			}
+		}
+		policy.Geo.Items = append(policy.Geo.Items, geoPolicyItem{Location: region, Rrdatas: []string{ip}})
+	case routingWRR:
+		if policy.Wrr == nil {
+			policy.Wrr = &wrrPolicy{}
+		}
+		for _, item := range policy.Wrr.Items {
+			if ipsOverlap(item.Rrdatas, []string{ip}) {
+				return false
+			}
+		}
+		policy.Wrr.Items = append(policy.Wrr.Items, wrrPolicyItem{Weight: weight, Rrdatas: []string{ip}})
+	}
+	return true
+}
+
+// Removes a member IP from the routing policy, items left without IPs are dropped
+func removeRoutingMember(policy *rrsetRoutingPolicy, ip string) (removed bool) {
+	if policy.Geo != nil {
+		var items []geoPolicyItem
+		for _, item := range policy.Geo.Items {
+			remaining_ips := ipDeleteChecker(item.Rrdatas, []string{ip})
+			removed = removed || len(remaining_ips) != len(item.Rrdatas)
+			if len(remaining_ips) > 0 {
+				item.Rrdatas = remaining_ips
+				items = append(items, item)
+			}
+		}
+		policy.Geo.Items = items
+	}
+	if policy.Wrr != nil {
+		var items []wrrPolicyItem
+		for _, item := range policy.Wrr.Items {
+			remaining_ips := ipDeleteChecker(item.Rrdatas, []string{ip})
+			removed = removed || len(remaining_ips) != len(item.Rrdatas)
+			if len(remaining_ips) > 0 {
+				item.Rrdatas = remaining_ips
+				items = append(items, item)
+			}
+		}
+		policy.Wrr.Items = items
+	}
+	return removed
+}
+
+// geo or wrr, empty when the policy has no items
+func routingPolicyType(policy *rrsetRoutingPolicy) string {
+	switch {
+	case policy == nil:
+		return ""
+	case policy.Geo != nil && len(policy.Geo.Items) > 0:
+		return routingGeo
+	case policy.Wrr != nil && len(policy.Wrr.Items) > 0:
+		return routingWRR
+	}
+	return ""
+}
+
+func routingPolicyEmpty(policy *rrsetRoutingPolicy) bool {
+	return (policy.Geo == nil || len(policy.Geo.Items) == 0) && (policy.Wrr == nil || len(policy.Wrr.Items) == 0)
+}
+
+// Adds or removes a group member to/from the routing policy based recordSet
+func routedGroupManagement(ctx context.Context, dnsInfo DnsInfo, target dnsTarget, dns_name, member_ip string) (result dnsResult) {
+	result = dnsResult{FQDN: dns_name}
+
+	record, exists, err := getRecordSet(ctx, target.HostProject, target.Zone, dns_name, "A")
+	if err != nil {
+		return lookupFailed(result, err)
+	} else if exists && record.RoutingPolicy == nil {
+		result.Status, result.Code, result.Reason = dnsDenied, denyConflict, fmt.Sprintf("record exists without a routing policy: %v", record.Rrdatas)
+		return
+	}
+
+	// Cloud DNS takes a single policy type per recordSet
+	if current := routingPolicyType(record.RoutingPolicy); exists && dnsInfo.Action == "create" && current != "" && current != dnsInfo.RoutingPolicy {
+		fmt.Printf("%q has a %v routing policy, %v member %q rejected\n", dns_name, current, dnsInfo.RoutingPolicy, dnsInfo.VMName)
+		result.Status, result.Code, result.Reason = dnsDenied, denyRoutingPolicy, fmt.Sprintf("record has a %v routing policy, %v requested", current, dnsInfo.RoutingPolicy)
+		return
+	}
+
+	txn := &dnsTransaction{}
+	updated := record.clone()
+	status := dnsUpdated
+
+	if dnsInfo.Action == "create" {
+		if !exists {
+			updated = rrset{Name: dns_name, Type: "A", TTL: 60, RoutingPolicy: &rrsetRoutingPolicy{}}
+			addRoutingMember(updated.RoutingPolicy, dnsInfo.RoutingPolicy, dnsInfo.Region, dnsInfo.Weight, member_ip)
+			txn.add(target.HostProject, target.Zone, updated)
+			status = dnsCreated
+		} else if addRoutingMember(updated.RoutingPolicy, dnsInfo.RoutingPolicy, dnsInfo.Region, dnsInfo.Weight, member_ip) {
+			txn.replace(target.HostProject, target.Zone, record, updated)
+		}
+	} else if dnsInfo.Action == "delete" && exists && removeRoutingMember(updated.RoutingPolicy, member_ip) {
+		if routingPolicyEmpty(updated.RoutingPolicy) {
+			// Last member left the group
+			txn.remove(target.HostProject, target.Zone, record)
+			status = dnsDeleted
+		} else {
+			txn.replace(target.HostProject, target.Zone, record, updated)
+		}
+	}
+
+	if txn.empty() {
+		result.Status = dnsUnchanged
+		return
+	}
+	if result.Status, err = txn.commit(ctx, status); err != nil {
+		result.Reason, result.Err = err.Error(), err
+	}
+	return result
+}
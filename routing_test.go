@@ -0,0 +1,109 @@
+package gcedns
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGeoRoutingMembers(t *testing.T) {
+
+	policy := &rrsetRoutingPolicy{}
+	addRoutingMember(policy, routingGeo, "us-central1", 1, "10.0.0.2")
+	addRoutingMember(policy, routingGeo, "us-central1", 1, "10.0.0.3")
+	addRoutingMember(policy, routingGeo, "europe-west1", 1, "10.1.0.2")
+
+	if addRoutingMember(policy, routingGeo, "us-central1", 1, "10.0.0.2") {
+		t.Errorf("FAILED: existing member was added again\n")
+	}
+
+	expected := []geoPolicyItem{
+		{Location: "us-central1", Rrdatas: []string{"10.0.0.2", "10.0.0.3"}},
+		{Location: "europe-west1", Rrdatas: []string{"10.1.0.2"}},
+	}
+	if !reflect.DeepEqual(policy.Geo.Items, expected) {
+		t.Errorf("FAILED: got %v expected %v\n", policy.Geo.Items, expected)
+	}
+
+	// Region item is dropped with its last member
+	if !removeRoutingMember(policy, "10.1.0.2") || len(policy.Geo.Items) != 1 {
+		t.Errorf("FAILED: got %v after removing the last europe-west1 member\n", policy.Geo.Items)
+	}
+	removeRoutingMember(policy, "10.0.0.2")
+	removeRoutingMember(policy, "10.0.0.3")
+	if !routingPolicyEmpty(policy) {
+		t.Errorf("FAILED: got %v expected an empty policy\n", policy.Geo.Items)
+	}
+}
+
+func TestWRRRoutingMembers(t *testing.T) {
+
+	policy := &rrsetRoutingPolicy{}
+	addRoutingMember(policy, routingWRR, "us-central1", 3, "10.0.0.2")
+	addRoutingMember(policy, routingWRR, "europe-west1", 1, "10.1.0.2")
+
+	expected := []wrrPolicyItem{
+		{Weight: 3, Rrdatas: []string{"10.0.0.2"}},
+		{Weight: 1, Rrdatas: []string{"10.1.0.2"}},
+	}
+	if !reflect.DeepEqual(policy.Wrr.Items, expected) {
+		t.Errorf("FAILED: got %v expected %v\n", policy.Wrr.Items, expected)
+	}
+
+	if removeRoutingMember(policy, "10.9.9.9") {
+		t.Errorf("FAILED: unknown member was removed\n")
+	}
+}
+
+func TestVMRoutingPolicy(t *testing.T) {
+
+	test_data := []struct {
+		labels map[string]string
+		policy string
+		weight float64
+	}{
+		{map[string]string{"dns_routing_policy": "wrr", "dns_weight": "5"}, routingWRR, 5},
+		{map[string]string{"dns_routing_policy": "wrr", "dns_weight": "heavy"}, routingWRR, 1},
+		{map[string]string{"dns_routing_policy": "geo"}, routingGeo, 1},
+		{map[string]string{"dns_routing_policy": "failover"}, "", 0},
+		{map[string]string{}, "", 0},
+	}
+
+	for _, data := range test_data {
+		policy, weight := vmRoutingPolicy(VMInfo{Labels: data.labels})
+		if policy != data.policy || weight != data.weight {
+			t.Errorf("FAILED: %v: got %v/%v expected %v/%v\n", data.labels, policy, weight, data.policy, data.weight)
+		}
+	}
+
+	if region := zoneRegion("us-central1-a"); region != "us-central1" {
+		t.Errorf("FAILED: got %v expected us-central1\n", region)
+	}
+}
+
+func TestRoutingPolicyMismatch(t *testing.T) {
+	setupTestDns(t)
+	ctx := context.Background()
+	member := func(policy, vm, ip string) dnsResult {
+		return groupManagement(ctx, DnsInfo{DnsHostName: "devserver-pool", Action: "create", IPs: []string{ip}, VMName: vm, VMProject: "prj-dev-4328",
+			RoutingPolicy: policy, Region: "us-central1", Weight: 1})
+	}
+
+	if result := member(routingGeo, "vm-1", "10.0.0.5"); result.Status != dnsCreated {
+		t.Fatalf("FAILED: got %v expected %v\n", result, dnsCreated)
+	}
+	if result := member(routingWRR, "vm-2", "10.0.0.6"); result.Status != dnsDenied || !strings.Contains(result.Reason, "geo routing policy") {
+		t.Errorf("FAILED: got %v expected the wrr member denied\n", result)
+	}
+	record, _, _ := getRecordSet(ctx, "prj-c-dnshub", "default-zone", "devserver-pool.gcp.company.com.", "A")
+	if record.RoutingPolicy.Wrr != nil || len(record.RoutingPolicy.Geo.Items[0].Rrdatas) != 1 {
+		t.Errorf("FAILED: got %+v\n", record.RoutingPolicy)
+	}
+
+	// Rejected like Cloud DNS does
+	both := rrset{Name: "qa.gcp.company.com.", Type: "A", TTL: 60, RoutingPolicy: &rrsetRoutingPolicy{Geo: &geoPolicy{}, Wrr: &wrrPolicy{}}}
+	if _, err := dnsAPI.createChange(ctx, "prj-c-dnshub", "default-zone", rrChange{Additions: []rrset{both}}); err == nil {
+		t.Errorf("FAILED: recordSet with both policies accepted\n")
+	}
+}
@@ -0,0 +1,96 @@
+package gcedns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+/* Event sequencing
+A delete can be processed before, or concurrently with, its create (retries, separate
+invocations). The last applied event of each instance and record name is kept with its
+audit log timestamp, and older events are dropped:
+- instance: any event older than the last applied one
+- name: a create older than the last delete, or a delete older than the last create,
+  e.g. a late delete of a VM whose name was since reused by a new VM.
+  Older creates on a shared name, e.g. MIG members joining, are still applied.
+DNS_STATE_STORE selects the store, with the same values as DNS_DEDUP_STORE.
+*/
+
+// Last applied event of an instance or record name
+type eventState struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Action     string    `json:"action"`
+	InstanceID string    `json:"instance_id"`
+	VMName     string    `json:"vm_name,omitempty"`
+	VMProject  string    `json:"vm_project,omitempty"`
+	// Group record the instance joined, found again on delete once the VM is gone
+	Group string `json:"group,omitempty"`
+}
+
+var eventStates = newEventStore("DNS_STATE_STORE")
+
+func instanceStateKey(instance_id string) string {
+	return "instance/" + instance_id
+}
+
+func nameStateKey(fqdn string) string {
+	return "name/" + fqdn
+}
+
+func loadEventState(ctx context.Context, key string) (state eventState, seen bool) {
+	if eventStates == nil || key == "" {
+		return state, false
+	}
+	value, seen, err := eventStates.get(ctx, key)
+	if err != nil {
+		fmt.Printf("Error reading the state of %v: %v\n", key, err)
+		return state, false
+	} else if !seen {
+		return state, false
+	}
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		fmt.Printf("Invalid state of %v: %v\n", key, err)
+		return state, false
+	}
+	return state, true
+}
+
+// Reason the event must be dropped, empty when it's current
+func staleEvent(ctx context.Context, event eventState, instanceKey, nameKey string) string {
+	if event.Timestamp.IsZero() {
+		return ""
+	}
+	if last, seen := loadEventState(ctx, instanceKey); seen && event.Timestamp.Before(last.Timestamp) {
+		return fmt.Sprintf("older than the instance's %v at %v", last.Action, last.Timestamp.Format(time.RFC3339))
+	}
+	if last, seen := loadEventState(ctx, nameKey); seen && event.Timestamp.Before(last.Timestamp) &&
+		(event.Action != last.Action || event.InstanceID == last.InstanceID) {
+		return fmt.Sprintf("older than the %v by %v at %v", last.Action, last.VMName, last.Timestamp.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// Records the event as the last applied one, unless a newer event was recorded meanwhile
+func recordEventState(ctx context.Context, event eventState, keys ...string) {
+	if eventStates == nil || event.Timestamp.IsZero() {
+		return
+	}
+	value, _ := json.Marshal(event)
+
+	recorded := make(map[string]bool)
+	for _, key := range keys {
+		if key == "" || recorded[key] {
+			continue
+		}
+		recorded[key] = true
+		unlock := recordLocks.lock("state/" + key)
+		if last, seen := loadEventState(ctx, key); !seen || !event.Timestamp.Before(last.Timestamp) {
+			if err := eventStates.put(ctx, key, string(value)); err != nil {
+				fmt.Printf("Error recording the state of %v: %v\n", key, err)
+			}
+		}
+		unlock()
+	}
+}
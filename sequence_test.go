@@ -0,0 +1,76 @@
+package gcedns
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaleEvents(t *testing.T) {
+	eventStates = newMemoryDedup(100)
+	defer func() { eventStates = newEventStore("DNS_STATE_STORE") }()
+
+	ctx := context.Background()
+	t1 := time.Date(2021, 7, 10, 10, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+
+	// vm-a deleted at t2, its name reused by vm-b created at t2
+	recordEventState(ctx, eventState{Timestamp: t2, Action: "delete", InstanceID: "111", VMName: "vm-a"}, instanceStateKey("111"))
+	recordEventState(ctx, eventState{Timestamp: t2, Action: "create", InstanceID: "222", VMName: "vm-b"}, instanceStateKey("222"), nameStateKey("dev01.gcp.company.com."))
+
+	test_data := []struct {
+		event eventState
+		key   string
+		stale bool
+	}{
+		// Create retried after the delete
+		{eventState{Timestamp: t1, Action: "create", InstanceID: "111"}, instanceStateKey("111"), true},
+		// Late delete of the name's previous owner
+		{eventState{Timestamp: t1, Action: "delete", InstanceID: "333"}, nameStateKey("dev01.gcp.company.com."), true},
+		// Another member joining a shared name
+		{eventState{Timestamp: t1, Action: "create", InstanceID: "333"}, nameStateKey("dev01.gcp.company.com."), false},
+		{eventState{Timestamp: t2.Add(time.Minute), Action: "delete", InstanceID: "222"}, nameStateKey("dev01.gcp.company.com."), false},
+		// No timestamp, no sequencing
+		{eventState{Action: "create", InstanceID: "111"}, instanceStateKey("111"), false},
+	}
+	for _, data := range test_data {
+		var reason string
+		if strings.HasPrefix(data.key, "instance/") {
+			reason = staleEvent(ctx, data.event, data.key, "")
+		} else {
+			reason = staleEvent(ctx, data.event, "", data.key)
+		}
+		if (reason != "") != data.stale {
+			t.Errorf("FAILED: %+v on %v: got %q expected stale %v\n", data.event, data.key, reason, data.stale)
+		}
+	}
+
+	// An older event doesn't overwrite the state
+	recordEventState(ctx, eventState{Timestamp: t1, Action: "create", InstanceID: "111"}, instanceStateKey("111"))
+	if last, _ := loadEventState(ctx, instanceStateKey("111")); last.Action != "delete" {
+		t.Errorf("FAILED: got %v expected the delete to stay\n", last.Action)
+	}
+}
+
+func TestStaleInsertDropped(t *testing.T) {
+	eventStates = newMemoryDedup(100)
+	defer func() { eventStates = newEventStore("DNS_STATE_STORE") }()
+
+	log_entry := map[string]interface{}{}
+	json.Unmarshal(insertAuditLog(`[{"key": "dns_host_name", "value": "devserver01"}]`), &log_entry)
+	log_entry["timestamp"] = "2021-07-10T10:00:00Z"
+	data, _ := json.Marshal(log_entry)
+
+	recordEventState(context.Background(), eventState{Timestamp: time.Date(2021, 7, 10, 10, 5, 0, 0, time.UTC), Action: "delete", InstanceID: "123"}, instanceStateKey("123"))
+
+	start := time.Now()
+	result, err := gceEventCheckOperation(data, context.Background())
+	if err != nil || !strings.Contains(result, "stale, dropped") {
+		t.Errorf("FAILED: got %v, %v expected a dropped event\n", result, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("FAILED: stale event took %v\n", elapsed)
+	}
+}
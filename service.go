@@ -0,0 +1,182 @@
+package gcedns
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/api/pubsub/v1"
+)
+
+/* Service mode
+Runs the event processing as a long running process pulling from the log sink's
+subscription, see cmd/gcedns. Concurrent events are coalesced into batched changes.
+*/
+
+// Messages pulled and processed concurrently
+var pullSize = envInt("DNS_PULL_SIZE", 100)
+
+// Serve processes the events of a Pub/Sub subscription, projects/PROJECT/subscriptions/NAME, until ctx is done
+func Serve(ctx context.Context, subscription string) error {
+	ps, err := pubsub.NewService(ctx)
+	if err != nil {
+		return err
+	}
+
+	if metricsAddr != "" {
+		if err := serveMetrics(ctx, metricsAddr); err != nil {
+			return err
+		}
+	}
+
+	batcher = newCoalescer(batchWindow, batchSize)
+	go batcher.run(ctx)
+	defer shutdownTracing()
+
+	pending := &pendingMessages{ackIDs: make(map[string]bool)}
+	go pending.extend(ctx, ps, subscription)
+
+	// A slot per message in flight, pulls only wait for a free slot, not for the previous pull
+	slots := make(chan struct{}, pullSize)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for ctx.Err() == nil {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+		free := pullSize - len(slots) + 1
+
+		var pulled *pubsub.PullResponse
+		err := withRetry(ctx, "pubsub.subscriptions.pull", func() (err error) {
+			pulled, err = ps.Projects.Subscriptions.Pull(subscription, &pubsub.PullRequest{MaxMessages: int64(free)}).Context(ctx).Do()
+			return err
+		})
+		if ctx.Err() != nil {
+			<-slots
+			break
+		} else if err != nil {
+			<-slots
+			return err
+		}
+		if len(pulled.ReceivedMessages) == 0 {
+			<-slots
+			continue
+		}
+
+		var ack_ids []string
+		for _, received := range pulled.ReceivedMessages {
+			ack_ids = append(ack_ids, received.AckId)
+		}
+		pending.add(ack_ids...)
+		// The subscription's deadline may be shorter than the first extension
+		pending.modify(ctx, ps, subscription, ack_ids, ackExtension)
+
+		for i, received := range pulled.ReceivedMessages {
+			if i > 0 {
+				slots <- struct{}{}
+			}
+			wg.Add(1)
+			go func(received *pubsub.ReceivedMessage) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				processMessage(ctx, ps, subscription, pending, received)
+			}(received)
+		}
+	}
+	return nil
+}
+
+func processMessage(ctx context.Context, ps *pubsub.Service, subscription string, pending *pendingMessages, received *pubsub.ReceivedMessage) {
+	data, err := base64.StdEncoding.DecodeString(received.Message.Data)
+	if err == nil {
+		publish_time, _ := time.Parse(time.RFC3339Nano, received.Message.PublishTime)
+		err = PubSubMsgReader(ctx, PubSubMessage{
+			Data:        data,
+			Attributes:  received.Message.Attributes,
+			MessageID:   received.Message.MessageId,
+			PublishTime: publish_time,
+		})
+	}
+	pending.remove(received.AckId)
+
+	if err != nil {
+		fmt.Printf("Error processing message %v: %v\n", received.Message.MessageId, err)
+		// Redelivered right away
+		pending.modify(ctx, ps, subscription, []string{received.AckId}, 0)
+		return
+	}
+	err = withRetry(ctx, "pubsub.subscriptions.acknowledge", func() error {
+		_, err := ps.Projects.Subscriptions.Acknowledge(subscription, &pubsub.AcknowledgeRequest{AckIds: []string{received.AckId}}).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Error acknowledging message %v: %v\n", received.Message.MessageId, err)
+	}
+}
+
+// Ack deadline of messages in flight, extended every half of it. Readiness and insert
+// operation waits outlast the subscription's ack deadline.
+const ackExtension = 60
+
+// Ack IDs of the messages in flight
+type pendingMessages struct {
+	sync.Mutex
+	ackIDs map[string]bool
+}
+
+func (p *pendingMessages) add(ack_ids ...string) {
+	p.Lock()
+	defer p.Unlock()
+	for _, ack_id := range ack_ids {
+		p.ackIDs[ack_id] = true
+	}
+}
+
+func (p *pendingMessages) remove(ack_id string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.ackIDs, ack_id)
+}
+
+func (p *pendingMessages) list() (ack_ids []string) {
+	p.Lock()
+	defer p.Unlock()
+	for ack_id := range p.ackIDs {
+		ack_ids = append(ack_ids, ack_id)
+	}
+	return ack_ids
+}
+
+// Extends the ack deadline of the messages in flight until ctx is done
+func (p *pendingMessages) extend(ctx context.Context, ps *pubsub.Service, subscription string) {
+	ticker := time.NewTicker(ackExtension * time.Second / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if ack_ids := p.list(); len(ack_ids) > 0 {
+				p.modify(ctx, ps, subscription, ack_ids, ackExtension)
+			}
+		}
+	}
+}
+
+// Sets the ack deadline of the messages, 0 nacks them
+func (p *pendingMessages) modify(ctx context.Context, ps *pubsub.Service, subscription string, ack_ids []string, seconds int64) {
+	err := withRetry(ctx, "pubsub.subscriptions.modifyAckDeadline", func() error {
+		_, err := ps.Projects.Subscriptions.ModifyAckDeadline(subscription, &pubsub.ModifyAckDeadlineRequest{AckIds: ack_ids, AckDeadlineSeconds: seconds}).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Error setting the ack deadline of %v messages to %vs: %v\n", len(ack_ids), seconds, err)
+	}
+}
@@ -0,0 +1,474 @@
+package gcedns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+)
+
+/* Zone snapshots
+The managed recordSets of a zone, A and CNAME records whose name is in the allow list and PTRs
+pointing to one, are saved to DNS_SNAPSHOT_DIR before each change to the zone, and by the
+snapshot command, ex: from a Cloud Scheduler job. DNS_SNAPSHOT_DIR is a local directory or
+gs://BUCKET/PREFIX, snapshots are PROJECT/ZONE/ID.json with the UTC time as ID so they sort by age.
+The rollback command restores a zone's managed records to a snapshot in a single change.
+A snapshot lists the whole zone, every page of it, so snapshots before changes are taken at
+most once per zone every DNS_SNAPSHOT_INTERVAL seconds, per instance.
+*/
+
+var (
+	snapshotDir = os.Getenv("DNS_SNAPSHOT_DIR")
+	// Built once, its Cloud Storage client is reused across changes
+	snapshots = newSnapshotStore(snapshotDir)
+	// Min time between the snapshots of a zone before changes, 0 snapshots each change
+	snapshotInterval = envSeconds("DNS_SNAPSHOT_INTERVAL", 300)
+	lastSnapshots    = struct {
+		sync.Mutex
+		times map[string]time.Time
+	}{times: make(map[string]time.Time)}
+)
+
+// IDs sort by time
+const snapshotIDFormat = "20060102T150405.000000000Z"
+
+type zoneSnapshot struct {
+	ID      string    `json:"id"`
+	Project string    `json:"project"`
+	Zone    string    `json:"zone"`
+	Time    time.Time `json:"time"`
+	Records []rrset   `json:"records"`
+}
+
+type snapshotStore interface {
+	save(ctx context.Context, snapshot zoneSnapshot) error
+	// Snapshot IDs of the zone, oldest first
+	list(ctx context.Context, project, zone string) ([]string, error)
+	load(ctx context.Context, project, zone, id string) (zoneSnapshot, error)
+}
+
+func newSnapshotStore(dir string) snapshotStore {
+	if strings.HasPrefix(dir, "gs://") {
+		location := strings.SplitN(strings.TrimPrefix(dir, "gs://"), "/", 2)
+		store := &gcsSnapshots{Bucket: location[0]}
+		if len(location) == 2 {
+			store.Prefix = strings.Trim(location[1], "/")
+		}
+		return store
+	}
+	return localSnapshots{Dir: dir}
+}
+
+// Managed recordSets of the zone, sorted by name and type
+func managedRecords(ctx context.Context, project, zone string) ([]rrset, error) {
+	allow_list, err := loadAllowList()
+	if err != nil {
+		return nil, err
+	}
+	ctx, span := startSpan(ctx, "dns.resourceRecordSets.list", "project", project, "zone", zone)
+	records, err := dnsAPI.listRecordSets(ctx, project, zone, "", "")
+	span.end(err)
+	if err != nil {
+		return nil, err
+	}
+
+	var managed []rrset
+	for _, record := range records {
+		if len(recordOwners(record, allow_list)) > 0 {
+			managed = append(managed, record)
+		}
+	}
+	sortRecords(managed)
+	return managed, nil
+}
+
+func sortRecords(records []rrset) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Name != records[j].Name {
+			return records[i].Name < records[j].Name
+		}
+		return records[i].Type < records[j].Type
+	})
+}
+
+func takeSnapshot(ctx context.Context, store snapshotStore, project, zone string) (snapshot zoneSnapshot, err error) {
+	records, err := managedRecords(ctx, project, zone)
+	if err != nil {
+		return snapshot, err
+	}
+	now := time.Now().UTC()
+	snapshot = zoneSnapshot{ID: now.Format(snapshotIDFormat), Project: project, Zone: zone, Time: now, Records: records}
+	if snapshot.Records == nil {
+		snapshot.Records = []rrset{}
+	}
+	return snapshot, store.save(ctx, snapshot)
+}
+
+// Claims the zone's snapshot of the current window, false if it was taken already
+func snapshotDue(project, zone string) bool {
+	lastSnapshots.Lock()
+	defer lastSnapshots.Unlock()
+	key := project + "/" + zone
+	if last, taken := lastSnapshots.times[key]; taken && time.Since(last) < snapshotInterval {
+		return false
+	}
+	lastSnapshots.times[key] = time.Now()
+	return true
+}
+
+// Snapshot of the zone about to be changed, unless one was taken in the last snapshotInterval.
+// A failed snapshot doesn't hold the change back, the next change takes it.
+func snapshotBeforeChange(ctx context.Context, project, zone string) {
+	if snapshotDir == "" || dryRun || !snapshotDue(project, zone) {
+		return
+	}
+	snapshot, err := takeSnapshot(ctx, snapshots, project, zone)
+	if err != nil {
+		fmt.Printf("Error taking a snapshot of %v/%v: %v\n", project, zone, err)
+		lastSnapshots.Lock()
+		delete(lastSnapshots.times, project+"/"+zone)
+		lastSnapshots.Unlock()
+	} else if debug != "" {
+		fmt.Printf("Snapshot %v of %v/%v: %v records\n", snapshot.ID, project, zone, len(snapshot.Records))
+	}
+}
+
+// Zones records are written to: the default zones and the zones granted in the DNS policy
+func managedZones() ([]string, error) {
+	zones := []string{defaultDnsHostProject + "/" + defaultDnsZone, defaultPTRHostProject + "/" + defaultPTRZone}
+	policy, err := loadDnsPolicy()
+	if err != nil {
+		return nil, err
+	}
+	for _, grants := range policy.Zones {
+		for _, grant := range grants {
+			// Zones of "*" grants are only known once written to
+			if grant.Zone != "*" {
+				zones = append(zones, grant.HostProject+"/"+grant.Zone)
+			}
+		}
+	}
+
+	sort.Strings(zones)
+	var unique []string
+	for i, zone := range zones {
+		if i == 0 || zone != zones[i-1] {
+			unique = append(unique, zone)
+		}
+	}
+	return unique, nil
+}
+
+func splitZone(zone string) (project, name string, err error) {
+	parts := strings.Split(zone, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid zone %q, expected PROJECT/ZONE", zone)
+	}
+	return parts[0], parts[1], nil
+}
+
+// SnapshotZones saves the managed records of the zones (PROJECT/ZONE) to dir,
+// of the default and policy zones when none are given
+func SnapshotZones(ctx context.Context, dir string, zones []string) error {
+	if dir == "" {
+		return fmt.Errorf("no snapshot directory, set DNS_SNAPSHOT_DIR")
+	}
+	if len(zones) == 0 {
+		var err error
+		if zones, err = managedZones(); err != nil {
+			return err
+		}
+	}
+
+	store := newSnapshotStore(dir)
+	failed := 0
+	for _, zone := range zones {
+		project, name, err := splitZone(zone)
+		if err == nil {
+			var snapshot zoneSnapshot
+			if snapshot, err = takeSnapshot(ctx, store, project, name); err == nil {
+				fmt.Printf("Snapshot %v of %v: %v records\n", snapshot.ID, zone, len(snapshot.Records))
+				continue
+			}
+		}
+		fmt.Printf("Error taking a snapshot of %v: %v\n", zone, err)
+		failed++
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v of %v snapshots failed", failed, len(zones))
+	}
+	return nil
+}
+
+// Change restoring the snapshot's records: managed records not in the snapshot are deleted,
+// records differing from the snapshot are replaced and missing ones added.
+// current is the whole zone, a record of the snapshot may no longer be managed.
+func restoreChange(current []rrset, snapshot []rrset, allow_list map[string]string) (change rrChange) {
+	key := func(record rrset) string { return record.Name + " " + record.Type }
+	existing := make(map[string]rrset)
+	for _, record := range current {
+		existing[key(record)] = record
+	}
+	wanted := make(map[string]rrset)
+	for _, record := range snapshot {
+		wanted[key(record)] = record
+	}
+
+	for k, record := range existing {
+		target, restored := wanted[k]
+		if restored && sameRecord(record, target) {
+			continue
+		}
+		if restored || len(recordOwners(record, allow_list)) > 0 {
+			change.Deletions = append(change.Deletions, record)
+		}
+	}
+	for k, target := range wanted {
+		if record, exists := existing[k]; !exists || !sameRecord(record, target) {
+			change.Additions = append(change.Additions, target)
+		}
+	}
+	sortRecords(change.Deletions)
+	sortRecords(change.Additions)
+	return change
+}
+
+func sameRecord(a, b rrset) bool {
+	if a.TTL != b.TTL || !reflect.DeepEqual(a.RoutingPolicy, b.RoutingPolicy) || len(a.Rrdatas) != len(b.Rrdatas) {
+		return false
+	}
+	a_data := append([]string{}, a.Rrdatas...)
+	b_data := append([]string{}, b.Rrdatas...)
+	sort.Strings(a_data)
+	sort.Strings(b_data)
+	return reflect.DeepEqual(a_data, b_data)
+}
+
+func formatRecord(record rrset) string {
+	data := strings.Join(record.Rrdatas, " ")
+	if record.RoutingPolicy != nil {
+		policy, _ := json.Marshal(record.RoutingPolicy)
+		data = string(policy)
+	}
+	return fmt.Sprintf("%v %v %v %v", record.Name, record.TTL, record.Type, data)
+}
+
+// RollbackZone restores the managed records of zone (PROJECT/ZONE) to the snapshot id, or the
+// latest one, in a single change. The diff is printed and only applied with apply.
+// Without an id the zone's snapshots are listed.
+func RollbackZone(ctx context.Context, dir, zone, id string, apply bool) error {
+	if dir == "" {
+		return fmt.Errorf("no snapshot directory, set DNS_SNAPSHOT_DIR")
+	}
+	project, name, err := splitZone(zone)
+	if err != nil {
+		return err
+	}
+	store := newSnapshotStore(dir)
+	ids, err := store.list(ctx, project, name)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("no snapshots of %v in %v", zone, dir)
+	}
+	if id == "" {
+		fmt.Printf("Snapshots of %v, oldest first:\n", zone)
+		for _, snapshot_id := range ids {
+			fmt.Println(snapshot_id)
+		}
+		return nil
+	} else if id == "latest" {
+		id = ids[len(ids)-1]
+	}
+
+	snapshot, err := store.load(ctx, project, name, id)
+	if err != nil {
+		return err
+	}
+	allow_list, err := loadAllowList()
+	if err != nil {
+		return err
+	}
+
+	// Names of the change are locked against events while it's applied
+	var keys []string
+	for _, record := range snapshot.Records {
+		keys = append(keys, recordKey(project, name, record.Name))
+	}
+	current, err := dnsAPI.listRecordSets(ctx, project, name, "", "")
+	if err != nil {
+		return err
+	}
+	change := restoreChange(current, snapshot.Records, allow_list)
+	for _, record := range change.Deletions {
+		keys = append(keys, recordKey(project, name, record.Name))
+	}
+	unlock, err := lockRecords(ctx, keys...)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Events may have changed the zone before the lock
+	if current, err = dnsAPI.listRecordSets(ctx, project, name, "", ""); err != nil {
+		return err
+	}
+	change = restoreChange(current, snapshot.Records, allow_list)
+	if len(change.Additions) == 0 && len(change.Deletions) == 0 {
+		fmt.Printf("%v already matches snapshot %v\n", zone, id)
+		return nil
+	}
+
+	fmt.Printf("Rollback of %v to snapshot %v:\n", zone, id)
+	for _, record := range change.Deletions {
+		fmt.Printf("- %v\n", formatRecord(record))
+	}
+	for _, record := range change.Additions {
+		fmt.Printf("+ %v\n", formatRecord(record))
+	}
+	if !apply {
+		fmt.Println("Dry run, nothing changed")
+		return nil
+	}
+
+	// The rollback can be rolled back too, whatever the snapshot interval
+	if _, err := takeSnapshot(ctx, store, project, name); err != nil {
+		return fmt.Errorf("Error taking a snapshot of %v before the rollback: %v", zone, err)
+	}
+	if err := applyChange(ctx, project, name, change); err != nil {
+		return fmt.Errorf("Error rolling back %v: %v", zone, err)
+	}
+	fmt.Printf("Rolled back %v to snapshot %v: %v deletions, %v additions\n", zone, id, len(change.Deletions), len(change.Additions))
+	return nil
+}
+
+type localSnapshots struct {
+	Dir string
+}
+
+func (l localSnapshots) path(project, zone, id string) string {
+	return filepath.Join(l.Dir, project, zone, id+".json")
+}
+
+func (l localSnapshots) save(ctx context.Context, snapshot zoneSnapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := l.path(snapshot.Project, snapshot.Zone, snapshot.ID)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+func (l localSnapshots) list(ctx context.Context, project, zone string) (ids []string, err error) {
+	files, err := ioutil.ReadDir(filepath.Join(l.Dir, project, zone))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (l localSnapshots) load(ctx context.Context, project, zone, id string) (snapshot zoneSnapshot, err error) {
+	data, err := ioutil.ReadFile(l.path(project, zone, id))
+	if err != nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal(data, &snapshot)
+	return snapshot, err
+}
+
+type gcsSnapshots struct {
+	Bucket string
+	Prefix string
+
+	once    sync.Once
+	service *storage.Service
+	err     error
+}
+
+func (g *gcsSnapshots) storage(ctx context.Context) (*storage.Service, error) {
+	g.once.Do(func() {
+		g.service, g.err = storage.NewService(context.Background())
+	})
+	return g.service, g.err
+}
+
+func (g *gcsSnapshots) object(project, zone, id string) string {
+	return path.Join(g.Prefix, project, zone, id+".json")
+}
+
+func (g *gcsSnapshots) save(ctx context.Context, snapshot zoneSnapshot) error {
+	gcs, err := g.storage(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	object := &storage.Object{Name: g.object(snapshot.Project, snapshot.Zone, snapshot.ID), ContentType: "application/json"}
+	return withRetry(ctx, "storage.objects.insert", func() error {
+		_, err := gcs.Objects.Insert(g.Bucket, object).Media(bytes.NewReader(data)).Context(ctx).Do()
+		return err
+	})
+}
+
+func (g *gcsSnapshots) list(ctx context.Context, project, zone string) (ids []string, err error) {
+	gcs, err := g.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	prefix := g.object(project, zone, "")
+	prefix = strings.TrimSuffix(prefix, ".json")
+	err = gcs.Objects.List(g.Bucket).Prefix(prefix).Pages(ctx, func(objects *storage.Objects) error {
+		for _, object := range objects.Items {
+			id := strings.TrimPrefix(object.Name, prefix)
+			if strings.HasSuffix(id, ".json") && !strings.Contains(id, "/") {
+				ids = append(ids, strings.TrimSuffix(id, ".json"))
+			}
+		}
+		return nil
+	})
+	sort.Strings(ids)
+	return ids, err
+}
+
+func (g *gcsSnapshots) load(ctx context.Context, project, zone, id string) (snapshot zoneSnapshot, err error) {
+	gcs, err := g.storage(ctx)
+	if err != nil {
+		return snapshot, err
+	}
+	resp, err := gcs.Objects.Get(g.Bucket, g.object(project, zone, id)).Context(ctx).Download()
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return snapshot, fmt.Errorf("no snapshot %v of %v/%v", id, project, zone)
+	} else if err != nil {
+		return snapshot, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&snapshot)
+	return snapshot, err
+}
@@ -0,0 +1,110 @@
+package gcedns
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRollback(t *testing.T) {
+	backend := setupTestDns(t)
+	snapshotDir, snapshotInterval = t.TempDir(), 0
+	snapshots = newSnapshotStore(snapshotDir)
+	t.Cleanup(func() {
+		snapshotDir, snapshotInterval = "", envSeconds("DNS_SNAPSHOT_INTERVAL", 300)
+		snapshots = newSnapshotStore(snapshotDir)
+	})
+	ctx := context.Background()
+
+	dnsManagement(ctx, DnsInfo{DnsHostName: "devserver01", Action: "create", IPs: []string{"10.0.0.5"}, VMName: "vm-01", VMProject: "prj-dev-4328"})
+	// Not managed, left alone by rollbacks
+	backend.createChange(ctx, "prj-c-dnshub", "default-zone", rrChange{Additions: []rrset{{Name: "www.gcp.company.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.1.0.1"}}}})
+
+	store := newSnapshotStore(snapshotDir)
+	before, _ := store.list(ctx, "prj-c-dnshub", "default-zone")
+	if err := SnapshotZones(ctx, snapshotDir, []string{"prj-c-dnshub/default-zone"}); err != nil {
+		t.Fatalf("FAILED: snapshot got %v\n", err)
+	}
+	ids, _ := store.list(ctx, "prj-c-dnshub", "default-zone")
+	if len(ids) != len(before)+1 {
+		t.Fatalf("FAILED: got snapshots %v\n", ids)
+	}
+	id := ids[len(ids)-1]
+	snapshot, err := store.load(ctx, "prj-c-dnshub", "default-zone", id)
+	if err != nil || len(snapshot.Records) != 1 || snapshot.Records[0].Name != "devserver01.gcp.company.com." {
+		t.Fatalf("FAILED: got snapshot %+v, %v expected devserver01 only\n", snapshot, err)
+	}
+
+	// Each change is snapshotted first
+	dnsManagement(ctx, DnsInfo{DnsHostName: "devserver01", Action: "create", IPs: []string{"10.0.0.6"}, VMName: "vm-02", VMProject: "prj-dev-4328"})
+	dnsManagement(ctx, DnsInfo{DnsHostName: "devserver02", Action: "create", IPs: []string{"10.0.0.7"}, VMName: "vm-03", VMProject: "prj-dev-4328"})
+	if after, _ := store.list(ctx, "prj-c-dnshub", "default-zone"); len(after) != len(ids)+2 {
+		t.Errorf("FAILED: got %v snapshots expected %v\n", len(after), len(ids)+2)
+	}
+	backend.createChange(ctx, "prj-c-dnshub", "default-zone", rrChange{
+		Deletions: []rrset{{Name: "www.gcp.company.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.1.0.1"}}},
+		Additions: []rrset{{Name: "www.gcp.company.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.1.0.2"}}},
+	})
+
+	// Dry run
+	if err := RollbackZone(ctx, snapshotDir, "prj-c-dnshub/default-zone", id, false); err != nil {
+		t.Fatalf("FAILED: rollback preview got %v\n", err)
+	}
+	if record, _, _ := getRecordSet(ctx, "prj-c-dnshub", "default-zone", "devserver02.gcp.company.com.", "A"); len(record.Rrdatas) == 0 {
+		t.Errorf("FAILED: preview changed the zone\n")
+	}
+
+	if err := RollbackZone(ctx, snapshotDir, "prj-c-dnshub/default-zone", id, true); err != nil {
+		t.Fatalf("FAILED: rollback got %v\n", err)
+	}
+	if _, exists, _ := getRecordSet(ctx, "prj-c-dnshub", "default-zone", "devserver02.gcp.company.com.", "A"); exists {
+		t.Errorf("FAILED: devserver02 not deleted\n")
+	}
+	if record, _, _ := getRecordSet(ctx, "prj-c-dnshub", "default-zone", "devserver01.gcp.company.com.", "A"); !reflect.DeepEqual(record.Rrdatas, []string{"10.0.0.5"}) {
+		t.Errorf("FAILED: got devserver01 %v expected 10.0.0.5\n", record.Rrdatas)
+	}
+	if record, _, _ := getRecordSet(ctx, "prj-c-dnshub", "default-zone", "www.gcp.company.com.", "A"); !reflect.DeepEqual(record.Rrdatas, []string{"10.1.0.2"}) {
+		t.Errorf("FAILED: unmanaged record got %v\n", record.Rrdatas)
+	}
+}
+
+func TestSnapshotInterval(t *testing.T) {
+	setupTestDns(t)
+	snapshotDir, snapshotInterval = t.TempDir(), time.Minute
+	snapshots = newSnapshotStore(snapshotDir)
+	lastSnapshots.times = make(map[string]time.Time)
+	t.Cleanup(func() {
+		snapshotDir, snapshotInterval = "", envSeconds("DNS_SNAPSHOT_INTERVAL", 300)
+		snapshots = newSnapshotStore(snapshotDir)
+		lastSnapshots.times = make(map[string]time.Time)
+	})
+	ctx := context.Background()
+
+	// One full zone list per window, not per change
+	dnsManagement(ctx, DnsInfo{DnsHostName: "devserver01", Action: "create", IPs: []string{"10.0.0.5"}, VMName: "vm-01", VMProject: "prj-dev-4328"})
+	dnsManagement(ctx, DnsInfo{DnsHostName: "devserver02", Action: "create", IPs: []string{"10.0.0.7"}, VMName: "vm-03", VMProject: "prj-dev-4328"})
+	if ids, _ := snapshots.list(ctx, "prj-c-dnshub", "default-zone"); len(ids) != 1 {
+		t.Errorf("FAILED: got %v snapshots expected 1\n", len(ids))
+	}
+}
+
+func TestRestoreChange(t *testing.T) {
+	allow_list := map[string]string{"prj-dev-4328": "^devserver.*$"}
+	current := []rrset{
+		{Name: "devserver01.gcp.company.com.", Type: "A", TTL: 60, Rrdatas: []string{"10.0.0.6", "10.0.0.5"}},
+		{Name: "5.0.0.10.in-addr.arpa.", Type: "PTR", TTL: 60, Rrdatas: []string{"devserver01.gcp.company.com."}},
+		{Name: "gcp.company.com.", Type: "SOA", TTL: 21600, Rrdatas: []string{"ns-cloud-a1.googledomains.com. ..."}},
+	}
+	snapshot := []rrset{
+		{Name: "devserver01.gcp.company.com.", Type: "A", TTL: 60, Rrdatas: []string{"10.0.0.5", "10.0.0.6"}},
+		{Name: "devserver03.gcp.company.com.", Type: "A", TTL: 60, Rrdatas: []string{"10.0.0.9"}},
+	}
+	change := restoreChange(current, snapshot, allow_list)
+	if len(change.Deletions) != 1 || change.Deletions[0].Type != "PTR" {
+		t.Errorf("FAILED: got deletions %+v expected the PTR\n", change.Deletions)
+	}
+	if len(change.Additions) != 1 || change.Additions[0].Name != "devserver03.gcp.company.com." {
+		t.Errorf("FAILED: got additions %+v expected devserver03\n", change.Additions)
+	}
+}
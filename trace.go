@@ -0,0 +1,229 @@
+package gcedns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	cloudtrace "google.golang.org/api/cloudtrace/v2"
+)
+
+/* Tracing
+OpenTelemetry traces, one per event, with spans for parsing, the VM lookup, the allow list
+check and each Cloud DNS list and change call. The W3C trace context of the publisher is
+extracted from the traceparent (or googclient_traceparent) attribute of the Pub/Sub message,
+unsampled publisher traces aren't exported.
+DNS_TRACE_EXPORTER selects the exporter of the tracer provider:
+- "" (default): none, tracing is disabled
+- otlp: OTLP over HTTP, configured by the OTEL_EXPORTER_OTLP_* variables
+- log: a JSON line per span, with the Cloud Logging trace fields
+- cloudtrace://PROJECT: Cloud Trace
+*/
+
+var tracerProvider = newTracerProvider(os.Getenv("DNS_TRACE_EXPORTER"))
+
+// W3C traceparent and tracestate
+var propagator = propagation.TraceContext{}
+
+func newTracerProvider(config string) trace.TracerProvider {
+	var exporter sdktrace.SpanExporter
+	switch {
+	case config == "":
+		return trace.NewNoopTracerProvider()
+	case config == "otlp":
+		otlp, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			fmt.Printf("Error starting the OTLP exporter, tracing disabled: %v\n", err)
+			return trace.NewNoopTracerProvider()
+		}
+		exporter = otlp
+	case config == "log":
+		exporter = logSpans{}
+	case strings.HasPrefix(config, "cloudtrace://"):
+		exporter = &cloudTraceSpans{Project: strings.TrimPrefix(config, "cloudtrace://")}
+	default:
+		fmt.Printf("Unknown DNS_TRACE_EXPORTER %q, tracing disabled\n", config)
+		return trace.NewNoopTracerProvider()
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("gcedns"))),
+	)
+}
+
+// Exports the ended spans, a Cloud Function instance may be frozen once the event returns
+func flushSpans(ctx context.Context) {
+	if provider, ok := tracerProvider.(*sdktrace.TracerProvider); ok {
+		if err := provider.ForceFlush(ctx); err != nil {
+			fmt.Printf("Error exporting spans: %v\n", err)
+		}
+	}
+}
+
+// Exports the ended spans and stops the exporter, at the end of service mode
+func shutdownTracing() {
+	if provider, ok := tracerProvider.(*sdktrace.TracerProvider); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			fmt.Printf("Error exporting spans: %v\n", err)
+		}
+	}
+}
+
+// Continues the publisher's trace, from the message attributes
+func contextWithMessageTrace(ctx context.Context, attributes map[string]string) context.Context {
+	for _, key := range []string{"traceparent", "googclient_traceparent"} {
+		if attributes[key] == "" {
+			continue
+		}
+		carrier := propagation.HeaderCarrier{}
+		carrier.Set("traceparent", attributes[key])
+		carrier.Set("tracestate", attributes["tracestate"])
+		remote := propagator.Extract(ctx, carrier)
+		if trace.SpanContextFromContext(remote).IsValid() {
+			return remote
+		}
+	}
+	return ctx
+}
+
+type span struct {
+	trace.Span
+}
+
+// Starts a child of the span in ctx, or the local root of a new or remote trace
+func startSpan(ctx context.Context, name string, attributes ...string) (context.Context, *span) {
+	var kvs []attribute.KeyValue
+	for i := 0; i+1 < len(attributes); i += 2 {
+		kvs = append(kvs, attribute.String(attributes[i], attributes[i+1]))
+	}
+	ctx, s := tracerProvider.Tracer("gcedns").Start(ctx, name, trace.WithAttributes(kvs...))
+	return ctx, &span{s}
+}
+
+func (s *span) set(key, value string) {
+	s.SetAttributes(attribute.String(key, value))
+}
+
+func (s *span) end(err error) {
+	if err != nil {
+		s.RecordError(err)
+		s.SetStatus(codes.Error, err.Error())
+	}
+	s.End()
+}
+
+// Fields of an exported span
+type spanRecord struct {
+	Name       string            `json:"name"`
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_span_id,omitempty"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+func newSpanRecord(s sdktrace.ReadOnlySpan) spanRecord {
+	record := spanRecord{Name: s.Name(), TraceID: s.SpanContext().TraceID().String(), SpanID: s.SpanContext().SpanID().String(),
+		Start: s.StartTime(), End: s.EndTime(), Attributes: map[string]string{}}
+	if s.Parent().IsValid() {
+		record.ParentID = s.Parent().SpanID().String()
+	}
+	for _, kv := range s.Attributes() {
+		record.Attributes[string(kv.Key)] = kv.Value.Emit()
+	}
+	if s.Status().Code == codes.Error {
+		record.Error = s.Status().Description
+	}
+	return record
+}
+
+type logSpans struct{}
+
+func (logSpans) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	for _, s := range spans {
+		record := newSpanRecord(s)
+		entry := map[string]interface{}{
+			"message":                       "span " + record.Name,
+			"span":                          record,
+			"duration_ms":                   record.End.Sub(record.Start).Milliseconds(),
+			"logging.googleapis.com/spanId": record.SpanID,
+		}
+		if project := os.Getenv("GCP_PROJECT"); project != "" {
+			entry["logging.googleapis.com/trace"] = fmt.Sprintf("projects/%v/traces/%v", project, record.TraceID)
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", line)
+	}
+	return nil
+}
+
+func (logSpans) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+type cloudTraceSpans struct {
+	Project string
+
+	once    sync.Once
+	service *cloudtrace.Service
+	err     error
+}
+
+func (c *cloudTraceSpans) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	c.once.Do(func() {
+		c.service, c.err = cloudtrace.NewService(context.Background())
+	})
+	if c.err != nil {
+		return c.err
+	}
+
+	request := &cloudtrace.BatchWriteSpansRequest{}
+	for _, s := range spans {
+		record := newSpanRecord(s)
+		attributes := map[string]cloudtrace.AttributeValue{}
+		for k, v := range record.Attributes {
+			attributes[k] = cloudtrace.AttributeValue{StringValue: &cloudtrace.TruncatableString{Value: v}}
+		}
+		trace_span := &cloudtrace.Span{
+			Name:         fmt.Sprintf("projects/%v/traces/%v/spans/%v", c.Project, record.TraceID, record.SpanID),
+			SpanId:       record.SpanID,
+			ParentSpanId: record.ParentID,
+			DisplayName:  &cloudtrace.TruncatableString{Value: record.Name},
+			StartTime:    record.Start.UTC().Format(time.RFC3339Nano),
+			EndTime:      record.End.UTC().Format(time.RFC3339Nano),
+			Attributes:   &cloudtrace.Attributes{AttributeMap: attributes},
+		}
+		if record.Error != "" {
+			// google.rpc.Code UNKNOWN
+			trace_span.Status = &cloudtrace.Status{Code: 2, Message: record.Error}
+		}
+		request.Spans = append(request.Spans, trace_span)
+	}
+	return withRetry(ctx, "cloudtrace.traces.batchWrite", func() error {
+		_, err := c.service.Projects.Traces.BatchWrite("projects/"+c.Project, request).Context(ctx).Do()
+		return err
+	})
+}
+
+func (c *cloudTraceSpans) Shutdown(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,131 @@
+package gcedns
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func setupTestTracer(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { tracerProvider = newTracerProvider("") })
+	return exporter
+}
+
+func spanNames(exporter *tracetest.InMemoryExporter) (names []string) {
+	for _, s := range exporter.GetSpans() {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+func TestEventTrace(t *testing.T) {
+	setupTestDns(t)
+	exporter := setupTestTracer(t)
+	events = newMemoryDedup(10)
+	defer func() { events = newEventStore("DNS_DEDUP_STORE") }()
+
+	// Denied on the fast path, traced from the publisher's span
+	m := PubSubMessage{
+		Data:       insertAuditLog(`[{"key": "dns_host_name", "value": "prod01"}]`),
+		Attributes: map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		MessageID:  "2797262539811474",
+	}
+	if err := PubSubMsgReader(context.Background(), m); err != nil {
+		t.Fatalf("FAILED: got %v\n", err)
+	}
+
+	if names := spanNames(exporter); !reflect.DeepEqual(names, []string{"parse", "checkAllowList", "gcedns.event"}) {
+		t.Fatalf("FAILED: got spans %v\n", names)
+	}
+	spans := exporter.GetSpans()
+	for _, s := range spans {
+		if s.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("FAILED: %v in trace %v expected the publisher's trace\n", s.Name, s.SpanContext.TraceID())
+		}
+	}
+	if root := spans[2]; root.Parent.SpanID().String() != "00f067aa0ba902b7" || spans[0].Parent.SpanID() != root.SpanContext.SpanID() {
+		t.Errorf("FAILED: got parents %v and %v\n", root.Parent.SpanID(), spans[0].Parent.SpanID())
+	}
+
+	// Unsampled publisher trace, not exported
+	exporter.Reset()
+	m.Attributes["traceparent"] = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"
+	m.MessageID = "2797262539811475"
+	PubSubMsgReader(context.Background(), m)
+	if names := spanNames(exporter); len(names) != 0 {
+		t.Errorf("FAILED: got spans %v expected none\n", names)
+	}
+}
+
+func TestDnsCallSpans(t *testing.T) {
+	setupTestDns(t)
+	exporter := setupTestTracer(t)
+
+	ctx, root := startSpan(context.Background(), "test")
+	dnsManagement(ctx, DnsInfo{DnsHostName: "devserver01", Action: "create", IPs: []string{"10.0.0.5"}, VMName: "vm-01", VMProject: "prj-dev-4328"})
+	root.end(nil)
+
+	counts := map[string]int{}
+	for _, s := range exporter.GetSpans() {
+		counts[s.Name]++
+		if s.SpanContext.TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("FAILED: %v not in the test trace\n", s.Name)
+		}
+	}
+	// A and PTR lookups, then one change per zone
+	if counts["dns.resourceRecordSets.list"] != 2 || counts["dns.changes.create"] != 2 || counts["checkAllowList"] != 1 {
+		t.Errorf("FAILED: got spans %v\n", counts)
+	}
+}
+
+func TestConcurrentSpans(t *testing.T) {
+	exporter := setupTestTracer(t)
+
+	ctx, root := startSpan(context.Background(), "test")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, s := startSpan(ctx, "child")
+			s.set("n", strconv.Itoa(i))
+			root.set("child", strconv.Itoa(i))
+			s.end(nil)
+		}(i)
+	}
+	wg.Wait()
+	root.end(nil)
+
+	if spans := exporter.GetSpans(); len(spans) != 11 {
+		t.Errorf("FAILED: got %v spans expected 11\n", len(spans))
+	}
+}
+
+func TestMessageTrace(t *testing.T) {
+	test_data := []struct {
+		attributes map[string]string
+		valid      bool
+		sampled    bool
+	}{
+		{map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, true, true},
+		{map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"}, true, false},
+		{map[string]string{"googclient_traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, true, true},
+		{map[string]string{"traceparent": "00-00000000000000000000000000000000-00f067aa0ba902b7-01"}, false, false},
+		{map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7"}, false, false},
+		{map[string]string{"traceparent": "not a traceparent"}, false, false},
+	}
+	for _, data := range test_data {
+		parent := trace.SpanContextFromContext(contextWithMessageTrace(context.Background(), data.attributes))
+		if parent.IsValid() != data.valid || parent.IsSampled() != data.sampled || (data.valid && !parent.IsRemote()) {
+			t.Errorf("FAILED: %v got %+v\n", data.attributes, parent)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package gcedns
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/* Planned DNS transactions
+An event's record changes (A, PTR, group, CNAME) are planned first, then applied as one
+change per zone. Cloud DNS applies each change atomically, when a later zone fails the
+zones already applied are rolled back with the inverse change.
+*/
+
+// Max time to wait for a change to be done
+var changeTimeout = envSeconds("DNS_CHANGE_TIMEOUT", 60)
+
+type zoneChange struct {
+	Project string
+	Zone    string
+	Change  rrChange
+}
+
+type dnsTransaction struct {
+	changes []*zoneChange
+}
+
+// Planned change of a zone, zones are applied in the order they're first touched
+func (t *dnsTransaction) zone(project, zone string) *rrChange {
+	for _, zc := range t.changes {
+		if zc.Project == project && zc.Zone == zone {
+			return &zc.Change
+		}
+	}
+	t.changes = append(t.changes, &zoneChange{Project: project, Zone: zone})
+	return &t.changes[len(t.changes)-1].Change
+}
+
+func (t *dnsTransaction) add(project, zone string, record rrset) {
+	change := t.zone(project, zone)
+	change.Additions = append(change.Additions, record)
+}
+
+// record must be the current recordSet, Cloud DNS only deletes exact matches
+func (t *dnsTransaction) remove(project, zone string, record rrset) {
+	change := t.zone(project, zone)
+	record.Kind = ""
+	change.Deletions = append(change.Deletions, record)
+}
+
+func (t *dnsTransaction) replace(project, zone string, current, record rrset) {
+	t.remove(project, zone, current)
+	t.add(project, zone, record)
+}
+
+func (t *dnsTransaction) empty() bool {
+	for _, zc := range t.changes {
+		if len(zc.Change.Additions) > 0 || len(zc.Change.Deletions) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Applies the transaction, status on success, dnsFailed and the error otherwise
+func (t *dnsTransaction) commit(ctx context.Context, status string) (string, error) {
+	if err := t.apply(ctx); err != nil {
+		fmt.Println(err)
+		return dnsFailed, err
+	}
+	return status, nil
+}
+
+// Applies zone changes in order, on failure the applied ones are compensated in reverse order
+func (t *dnsTransaction) apply(ctx context.Context) error {
+	var applied []*zoneChange
+
+	for _, zc := range t.changes {
+		if len(zc.Change.Additions) == 0 && len(zc.Change.Deletions) == 0 {
+			continue
+		}
+		if debug != "" {
+			fmt.Printf("DNS change for %v/%v: %+v\n", zc.Project, zc.Zone, zc.Change)
+		}
+
+		snapshotBeforeChange(ctx, zc.Project, zc.Zone)
+		err := applyChange(ctx, zc.Project, zc.Zone, zc.Change)
+		if err != nil {
+			err = fmt.Errorf("Error making DNS change in %v/%v: %w", zc.Project, zc.Zone, err)
+			rollback(ctx, applied)
+			return err
+		}
+		applied = append(applied, zc)
+	}
+	for _, zc := range applied {
+		observeChange(zc.Change)
+	}
+	eventAudit(ctx).addChanges(applied)
+	return nil
+}
+
+// Inverse of the applied changes, newest first
+func rollback(ctx context.Context, applied []*zoneChange) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		zc := applied[i]
+		inverse := rrChange{Additions: zc.Change.Deletions, Deletions: zc.Change.Additions}
+		if err := applyChange(ctx, zc.Project, zc.Zone, inverse); err != nil {
+			fmt.Printf("Error rolling back DNS change in %v/%v, fix manually: %+v: %v\n", zc.Project, zc.Zone, zc.Change, err)
+			continue
+		}
+		fmt.Printf("Rolled back DNS change in %v/%v\n", zc.Project, zc.Zone)
+	}
+}
+
+// Creates the change and waits for it to be done
+func applyChange(ctx context.Context, project, zone string, change rrChange) (err error) {
+	ctx, span := startSpan(ctx, "dns.changes.create", "project", project, "zone", zone,
+		"additions", strconv.Itoa(len(change.Additions)), "deletions", strconv.Itoa(len(change.Deletions)))
+	defer func() { span.end(err) }()
+
+	created, err := dnsAPI.createChange(ctx, project, zone, change)
+	if err != nil {
+		return err
+	}
+
+	wait := newBackoff(500*time.Millisecond, 5*time.Second, changeTimeout)
+	for created.Status != "done" {
+		if !wait.Wait(ctx) {
+			return fmt.Errorf("change %v not done after %v", created.ID, changeTimeout)
+		}
+		if created, err = dnsAPI.getChange(ctx, project, zone, created.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
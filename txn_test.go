@@ -0,0 +1,253 @@
+package gcedns
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Fails every change to one zone, with failCode or a 400, and every list of listZone
+type failingDNS struct {
+	*memoryDNS
+	failZone string
+	failCode int
+	listZone string
+}
+
+func (f failingDNS) listRecordSets(ctx context.Context, project, zone, dns_name, rs_type string) ([]rrset, error) {
+	if zone == f.listZone {
+		return nil, &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "unavailable"}
+	}
+	return f.memoryDNS.listRecordSets(ctx, project, zone, dns_name, rs_type)
+}
+
+func (f failingDNS) createChange(ctx context.Context, project, zone string, change rrChange) (rrChange, error) {
+	if zone == f.failZone {
+		code := f.failCode
+		if code == 0 {
+			code = http.StatusBadRequest
+		}
+		return rrChange{}, &googleapi.Error{Code: code, Message: "invalid"}
+	}
+	return f.memoryDNS.createChange(ctx, project, zone, change)
+}
+
+// Restores the policy files and default zones a test overwrites
+func restoreDnsGlobals(t *testing.T) {
+	allow_list, policy := dnsAllowListFile, dnsPolicyFile
+	host_project, zone, domain := defaultDnsHostProject, defaultDnsZone, defaultDnsDomain
+	ptr_host_project, ptr_zone, ptr_domain := defaultPTRHostProject, defaultPTRZone, defaultPTRDomain
+	t.Cleanup(func() {
+		dnsAllowListFile, dnsPolicyFile = allow_list, policy
+		defaultDnsHostProject, defaultDnsZone, defaultDnsDomain = host_project, zone, domain
+		defaultPTRHostProject, defaultPTRZone, defaultPTRDomain = ptr_host_project, ptr_zone, ptr_domain
+	})
+}
+
+// Allow list, default zones and an in-memory backend for record management tests
+func setupTestDns(t *testing.T) *memoryDNS {
+	restoreDnsGlobals(t)
+	dir, err := ioutil.TempDir("", "dns_txn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	dnsAllowListFile = filepath.Join(dir, "dns_allow_list.yaml")
+	if err := ioutil.WriteFile(dnsAllowListFile, []byte(`prj-dev-4328: "^(devserver|qa).*$"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dnsPolicyFile = filepath.Join(dir, "dns_policy.yaml")
+
+	defaultDnsHostProject, defaultDnsZone, defaultDnsDomain = "prj-c-dnshub", "default-zone", "gcp.company.com."
+	defaultPTRHostProject, defaultPTRZone, defaultPTRDomain = "prj-c-dnshub", "ptr-zone", "in-addr.arpa."
+
+	backend := newMemoryDNS()
+	dnsAPI = backend
+	t.Cleanup(func() { dnsAPI = cloudDNS{} })
+	return backend
+}
+
+func TestAtomicARecordAndPTR(t *testing.T) {
+	backend := setupTestDns(t)
+	dnsInfo := DnsInfo{DnsHostName: "devserver01", Action: "create", IPs: []string{"10.0.0.5"}, VMName: "vm-01", VMProject: "prj-dev-4328"}
+
+	if result := dnsManagement(context.Background(), dnsInfo); result.Status != dnsCreated {
+		t.Errorf("FAILED: create got %v expected %v\n", result, dnsCreated)
+	}
+	if _, exists, _ := getRecordSet(context.Background(), "prj-c-dnshub", "default-zone", "devserver01.gcp.company.com.", "A"); !exists {
+		t.Errorf("FAILED: A record not created\n")
+	}
+	ptr, exists, _ := getRecordSet(context.Background(), "prj-c-dnshub", "ptr-zone", "5.0.0.10.in-addr.arpa.", "PTR")
+	if !exists || ptr.Rrdatas[0] != "devserver01.gcp.company.com." {
+		t.Errorf("FAILED: PTR record got %v expected devserver01.gcp.company.com.\n", ptr)
+	}
+
+	// Replayed event changes nothing
+	if result := dnsManagement(context.Background(), dnsInfo); result.Status != dnsUnchanged {
+		t.Errorf("FAILED: replayed create got %v expected %v\n", result, dnsUnchanged)
+	}
+	if backend.changes != 2 {
+		t.Errorf("FAILED: got %v changes expected 2\n", backend.changes)
+	}
+
+	dnsInfo.Action = "delete"
+	if result := dnsManagement(context.Background(), dnsInfo); result.Status != dnsDeleted {
+		t.Errorf("FAILED: delete got %v expected %v\n", result, dnsDeleted)
+	}
+	if records, _ := backend.listRecordSets(context.Background(), "prj-c-dnshub", "ptr-zone", "", ""); len(records) != 0 {
+		t.Errorf("FAILED: PTR left after delete: %v\n", records)
+	}
+}
+
+func TestSameZoneSingleChange(t *testing.T) {
+	backend := setupTestDns(t)
+	defaultPTRZone = defaultDnsZone
+
+	dnsInfo := DnsInfo{DnsHostName: "devserver01", Action: "create", IPs: []string{"10.0.0.5"}, VMName: "vm-01", VMProject: "prj-dev-4328"}
+	if result := dnsManagement(context.Background(), dnsInfo); result.Status != dnsCreated {
+		t.Errorf("FAILED: create got %v expected %v\n", result, dnsCreated)
+	}
+	if backend.changes != 1 {
+		t.Errorf("FAILED: got %v changes expected A and PTR in 1\n", backend.changes)
+	}
+}
+
+func TestCompensationOnPartialFailure(t *testing.T) {
+	backend := setupTestDns(t)
+	dnsAPI = failingDNS{memoryDNS: backend, failZone: "ptr-zone"}
+
+	dnsInfo := DnsInfo{DnsHostName: "devserver01", Action: "create", IPs: []string{"10.0.0.5"}, VMName: "vm-01", VMProject: "prj-dev-4328"}
+	if result := dnsManagement(context.Background(), dnsInfo); result.Status != dnsFailed || !strings.Contains(result.Reason, "invalid") {
+		t.Errorf("FAILED: got %v expected %v with the change error\n", result, dnsFailed)
+	}
+	// A record applied, then rolled back
+	if backend.changes != 2 {
+		t.Errorf("FAILED: got %v changes expected the A change and its rollback\n", backend.changes)
+	}
+	if _, exists, _ := getRecordSet(context.Background(), "prj-c-dnshub", "default-zone", "devserver01.gcp.company.com.", "A"); exists {
+		t.Errorf("FAILED: A record left after the PTR failed\n")
+	}
+}
+
+func TestListErrorFailsEvent(t *testing.T) {
+	backend := setupTestDns(t)
+	dnsAPI = failingDNS{memoryDNS: backend, listZone: "ptr-zone"}
+
+	dnsInfo := DnsInfo{DnsHostName: "devserver01", Action: "create", IPs: []string{"10.0.0.5"}, VMName: "vm-01", VMProject: "prj-dev-4328"}
+	if result := dnsManagement(context.Background(), dnsInfo); result.Status != dnsFailed {
+		t.Errorf("FAILED: got %v expected %v\n", result, dnsFailed)
+	}
+	if backend.changes != 0 {
+		t.Errorf("FAILED: got %v changes expected none\n", backend.changes)
+	}
+}
+
+func TestRollbackRestoresPatchedRecord(t *testing.T) {
+	backend := setupTestDns(t)
+	existing := rrset{Name: "qa.gcp.company.com.", Rrdatas: []string{"10.0.0.1"}, TTL: 300, Type: "A"}
+	backend.createChange(context.Background(), "prj-c-dnshub", "default-zone", rrChange{Additions: []rrset{existing}})
+
+	merged := existing.clone()
+	merged.Rrdatas = append(merged.Rrdatas, "10.0.0.2")
+	txn := &dnsTransaction{}
+	txn.replace("prj-c-dnshub", "default-zone", existing, merged)
+	txn.add("prj-c-dnshub", "ptr-zone", rrset{Name: "2.0.0.10.in-addr.arpa.", Rrdatas: []string{"qa.gcp.company.com."}, TTL: 60, Type: "PTR"})
+
+	dnsAPI = failingDNS{memoryDNS: backend, failZone: "ptr-zone"}
+	if err := txn.apply(context.Background()); err == nil {
+		t.Errorf("FAILED: expected an error from the PTR zone\n")
+	}
+	if record, _, _ := getRecordSet(context.Background(), "prj-c-dnshub", "default-zone", "qa.gcp.company.com.", "A"); !sameRecordSet(record, existing) {
+		t.Errorf("FAILED: got %v expected %v restored\n", record, existing)
+	}
+}
+
+func TestAutoSuffixRecords(t *testing.T) {
+	setupTestDns(t)
+	ioutil.WriteFile(dnsPolicyFile, []byte(`conflicts:
+  default: "auto-suffix"
+`), 0644)
+	ctx := context.Background()
+	vm := func(action, name, ip string) dnsResult {
+		return dnsManagement(ctx, DnsInfo{DnsHostName: "devserver01", Action: action, IPs: []string{ip}, VMName: name, VMProject: "prj-dev-4328"})
+	}
+
+	vm("create", "vm-01", "10.0.0.5")
+	vm("create", "vm-02", "10.0.0.6")
+	if result := vm("create", "vm-03", "10.0.0.7"); result.FQDN != "devserver01-3.gcp.company.com." {
+		t.Fatalf("FAILED: got %v expected devserver01-3\n", result)
+	}
+	vm("delete", "vm-02", "10.0.0.6")
+
+	// Retried past the gap left by vm-02
+	if result := vm("create", "vm-03", "10.0.0.7"); result.FQDN != "devserver01-3.gcp.company.com." || result.Status != dnsUnchanged {
+		t.Errorf("FAILED: retry got %v expected devserver01-3 unchanged\n", result)
+	}
+	if _, exists, _ := getRecordSet(ctx, "prj-c-dnshub", "default-zone", "devserver01-2.gcp.company.com.", "A"); exists {
+		t.Errorf("FAILED: retry took a second name\n")
+	}
+
+	// The base name is gone, the suffixed record is still found
+	vm("delete", "vm-01", "10.0.0.5")
+	if result := vm("delete", "vm-03", "10.0.0.7"); result.Status != dnsDeleted || result.FQDN != "devserver01-3.gcp.company.com." {
+		t.Errorf("FAILED: delete got %v expected devserver01-3 deleted\n", result)
+	}
+	if _, exists, _ := getRecordSet(ctx, "prj-c-dnshub", "default-zone", "devserver01-3.gcp.company.com.", "A"); exists {
+		t.Errorf("FAILED: devserver01-3 leaked\n")
+	}
+}
+
+// One list of the zone finds the suffixed names, whether or not the base name exists
+func TestAutoSuffixLookups(t *testing.T) {
+	setupTestDns(t)
+	ioutil.WriteFile(dnsPolicyFile, []byte(`conflicts:
+  default: "auto-suffix"
+`), 0644)
+	ctx := context.Background()
+	vm := func(action, name, ip string) dnsResult {
+		return dnsManagement(ctx, DnsInfo{DnsHostName: "devserver01", Action: action, IPs: []string{ip}, VMName: name, VMProject: "prj-dev-4328"})
+	}
+	for i := 1; i <= 5; i++ {
+		vm("create", fmt.Sprintf("vm-%v", i), fmt.Sprintf("10.0.0.%v", i))
+	}
+
+	exporter := setupTestTracer(t)
+	lists := func() (n int) {
+		for _, s := range exporter.GetSpans() {
+			if s.Name == "dns.resourceRecordSets.list" {
+				n++
+			}
+		}
+		exporter.Reset()
+		return n
+	}
+
+	// Base name, suffixed names, PTR
+	if result := vm("create", "vm-6", "10.0.0.6"); result.FQDN != "devserver01-6.gcp.company.com." {
+		t.Errorf("FAILED: got %v expected devserver01-6\n", result)
+	}
+	if n := lists(); n != 3 {
+		t.Errorf("FAILED: create took %v lists expected 3\n", n)
+	}
+
+	// The base name's VM is gone, a retried create keeps its suffixed name
+	vm("delete", "vm-1", "10.0.0.1")
+	lists()
+	if result := vm("create", "vm-4", "10.0.0.4"); result.FQDN != "devserver01-4.gcp.company.com." || result.Status != dnsUnchanged {
+		t.Errorf("FAILED: retry got %v expected devserver01-4 unchanged\n", result)
+	}
+	if _, exists, _ := getRecordSet(ctx, "prj-c-dnshub", "default-zone", "devserver01.gcp.company.com.", "A"); exists {
+		t.Errorf("FAILED: retry took the base name too\n")
+	}
+	if n := lists(); n > 3 {
+		t.Errorf("FAILED: retried create took %v lists\n", n)
+	}
+}
@@ -5,27 +5,52 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"sync"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/compute/v1"
 )
 
+// Max time to wait for a VM's insert operation and IPs
+var operationTimeout = envSeconds("DNS_OPERATION_TIMEOUT", 120)
+
+// Writes the DNS outcome back to the VM metadata when set, needs compute.instances.setMetadata on the VM projects
+var writeBack = os.Getenv("DNS_WRITE_BACK")
+
 type VMInfo struct {
-	IPs       []string
-	Labels    map[string]string
-	Name      string
-	VMProject string
+	IPs           []string
+	Labels        map[string]string
+	Metadata      map[string]string
+	Name          string
+	VMProject     string
+	Zone          string
+	InstanceID    string
+	AccessConfigs []accessConfig
+}
+
+// External IP of a network interface
+type accessConfig struct {
+	NIC                 string
+	Name                string
+	Type                string
+	NatIP               string
+	SetPublicPtr        bool
+	PublicPtrDomainName string
 }
 
 // call GCE for explicitly retriving any VM metadata
 // return - vmlabels map[string]string, vmips []string
 func getGCEMetadata(data []byte, ctx context.Context) (vm_info VMInfo, status bool) {
-	time.Sleep(5 * time.Second) //adding a little sleep as nic assigment sometimes takes longer.
-	var mutex sync.Mutex
-	mutex.Lock()
-	defer mutex.Unlock()
+	ctx, span := startSpan(ctx, "getGCEMetadata")
+	defer func() {
+		span.set("vm_name", vm_info.Name)
+		span.set("found", strconv.FormatBool(status))
+		span.end(nil)
+	}()
 
 	if len(data) == 0 {
 		log.Println("No data received")
@@ -38,6 +63,74 @@ func getGCEMetadata(data []byte, ctx context.Context) (vm_info VMInfo, status bo
 		return VMInfo{}, false
 	}
 
+	if logMessage.Resource.Labels.ProjectID == "" || logMessage.Resource.Labels.Zone == "" || logMessage.Resource.Labels.InstanceID == "" {
+		// fmt.Printf("Missing VM info, returning..\n ProjectID: %q, Zone: %q, InstanceID: %q\n", logMessage.Resource.Labels.ProjectID, logMessage.Resource.Labels.Zone, logMessage.Resource.Labels.InstanceID)
+		return VMInfo{}, false
+	}
+
+	if debug != "" {
+		fmt.Printf("VM Info request parameters:\nProjectID: %v, Zone: %v, InstanceID: %v\n", logMessage.Resource.Labels.ProjectID, logMessage.Resource.Labels.Zone, logMessage.Resource.Labels.InstanceID)
+	}
+
+	vm_info, status = getInstance(ctx, logMessage.Resource.Labels.ProjectID, logMessage.Resource.Labels.Zone, logMessage.Resource.Labels.InstanceID)
+
+	// nic assigment sometimes takes longer, poll until the VM has its IPs
+	b := newBackoff(time.Second, 8*time.Second, operationTimeout)
+	for status && len(vm_info.IPs) == 0 && b.Wait(ctx) {
+		vm_info, status = getInstance(ctx, logMessage.Resource.Labels.ProjectID, logMessage.Resource.Labels.Zone, logMessage.Resource.Labels.InstanceID)
+	}
+	return vm_info, status
+}
+
+// Compute operation finished with an error, ex: quota exceeded on insert
+type operationError struct {
+	Operation string
+	Errors    []string
+}
+
+func (e *operationError) Error() string {
+	return fmt.Sprintf("operation %v failed: %v", e.Operation, strings.Join(e.Errors, ", "))
+}
+
+// Polls a zonal compute operation until it's DONE, returns an *operationError if it failed
+func waitForOperation(ctx context.Context, project, zone, operation string) (err error) {
+	ctx, span := startSpan(ctx, "waitForOperation", "operation", operation)
+	defer func() { span.end(err) }()
+
+	gce := computeService(ctx)
+	b := newBackoff(time.Second, 8*time.Second, operationTimeout)
+
+	for {
+		var op *compute.Operation
+		err := withRetry(ctx, "compute.zoneOperations.get", func() (err error) {
+			op, err = gce.ZoneOperations.Get(project, zone, operation).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error getting operation %v: %v", operation, err)
+		}
+
+		if op.Status == "DONE" {
+			if op.Error != nil && len(op.Error.Errors) > 0 {
+				opErr := &operationError{Operation: operation}
+				for _, e := range op.Error.Errors {
+					opErr.Errors = append(opErr.Errors, e.Code+": "+e.Message)
+				}
+				return opErr
+			}
+			return nil
+		}
+
+		if debug != "" {
+			fmt.Printf("operation %v is %v\n", operation, op.Status)
+		}
+		if !b.Wait(ctx) {
+			return fmt.Errorf("operation %v not done after %v, last status: %v", operation, operationTimeout, op.Status)
+		}
+	}
+}
+
+func computeService(ctx context.Context) *compute.Service {
 	client, err := google.DefaultClient(ctx, compute.ComputeScope)
 	if err != nil {
 		checkErr("failed initializing the comoute client", err)
@@ -48,37 +141,149 @@ func getGCEMetadata(data []byte, ctx context.Context) (vm_info VMInfo, status bo
 	if err != nil {
 		checkErr("Error instantiating compute client", err)
 	}
+	return compute
+}
 
-	if logMessage.Resource.Labels.ProjectID == "" || logMessage.Resource.Labels.Zone == "" || logMessage.Resource.Labels.InstanceID == "" {
-		// fmt.Printf("Missing VM info, returning..\n ProjectID: %q, Zone: %q, InstanceID: %q\n", logMessage.Resource.Labels.ProjectID, logMessage.Resource.Labels.Zone, logMessage.Resource.Labels.InstanceID)
-		return VMInfo{}, false
-	}
-
-	if debug != "" {
-		fmt.Printf("VM Info request parameters:\nProjectID: %v, Zone: %v, InstanceID: %v\n", logMessage.Resource.Labels.ProjectID, logMessage.Resource.Labels.Zone, logMessage.Resource.Labels.InstanceID)
-	}
-
-	gce := compute.Instances.Get(logMessage.Resource.Labels.ProjectID, logMessage.Resource.Labels.Zone, logMessage.Resource.Labels.InstanceID)
+// instance can either be the VM name or its ID
+func getInstance(ctx context.Context, project, zone, instance string) (vm_info VMInfo, status bool) {
+	gce := computeService(ctx).Instances.Get(project, zone, instance)
 
-	vm, err := gce.Do()
+	var vm *compute.Instance
+	err := withRetry(ctx, "compute.instances.get", func() (err error) {
+		vm, err = gce.Context(ctx).Do()
+		return err
+	})
 	if err != nil {
 		// In case VM does't exist, this is a noop.
 		fmt.Printf("Error occured: %v\n", err)
 		return VMInfo{}, false
 	}
 
-	var vmips []string
+	var (
+		vmips          []string
+		access_configs []accessConfig
+	)
 	for _, ips := range vm.NetworkInterfaces {
 		vmips = append(vmips, ips.NetworkIP)
+		for _, ac := range ips.AccessConfigs {
+			if ac.NatIP != "" {
+				access_configs = append(access_configs, accessConfig{
+					NIC:                 ips.Name,
+					Name:                ac.Name,
+					Type:                ac.Type,
+					NatIP:               ac.NatIP,
+					SetPublicPtr:        ac.SetPublicPtr,
+					PublicPtrDomainName: ac.PublicPtrDomainName,
+				})
+			}
+		}
+	}
+
+	metadata := make(map[string]string)
+	if vm.Metadata != nil {
+		for _, item := range vm.Metadata.Items {
+			if item.Value != nil {
+				metadata[item.Key] = *item.Value
+			}
+		}
 	}
 
 	vm_info = VMInfo{
-		IPs:       vmips,
-		Labels:    vm.Labels,
-		Name:      vm.Name,
-		VMProject: logMessage.Resource.Labels.ProjectID,
+		IPs:           vmips,
+		Labels:        vm.Labels,
+		Metadata:      metadata,
+		Name:          vm.Name,
+		VMProject:     project,
+		Zone:          zone,
+		InstanceID:    fmt.Sprint(vm.Id),
+		AccessConfigs: access_configs,
 	}
 
 	// vm.Hostname for hostname. return vm.Labels, vmips
 	return vm_info, true
 }
+
+// Helper func to pick a resource's project, zone and name from its URL
+// ex: https://www.googleapis.com/compute/v1/projects/PROJECT/zones/ZONE/instances/NAME
+func parseResourceURL(resource_url string) (project, zone, name string) {
+	parts := strings.Split(strings.Trim(resource_url, "/"), "/")
+	for i := 0; i+1 < len(parts); i++ {
+		switch parts[i] {
+		case "projects":
+			project = parts[i+1]
+		case "zones", "regions":
+			zone = parts[i+1]
+		}
+	}
+	if len(parts) > 0 {
+		name = parts[len(parts)-1]
+	}
+	return project, zone, name
+}
+
+// VM metadata keys holding the DNS outcome
+func dnsStatusMetadata(dnsRes dnsResult) map[string]string {
+	return map[string]string{
+		"dns-status":    dnsRes.Status,
+		"dns-fqdn":      dnsRes.FQDN,
+		"dns-reason":    dnsRes.Reason,
+		"dns-readiness": dnsRes.Readiness,
+	}
+}
+
+// Helper func to set metadata values, keys with an empty value are removed
+func mergeMetadata(metadata *compute.Metadata, values map[string]string) {
+	var items []*compute.MetadataItems
+	for _, item := range metadata.Items {
+		if _, exists := values[item.Key]; !exists {
+			items = append(items, item)
+		}
+	}
+
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if values[key] != "" {
+			value := values[key]
+			items = append(items, &compute.MetadataItems{Key: key, Value: &value})
+		}
+	}
+	metadata.Items = items
+}
+
+// Write the DNS outcome to the VM metadata, visible to guest scripts and `gcloud compute instances describe`
+func writeDnsStatus(ctx context.Context, vm_info VMInfo, dnsRes dnsResult) bool {
+	if writeBack == "" {
+		return false
+	}
+	if replaying {
+		// Replayed outcomes are history, the VM may have changed or be gone since
+		fmt.Printf("Replay, DNS status %v not written to %q\n", dnsRes.Status, vm_info.Name)
+		return false
+	}
+
+	gce := computeService(ctx)
+	// Fingerprint is rejected with a 412 when the metadata changed in between, retried on a fresh copy
+	err := withRebuildRetry(ctx, "compute.instances.setMetadata", func() error {
+		vm, err := gce.Instances.Get(vm_info.VMProject, vm_info.Zone, vm_info.Name).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		metadata := vm.Metadata
+		if metadata == nil {
+			metadata = &compute.Metadata{}
+		}
+		mergeMetadata(metadata, dnsStatusMetadata(dnsRes))
+
+		_, err = gce.Instances.SetMetadata(vm_info.VMProject, vm_info.Zone, vm_info.Name, metadata).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Error writing DNS status to %q: %v\n", vm_info.Name, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package gcedns
+
+import (
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestMergeMetadata(t *testing.T) {
+
+	startup, stale := "#!/bin/bash", "denied"
+	metadata := &compute.Metadata{
+		Fingerprint: "abc",
+		Items: []*compute.MetadataItems{
+			{Key: "startup-script", Value: &startup},
+			{Key: "dns-status", Value: &stale},
+			{Key: "dns-reason", Value: &stale},
+		},
+	}
+
+	mergeMetadata(metadata, dnsStatusMetadata(dnsResult{Status: dnsCreated, FQDN: "dev01.gcp.company.com."}))
+
+	values := make(map[string]string)
+	for _, item := range metadata.Items {
+		values[item.Key] = *item.Value
+	}
+	expected := map[string]string{
+		"startup-script": startup,
+		"dns-status":     dnsCreated,
+		"dns-fqdn":       "dev01.gcp.company.com.",
+	}
+	if len(values) != len(expected) {
+		t.Errorf("FAILED: got %v expected %v\n", values, expected)
+	}
+	for key, value := range expected {
+		if values[key] != value {
+			t.Errorf("FAILED: %v: got %q expected %q\n", key, values[key], value)
+		}
+	}
+	if metadata.Fingerprint != "abc" {
+		t.Errorf("FAILED: fingerprint changed to %q\n", metadata.Fingerprint)
+	}
+}